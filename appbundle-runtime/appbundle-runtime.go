@@ -42,6 +42,7 @@ var globalPath = getEnv(globalEnv, "PATH")
 
 type RuntimeConfig struct {
 	poolDir              string
+	defaultPoolDir       string
 	workDir              string
 	rExeName             string
 	mountDir             string
@@ -58,6 +59,14 @@ type RuntimeConfig struct {
 	mountOrExtract       uint8
 	noCleanup            bool
 	disableRandomWorkDir bool
+	inUserns             bool
+	outerUid             int
+	outerGid             int
+	fuseDev              *os.File
+	extractCacheLock     *os.File // Shared lock on the extraction cache entry we run from, held until we exit
+	noSandbox            bool
+	commands             map[string]string
+	command              string
 }
 
 type fileHandler struct {
@@ -99,6 +108,10 @@ func mountImage(cfg *RuntimeConfig, fh *fileHandler, fs *Filesystem) error {
 		return nil
 	}
 
+	if cfg.inUserns {
+		return mountImageUserns(cfg, fs)
+	}
+
 	cmd := fs.MountCmd(cfg)
 	cmd.SetStdout(os.Stdout)
 	cmd.SetStderr(os.Stderr)
@@ -120,6 +133,9 @@ func extractImage(cfg *RuntimeConfig, fh *fileHandler, fs *Filesystem, query str
 	if err := os.MkdirAll(cfg.mountDir, 0755); err != nil {
 		return fmt.Errorf("failed to create mount directory %s: %v", cfg.mountDir, err)
 	}
+	if err := checkFreeSpace(cfg, fh, cfg.mountDir); err != nil {
+		return err
+	}
 	cmd := fs.ExtractCmd(cfg, query)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
@@ -152,7 +168,7 @@ func (f *fileHandler) readPlaceholdersAndMarkers(cfg *RuntimeConfig) error {
 	data, err := xattr.FGet(f.file, "user.RuntimeConfig")
 	if err == nil {
 		lines := strings.Split(string(data), "\n")
-		if len(lines) >= 8 {
+		if len(lines) >= 10 {
 			cfg.appBundleFS = lines[0]
 			cfg.archiveOffset = uint64(parseUint(lines[1]))
 			cfg.exeName = lines[2]
@@ -163,6 +179,8 @@ func (f *fileHandler) readPlaceholdersAndMarkers(cfg *RuntimeConfig) error {
 			if n, err := strconv.ParseUint(lines[7], 10, 8); err == nil {
 				cfg.mountOrExtract = uint8(n)
 			}
+			cfg.defaultPoolDir = lines[8]
+			cfg.commands = decodeCommands(lines[9])
 			return nil
 		}
 	}
@@ -200,9 +218,13 @@ func (f *fileHandler) readPlaceholdersAndMarkers(cfg *RuntimeConfig) error {
 	cfg.mountOrExtract = runtimeInfo["MountOrExtract"].(uint8) // cfg.mountOrExtract = uint8(runtimeInfo["MountOrExtract"].(uint64))
 	cfg.disableRandomWorkDir = runtimeInfo["DisableRandomWorkDir"].(bool)
 	cfg.archiveOffset = cfg.elfFileSize
+	if poolDir, ok := runtimeInfo["PoolDir"].(string); ok {
+		cfg.defaultPoolDir = poolDir
+	}
+	cfg.commands = parseCommands(runtimeInfo["Commands"])
 
-	xattrData := fmt.Sprintf("%s\n%d\n%s\n%s\n%s\n%s\n%s\n%d\n",
-		cfg.appBundleFS, cfg.archiveOffset, cfg.exeName, cfg.pelfVersion, cfg.pelfHost, cfg.hash, T(cfg.disableRandomWorkDir, "1", ""), cfg.mountOrExtract)
+	xattrData := fmt.Sprintf("%s\n%d\n%s\n%s\n%s\n%s\n%s\n%d\n%s\n%s\n",
+		cfg.appBundleFS, cfg.archiveOffset, cfg.exeName, cfg.pelfVersion, cfg.pelfHost, cfg.hash, T(cfg.disableRandomWorkDir, "1", ""), cfg.mountOrExtract, cfg.defaultPoolDir, encodeCommands(cfg.commands))
 	if err := xattr.FSet(f.file, "user.RuntimeConfig", []byte(xattrData)); err != nil {
 		return fmt.Errorf("failed to set xattr: %w", err)
 	}
@@ -291,12 +313,10 @@ func setEnv(env *[]string, key, value string) {
 
 func initConfig() (*RuntimeConfig, *fileHandler, error) {
 	cfg := &RuntimeConfig{
-		exeName:              "",
-		poolDir:              filepath.Join(os.TempDir(), ".pelfbundles"),
-		selfPath:             getSelfPath(),
-		disableRandomWorkDir: T(getEnv(globalEnv, "PBUNDLE_DISABLE_RANDOM_WORKDIR") == "1", true, false),
-		noCleanup:            false,
-		mountOrExtract:       2,
+		exeName:        "",
+		selfPath:       getSelfPath(),
+		noCleanup:      false,
+		mountOrExtract: 2,
 	}
 
 	fh, err := newFileHandler(cfg.selfPath)
@@ -313,16 +333,18 @@ func initConfig() (*RuntimeConfig, *fileHandler, error) {
 	}
 
 	cfg.rExeName = sanitizeFilename(cfg.exeName)
+	dispatchMulticall(cfg)
 
-	cfg.workDir = getWorkDir(cfg, fh)
-	cfg.mountDir = filepath.Join(cfg.workDir, "mounted")
-	cfg.entrypoint = filepath.Join(cfg.mountDir, "AppRun")
-	cfg.staticToolsDir = filepath.Join(cfg.poolDir, ".static")
+	if err := loadBundleSettings(cfg); err != nil {
+		logError("Failed to load the settings of the AppBundle", err, cfg)
+	}
 
-	if err := os.MkdirAll(cfg.workDir, 0755); err != nil {
+	if err := setPoolDir(cfg, fh, cfg.mountOrExtract == 1); err != nil {
 		logError("Failed to create work directory", err, cfg)
 	}
 
+	initUserns(cfg)
+
 	return cfg, fh, nil
 }
 
@@ -405,40 +427,16 @@ func setSelfEnv(cfg *RuntimeConfig, dirSuffix, envVar, oldEnvVar, defaultValue s
 }
 
 func setSelfEnvs(cfg *RuntimeConfig) error {
-	homeDir := getEnv(globalEnv, "HOME")
-
-	// XDG_CONFIG_HOME special logic
-	configDir := cfg.selfPath + ".config"
-	if _, err := os.Stat(configDir); err == nil {
-		// Save real value if not already saved
-		if getEnv(globalEnv, "REAL_XDG_CONFIG_HOME") == "" {
-			real := getEnv(globalEnv, "XDG_CONFIG_HOME")
-			if real == "" {
-				real = filepath.Join(homeDir, ".config")
-			}
-			setEnv(&globalEnv, "REAL_XDG_CONFIG_HOME", real)
-		}
-		setEnv(&globalEnv, "XDG_CONFIG_HOME", configDir)
-	}
-
-	// Other XDG directories (no special logic, just override if present)
-	for _, item := range []struct {
-		suffix, env, realEnv, def string
-	}{
-		{".share", "XDG_DATA_HOME", "REAL_XDG_DATA_HOME", filepath.Join(homeDir, ".local", "share")},
-		{".cache", "XDG_CACHE_HOME", "REAL_XDG_CACHE_HOME", filepath.Join(homeDir, ".cache")},
-		{".home", "HOME", "REAL_HOME", homeDir},
-	} {
-		dir := cfg.selfPath + item.suffix
+	// The portable dirs next to the bundle replace the user's, the real values are kept in REAL_*
+	for _, p := range portableDirs {
+		dir := cfg.selfPath + p.suffix
 		if _, err := os.Stat(dir); err == nil {
-			if getEnv(globalEnv, item.realEnv) == "" {
-				old := getEnv(globalEnv, item.env)
-				if old == "" {
-					old = item.def
+			if getEnv(globalEnv, p.realEnv) == "" {
+				if real := p.realDir(); real != "" {
+					setEnv(&globalEnv, p.realEnv, real)
 				}
-				setEnv(&globalEnv, item.realEnv, old)
 			}
-			setEnv(&globalEnv, item.env, dir)
+			setEnv(&globalEnv, p.env, dir)
 		}
 	}
 
@@ -483,18 +481,42 @@ func executeFile(args []string, cfg *RuntimeConfig) error {
 	// COMPAT
 	setEnv(&globalEnv, "APPIMAGE", cfg.selfPath)
 
-	executableFile, err := lookPath(cfg.entrypoint, globalPath)
+	entrypoint := cfg.entrypoint
+	if cfg.command != "" && entrypoint == filepath.Join(cfg.mountDir, "AppRun") {
+		// Invoked through a symlink named after one of our commands, there's no need to go through the AppRun
+		entrypoint = filepath.Join(cfg.mountDir, cfg.command)
+	}
+
+	executableFile, err := lookPath(entrypoint, globalPath)
 	if err != nil {
-		return fmt.Errorf("Unable to find the location of %s: %v", cfg.entrypoint, err)
+		return fmt.Errorf("Unable to find the location of %s: %v", entrypoint, err)
 	}
 
 	setSelfEnvs(cfg)
 
+	profile, err := loadSandboxProfile(cfg)
+	if err != nil {
+		logError("Unable to sandbox the AppBundle", err, cfg)
+	}
+	var extraFiles []*os.File
+	if profile != nil {
+		if executableFile, args, extraFiles, err = sandboxCommand(cfg, profile, executableFile, args); err != nil {
+			logError("Unable to sandbox the AppBundle (--pbundle_sandbox=off disables the sandbox)", err, cfg)
+		}
+	}
+	defer func() {
+		for _, f := range extraFiles {
+			f.Close()
+		}
+	}()
+
 	cmd := exec.Command(executableFile, args...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.Env = globalEnv
+	cmd.ExtraFiles = extraFiles
+	cmd.SysProcAttr = usernsSysProcAttr(cfg)
 	return cmd.Run()
 }
 
@@ -502,7 +524,7 @@ func updatePath(envVar, dirs string) string {
 	var newPath string
 	if getEnv(globalEnv, envVar) == "" {
 		newPath = dirs
-	} else if getEnv(globalEnv, fmt.Sprintf("PBUNDLE_OVERTAKE_%s", envVar)) == "1" {
+	} else if getSetting(fmt.Sprintf("PBUNDLE_OVERTAKE_%s", envVar)) == "1" {
 		newPath = dirs + ":" + getEnv(globalEnv, envVar)
 	} else {
 		newPath = getEnv(globalEnv, envVar) + ":" + dirs
@@ -514,8 +536,13 @@ func updatePath(envVar, dirs string) string {
 }
 
 func detachedCleanup(cfg *RuntimeConfig) {
+	if cfg.inUserns {
+		// Nobody else can see our mount, but the FUSE driver would outlive us if we didn't unmount it
+		_ = syscall.Unmount(cfg.mountDir, syscall.MNT_DETACH)
+	}
 	if cfg.noCleanup { return }
-	cmd := exec.Command(os.Args[0], "--pbundle_internal_Cleanup", cfg.mountDir, cfg.poolDir, cfg.workDir, T(cfg.mountOrExtract == 1, "1", ""))
+	// Not os.Args[0], which is a bare command name when run through a command symlink, and would be looked up in $PATH
+	cmd := exec.Command(cfg.selfPath, "--pbundle_internal_Cleanup", cfg.mountDir, cfg.poolDir, cfg.workDir, T(cfg.mountOrExtract == 1, "1", ""))
 	cmd.Stdin = nil
 	cmd.Stdout = nil
 	cmd.Stderr = nil
@@ -525,6 +552,10 @@ func detachedCleanup(cfg *RuntimeConfig) {
 }
 
 func fuseUnmount(mountDir string) {
+	if isLoopMounted(mountDir) {
+		loopUnmount(mountDir)
+		return
+	}
 	cmd := exec.Command("fusermount3", "-u", mountDir)
 	cmd.Env = globalEnv
 	cmd.Run()
@@ -638,6 +669,9 @@ func main() {
 		cleanup(os.Args[2], os.Args[3], os.Args[4], os.Args[5])
 		os.Exit(0)
 	}
+	if len(os.Args) > 2 && os.Args[1] == "--pbundle_internal_Confine" {
+		runConfined(os.Args[2:])
+	}
 
 	cfg, fh, err := initConfig()
 	if err != nil {
@@ -737,6 +771,12 @@ func isExecutableFile(file string) error {
 }
 
 func mountOrExtract(cfg *RuntimeConfig, fh *fileHandler) {
+	if cfg.mountOrExtract != 1 && !(cfg.mountOrExtract == 4 && canLoopMount(cfg)) && useUserns(cfg) {
+		if err := execInUserns(cfg); err != nil {
+			logWarning(fmt.Sprintf("Unable to mount the AppBundle within a user namespace: %v", err))
+		}
+	}
+
 	fs, err := checkDeps(cfg, fh)
 	if err != nil {
 		logError("Unexpected failure when checking the availability of the AppBundle's dependencies", err, cfg)
@@ -750,14 +790,14 @@ func mountOrExtract(cfg *RuntimeConfig, fh *fileHandler) {
 		}
 	case 1:
 		// Do not use FUSE mounting, but extract and run
-		if err := extractImage(cfg, fh, fs, ""); err != nil {
+		if err := extractOrReuse(cfg, fh, fs); err != nil {
 			logError("Failed to extract image", err, cfg)
 		}
 	case 2:
 		// Try to use FUSE mounting and if it is unavailable extract and run
 		if err := mountImage(cfg, fh, fs); err != nil {
 			logWarning("FUSE mounting failed, falling back to extraction")
-			if err := extractImage(cfg, fh, fs, ""); err != nil {
+			if err := extractOrReuse(cfg, fh, fs); err != nil {
 				logError("Failed to extract image", err, cfg)
 			}
 		}
@@ -767,15 +807,25 @@ func mountOrExtract(cfg *RuntimeConfig, fh *fileHandler) {
 		if cfg.elfFileSize < defaultSizeLimit {
 			if err := mountImage(cfg, fh, fs); err != nil {
 				logWarning("FUSE mounting failed, falling back to extraction")
-				if err := extractImage(cfg, fh, fs, ""); err != nil {
+				if err := extractOrReuse(cfg, fh, fs); err != nil {
 					logError("Failed to extract image", err, cfg)
 				}
 			}
 		} else {
-			if err := extractImage(cfg, fh, fs, ""); err != nil {
+			if err := extractOrReuse(cfg, fh, fs); err != nil {
 				logError("Failed to extract image", err, cfg)
 			}
 		}
+	case 4:
+		// Try to let the kernel mount the image, then FUSE mounting, and if both are unavailable extract and run
+		if err := loopMountImage(cfg, fh); err != nil {
+			if err := mountImage(cfg, fh, fs); err != nil {
+				logWarning("FUSE mounting failed, falling back to extraction")
+				if err := extractOrReuse(cfg, fh, fs); err != nil {
+					logError("Failed to extract image", err, cfg)
+				}
+			}
+		}
 	default:
 		logError("Invalid value for mountOrExtract", nil, cfg)
 	}
@@ -791,7 +841,7 @@ func T[T any](cond bool, vtrue, vfalse T) T {
 
 // --- DWARFS ---
 func getDwarfsCacheSize() string {
-	if s := os.Getenv("DWARFS_CACHESIZE"); s != "" {
+	if s := getSetting("DWARFS_CACHESIZE"); s != "" {
 		return s
 	}
 	m, _ := mem.VirtualMemory()
@@ -805,7 +855,7 @@ func getDwarfsCacheSize() string {
 }
 
 func getDwarfsWorkers(cachesize *string) string {
-	workers := getEnv(globalEnv, "DWARFS_WORKERS")
+	workers := getSetting("DWARFS_WORKERS")
 	if workers != "" {
 		return workers
 	}
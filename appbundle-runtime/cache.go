@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// Default size budget of the extraction cache, can be changed via $PBUNDLE_EXTRACT_CACHE_SIZE
+	EXTRACT_CACHE_SIZE = "4G"
+	// Written once an extraction has been completed, it contains the size of the extracted tree
+	extractCacheMarker = ".pbundle_complete"
+)
+
+type cacheEntry struct {
+	dir      string
+	size     uint64
+	lastUsed time.Time
+}
+
+func extractCacheEnabled(cfg *RuntimeConfig) bool {
+	return getSetting("PBUNDLE_EXTRACT_CACHE") == "1" && cfg.hash != ""
+}
+
+// getExtractCacheDir returns $XDG_CACHE_HOME/pelfbundles, or its $HOME/.cache equivalent
+func getExtractCacheDir() string {
+	if dir := getSetting("PBUNDLE_EXTRACT_CACHE_DIR"); dir != "" {
+		return dir
+	}
+	if dir := getEnv(globalEnv, "XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, "pelfbundles")
+	}
+	return filepath.Join(getEnv(globalEnv, "HOME"), ".cache", "pelfbundles")
+}
+
+// extractOrReuse extracts the image to the work dir, or, if the extraction cache is enabled,
+// reuses a previous extraction of the same image (as identified by cfg.hash)
+func extractOrReuse(cfg *RuntimeConfig, fh *fileHandler, fs *Filesystem) error {
+	if !extractCacheEnabled(cfg) {
+		if err := setPoolDir(cfg, fh, true); err != nil {
+			return err
+		}
+		return extractImage(cfg, fh, fs, "")
+	}
+
+	cacheDir := getExtractCacheDir()
+	if err := ensurePoolDir(cacheDir); err != nil {
+		return fmt.Errorf("unusable extraction cache directory: %w", err)
+	}
+	entryDir := filepath.Join(cacheDir, cfg.hash)
+	rootDir := filepath.Join(entryDir, "root")
+
+	if lock := lockExtractCacheEntry(entryDir); lock != nil {
+		cfg.extractCacheLock = lock
+		now := time.Now()
+		_ = os.Chtimes(filepath.Join(entryDir, extractCacheMarker), now, now)
+	} else {
+		tmpDir := entryDir + ".tmp-" + generateRandomString(4)
+		defer os.RemoveAll(tmpDir)
+
+		mountDir := cfg.mountDir
+		cfg.mountDir = filepath.Join(tmpDir, "root")
+		err := extractImage(cfg, fh, fs, "")
+		cfg.mountDir = mountDir
+		if err != nil {
+			return err
+		}
+
+		// The lock is taken before the entry is marked complete, so that it can't be evicted, and it follows the directory once it is renamed
+		lock, err := lockDir(tmpDir, syscall.LOCK_SH)
+		if err != nil {
+			return fmt.Errorf("failed to lock the extraction cache entry: %w", err)
+		}
+		size := dirSize(filepath.Join(tmpDir, "root"))
+		if err := os.WriteFile(filepath.Join(tmpDir, extractCacheMarker), []byte(strconv.FormatUint(size, 10)), 0644); err != nil {
+			lock.Close()
+			return fmt.Errorf("failed to write the extraction cache marker: %w", err)
+		}
+		// Another instance may have won the race, in which case we use its extraction and ours gets removed
+		if err := os.Rename(tmpDir, entryDir); err != nil {
+			if other := lockExtractCacheEntry(entryDir); other != nil {
+				lock.Close()
+				lock = other
+			} else {
+				os.RemoveAll(entryDir)
+				if err := os.Rename(tmpDir, entryDir); err != nil {
+					lock.Close()
+					return fmt.Errorf("failed to populate the extraction cache: %w", err)
+				}
+			}
+		}
+		cfg.extractCacheLock = lock
+
+		evictExtractCache(cacheDir)
+	}
+
+	rmEmptyDir(cfg.mountDir)
+	if cfg.entrypoint == filepath.Join(cfg.mountDir, "AppRun") {
+		cfg.entrypoint = filepath.Join(rootDir, "AppRun")
+	}
+	cfg.mountDir = rootDir
+	return nil
+}
+
+func isExtractCacheComplete(entryDir string) bool {
+	_, err := os.Stat(filepath.Join(entryDir, extractCacheMarker))
+	return err == nil
+}
+
+// lockDir opens dir and takes a flock(2) of the given kind on it. The lock lasts until the returned file is closed
+func lockDir(dir string, how int) (*os.File, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// lockExtractCacheEntry takes a shared lock on a complete cache entry, which keeps it from being evicted while we run from it.
+// It returns nil if the entry is missing or incomplete
+func lockExtractCacheEntry(entryDir string) *os.File {
+	lock, err := lockDir(entryDir, syscall.LOCK_SH)
+	if err != nil {
+		return nil
+	}
+	// The entry may have been evicted, or replaced, while we waited for the lock
+	locked, err := lock.Stat()
+	current, err2 := os.Stat(entryDir)
+	if err != nil || err2 != nil || !os.SameFile(locked, current) || !isExtractCacheComplete(entryDir) {
+		lock.Close()
+		return nil
+	}
+	return lock
+}
+
+// evictExtractCache removes the least recently used entries until the cache fits within its budget.
+// Entries that running instances hold a shared lock on (our own included) are skipped
+func evictExtractCache(cacheDir string) {
+	budget, err := parseSize(getSettingWithDefault("PBUNDLE_EXTRACT_CACHE_SIZE", EXTRACT_CACHE_SIZE))
+	if err != nil {
+		logWarning(fmt.Sprintf("Invalid PBUNDLE_EXTRACT_CACHE_SIZE: %v", err))
+		return
+	}
+
+	dirs, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return
+	}
+
+	var entries []cacheEntry
+	var total uint64
+	for _, d := range dirs {
+		entryDir := filepath.Join(cacheDir, d.Name())
+		marker := filepath.Join(entryDir, extractCacheMarker)
+		fi, err := os.Stat(marker)
+		if !d.IsDir() || err != nil {
+			continue
+		}
+		data, _ := os.ReadFile(marker)
+		size := parseUint(strings.TrimSpace(string(data)))
+		entries = append(entries, cacheEntry{dir: entryDir, size: size, lastUsed: fi.ModTime()})
+		total += size
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastUsed.Before(entries[j].lastUsed)
+	})
+
+	for _, e := range entries {
+		if total <= budget {
+			break
+		}
+		lock, err := lockDir(e.dir, syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != nil {
+			continue
+		}
+		// Make it incomplete first, so that no one picks up a half-removed entry
+		if err := os.Remove(filepath.Join(e.dir, extractCacheMarker)); err == nil {
+			os.RemoveAll(e.dir)
+			total -= e.size
+		}
+		lock.Close()
+	}
+}
+
+func dirSize(dir string) uint64 {
+	var size uint64
+	_ = filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += uint64(info.Size())
+		}
+		return nil
+	})
+	return size
+}
+
+// parseSize parses sizes such as "512M" or "4G", bare numbers are bytes
+func parseSize(s string) (uint64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	if s == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+	mult := uint64(1)
+	if i := strings.IndexByte("KMGT", s[len(s)-1]); i >= 0 {
+		mult = 1 << (10 * (i + 1))
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
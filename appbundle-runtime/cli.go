@@ -30,11 +30,25 @@ func handleRuntimeFlags(fh *fileHandler, args *[]string, cfg *RuntimeConfig) err
   --pbundle_svgIcon: Sends to stdout the base64 encoded .DirIcon.svg, exits with error number 1 if the .DirIcon does not exist
   --pbundle_appstream: Same as --pbundle_pngIcon but it uses the first .xml file it encounters on the top level of the AppDir
   --pbundle_desktop: Same as --pbundle_pngIcon but it uses the first .desktop file it encounters on the top level of the AppDir
-  --pbundle_portableHome: Creates a directory in the same place as the AppBundle, which will be used as $HOME during subsequent runs
-  --pbundle_portableConfig: Creates a directory in the same place as the AppBundle, which will be used as $XDG_CONFIG_HOME during subsequent runs
+  --pbundle_mimeInfo: Sends to stdout the base64 encoded shared-mime-info packages of the AppDir (usr/share/mime/packages/*.xml), one per line
+  --pbundle_portable <kind|all>: Creates directories in the same place as the AppBundle, which will be used instead of the user's during subsequent runs
+                                 Kinds: home ($HOME), config ($XDG_CONFIG_HOME), share ($XDG_DATA_HOME), cache ($XDG_CACHE_HOME),
+                                 state ($XDG_STATE_HOME) and runtime ($XDG_RUNTIME_DIR). Several kinds may be given, e.g: --pbundle_portable config,share
+  --pbundle_portable_migrate [names]: Copies the app's data (<name> within the real XDG dirs, .<name> within $HOME) into the portable directories that exist
+                                      The names default to the name of the AppBundleID
+  --pbundle_portable_export [file]: Writes a tarball of the portable directories to <file> (default: ./<bundle>.portable.tar.gz, "-" is stdout)
+  --pbundle_portableHome: Same as --pbundle_portable home
+  --pbundle_portableConfig: Same as --pbundle_portable config
   --pbundle_cleanup: Unmounts, removes, and tides up the AppBundle's workdir and mount pool. Does not affect other running AppBundles
                      Only affects other instances of this same AppBundle.
   --pbundle_mount: Mounts the AppBundle's filesystem to the specified directory or the default mount directory.
+  --pbundle_commands: Lists the commands of this AppBundle, which are run directly when the AppBundle is invoked through a symlink named after them
+  --pbundle_install-links <dir>: Creates a symlink to the AppBundle in <dir> for each of its commands
+  --pbundle_integrate [defaults]: Installs the .desktop file, icons and MIME types of the AppBundle within $XDG_DATA_HOME, and creates its thumbnails
+                                 Running it again refreshes the integration, e.g: after the AppBundle was updated
+                                 With "defaults", the AppBundle also becomes the default application for the MIME types and URL schemes of its .desktop file
+  --pbundle_deintegrate: Removes what --pbundle_integrate installed, and gives the MIME types back to the applications that they belonged to
+  --pbundle_sandbox=off: Runs the AppBundle without the sandbox declared by its sandbox profile (if any). It may precede any other flag
 `)
 
 		if cfg.appBundleFS != "dwarfs" {
@@ -83,6 +97,35 @@ func handleRuntimeFlags(fh *fileHandler, args *[]string, cfg *RuntimeConfig) err
 		}
 		return fmt.Errorf("!no_return")
 
+	case "--pbundle_portable":
+		if len(*args) < 2 {
+			return fmt.Errorf("missing argument for --pbundle_portable, valid kinds are: %s, all", strings.Join(portableKinds(), ", "))
+		}
+		dirs, err := parsePortableKinds((*args)[1:])
+		if err != nil {
+			return err
+		}
+		if err := createPortableDirs(cfg, dirs); err != nil {
+			return err
+		}
+		return fmt.Errorf("!no_return")
+
+	case "--pbundle_portable_migrate":
+		if err := migratePortableDirs(cfg, (*args)[1:]); err != nil {
+			return err
+		}
+		return fmt.Errorf("!no_return")
+
+	case "--pbundle_portable_export":
+		output := ""
+		if len(*args) > 1 {
+			output = (*args)[1]
+		}
+		if err := exportPortableDirs(cfg, output); err != nil {
+			return err
+		}
+		return fmt.Errorf("!no_return")
+
 	case "--pbundle_link":
 		if len(*args) < 2 {
 			return fmt.Errorf("missing binary argument for --pbundle_link")
@@ -117,6 +160,10 @@ func handleRuntimeFlags(fh *fileHandler, args *[]string, cfg *RuntimeConfig) err
 		mountOrExtract(cfg, fh)
 		return findAndEncodeFiles(cfg.mountDir, "*.xml", cfg)
 
+	case "--pbundle_mimeInfo":
+		mountOrExtract(cfg, fh)
+		return findAndEncodeFiles(filepath.Join(cfg.mountDir, "usr", "share", "mime", "packages"), "*.xml", cfg)
+
 	case "--pbundle_extract":
 		query := ""
 		if len(*args) > 1 {
@@ -151,11 +198,14 @@ func handleRuntimeFlags(fh *fileHandler, args *[]string, cfg *RuntimeConfig) err
 
 	case "--pbundle_extract_and_run", "--appimage-extract-and-run":
 		cfg.mountOrExtract = 1
+		if err := setPoolDir(cfg, fh, true); err != nil {
+			return err
+		}
 		fs, err := checkDeps(cfg, fh)
 		if err != nil {
 			return err
 		}
-		if err := extractImage(cfg, fh, fs, ""); err != nil {
+		if err := extractOrReuse(cfg, fh, fs); err != nil {
 			return err
 		}
 		*args = (*args)[1:]
@@ -192,6 +242,49 @@ func handleRuntimeFlags(fh *fileHandler, args *[]string, cfg *RuntimeConfig) err
 		fmt.Println(cfg.archiveOffset)
 		return fmt.Errorf("!no_return")
 
+	case "--pbundle_commands":
+		listCommands(cfg)
+		return fmt.Errorf("!no_return")
+
+	case "--pbundle_install-links":
+		if len(*args) < 2 {
+			return fmt.Errorf("missing directory argument for --pbundle_install-links")
+		}
+		if err := installLinks(cfg, (*args)[1]); err != nil {
+			return err
+		}
+		return fmt.Errorf("!no_return")
+
+	case "--pbundle_integrate":
+		setDefaults := false
+		if len(*args) > 1 {
+			if (*args)[1] != "defaults" {
+				return fmt.Errorf("unknown argument for --pbundle_integrate: %q", (*args)[1])
+			}
+			setDefaults = true
+		}
+		mountOrExtract(cfg, fh)
+		if err := integrateBundle(cfg, setDefaults); err != nil {
+			return err
+		}
+		return fmt.Errorf("!no_return")
+
+	case "--pbundle_deintegrate":
+		if err := deintegrateBundle(cfg); err != nil {
+			return err
+		}
+		return fmt.Errorf("!no_return")
+
+	case "--pbundle_sandbox=off":
+		logWarning("The sandbox of this AppBundle has been disabled")
+		cfg.noSandbox = true
+		*args = (*args)[1:]
+		if len(*args) > 0 {
+			return handleRuntimeFlags(fh, args, cfg)
+		}
+		mountOrExtract(cfg, fh)
+		_ = executeFile(*args, cfg)
+
 	case "--pbundle_cleanup":
 		fmt.Println("A cleanup job has been requested...")
 		cfg.noCleanup = false
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// parseCommands reads the Commands table of the RuntimeInfo, which maps command names to executables within the AppDir
+func parseCommands(v any) map[string]string {
+	commands := map[string]string{}
+	add := func(name, path any) {
+		n, ok1 := name.(string)
+		p, ok2 := path.(string)
+		if ok1 && ok2 && isCommandName(n) && filepath.IsLocal(p) && !strings.ContainsAny(p, "\t\n") {
+			commands[n] = p
+		}
+	}
+	switch table := v.(type) {
+	case map[string]any:
+		for name, path := range table {
+			add(name, path)
+		}
+	case map[any]any:
+		for name, path := range table {
+			add(name, path)
+		}
+	}
+	return commands
+}
+
+// isCommandName reports whether name can be the name of a command symlink. Tabs, newlines and '=' would also corrupt the
+// encoding of the command table
+func isCommandName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\t\n=")
+}
+
+// encodeCommands and decodeCommands (de)serialize the command table for the user.RuntimeConfig xattr, as tab-separated name=path pairs
+func encodeCommands(commands map[string]string) string {
+	pairs := make([]string, 0, len(commands))
+	for _, name := range sortedCommands(commands) {
+		pairs = append(pairs, name+"="+commands[name])
+	}
+	return strings.Join(pairs, "\t")
+}
+
+func decodeCommands(s string) map[string]string {
+	commands := map[string]string{}
+	for _, pair := range strings.Split(s, "\t") {
+		if name, path, ok := strings.Cut(pair, "="); ok {
+			commands[name] = path
+		}
+	}
+	return commands
+}
+
+func sortedCommands(commands map[string]string) []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// dispatchMulticall picks the command to run when the AppBundle is invoked through a symlink named after one of its commands
+func dispatchMulticall(cfg *RuntimeConfig) {
+	argv0 := filepath.Base(os.Args[0])
+	if argv0 == filepath.Base(cfg.selfPath) {
+		return
+	}
+	if path, ok := cfg.commands[argv0]; ok {
+		cfg.command = path
+	}
+}
+
+// listCommands prints the command table, as used by --pbundle_commands
+func listCommands(cfg *RuntimeConfig) {
+	for _, name := range sortedCommands(cfg.commands) {
+		fmt.Printf("%s\t%s\n", name, cfg.commands[name])
+	}
+}
+
+// installLinks creates a symlink to the AppBundle in dir for every command, existing files that are not links to the AppBundle are left alone
+func installLinks(cfg *RuntimeConfig, dir string) error {
+	if len(cfg.commands) == 0 {
+		return fmt.Errorf("this AppBundle does not declare any commands")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for _, name := range sortedCommands(cfg.commands) {
+		link := filepath.Join(dir, name)
+		if target, err := filepath.EvalSymlinks(link); err == nil {
+			if target != cfg.selfPath {
+				logWarning(fmt.Sprintf("Not overwriting %s, as it is not a link to this AppBundle", link))
+			}
+			continue
+		}
+		// Dangling links (such as those of an AppBundle that was moved) are replaced
+		if fi, err := os.Lstat(link); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			os.Remove(link)
+		}
+		if err := os.Symlink(cfg.selfPath, link); err != nil {
+			return fmt.Errorf("failed to create %s: %w", link, err)
+		}
+		fmt.Println(link)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// bundleSettings holds the settings read from the config files of the AppBundle, as "KEY=value" pairs named after their
+// env variables. Unlike globalEnv, it is only used for the runtime's own lookups, so that the settings of an AppBundle
+// don't reach the AppRun, nor the AppBundles that it starts
+var bundleSettings []string
+
+// BundleSettings is the structured, per-AppBundle equivalent of the env variables understood by the runtime. It is read from
+// <bundle>.pbundle.toml and $XDG_CONFIG_HOME/pelfbundles/<AppBundleID>.toml. Order of precedence (highest first):
+// the env, <bundle>.pbundle.toml, $XDG_CONFIG_HOME/pelfbundles/<AppBundleID>.toml, the RuntimeInfo, the runtime's defaults
+type BundleSettings struct {
+	RunBehavior          *uint8  `toml:"run_behavior"`           // PBUNDLE_RUN_BEHAVIOR
+	DisableRandomWorkDir *bool   `toml:"disable_random_workdir"` // PBUNDLE_DISABLE_RANDOM_WORKDIR
+	PoolDir              *string `toml:"pool_dir"`               // PBUNDLE_POOL_DIR
+	OvertakePath         *bool   `toml:"overtake_path"`          // PBUNDLE_OVERTAKE_PATH
+	Userns               *bool   `toml:"userns"`                 // PBUNDLE_USERNS
+	NoMemfdExec          *bool   `toml:"no_memfdexec"`           // NO_MEMFDEXEC
+	FuseDebug            *bool   `toml:"fuse_debug"`             // ENABLE_FUSE_DEBUG
+
+	ExtractCache struct {
+		Enabled *bool   `toml:"enabled"` // PBUNDLE_EXTRACT_CACHE
+		Dir     *string `toml:"dir"`     // PBUNDLE_EXTRACT_CACHE_DIR
+		Size    *string `toml:"size"`    // PBUNDLE_EXTRACT_CACHE_SIZE
+	} `toml:"extract_cache"`
+
+	Dwarfs struct {
+		CacheSize      *string `toml:"cachesize"`       // DWARFS_CACHESIZE
+		Workers        *uint   `toml:"workers"`         // DWARFS_WORKERS
+		Readahead      *string `toml:"readahead"`       // DWARFS_READAHEAD
+		BlockSize      *string `toml:"blocksize"`       // DWARFS_BLOCKSIZE
+		BlockAllocator *string `toml:"block_allocator"` // DWARFS_BLOCK_ALLOCATOR
+		TidyStrategy   *string `toml:"tidy_strategy"`   // DWARFS_TIDY_STRATEGY
+		PreloadAll     *bool   `toml:"preload_all"`     // DWARFS_PRELOAD_ALL
+		AnalysisFile   *string `toml:"analysis_file"`   // DWARFS_ANALYSIS_FILE
+	} `toml:"dwarfs"`
+
+	// Passed on to the AppRun, like the contents of <bundle>.env
+	Env map[string]string `toml:"env"`
+}
+
+// getSetting returns the value of a setting of the runtime: its env variable or, failing that, what the config files say
+func getSetting(key string) string {
+	if value := getEnv(globalEnv, key); value != "" {
+		return value
+	}
+	return getEnv(bundleSettings, key)
+}
+
+// getSettingWithDefault is getSetting, falling back to defaultValue if the setting is set nowhere
+func getSettingWithDefault(key, defaultValue string) string {
+	return getEnvWithDefault(globalEnv, key, getEnvWithDefault(bundleSettings, key, defaultValue))
+}
+
+// bundleSettingsPaths returns the config files of the AppBundle, the one that takes precedence comes first
+func bundleSettingsPaths(cfg *RuntimeConfig) []string {
+	configHome := getEnv(globalEnv, "XDG_CONFIG_HOME")
+	if configHome == "" {
+		configHome = filepath.Join(getEnv(globalEnv, "HOME"), ".config")
+	}
+	id := cfg.exeName
+	if strings.ContainsRune(id, '/') {
+		id = cfg.rExeName
+	}
+	return []string{
+		cfg.selfPath + ".pbundle.toml",
+		filepath.Join(configHome, "pelfbundles", id+".toml"),
+	}
+}
+
+// loadBundleSettings reads the settings of every config file into bundleSettings, unless they are set already.
+// Only the [env] table is exported, to the env of the AppRun
+func loadBundleSettings(cfg *RuntimeConfig) error {
+	for _, path := range bundleSettingsPaths(cfg) {
+		settings := BundleSettings{}
+		md, err := toml.DecodeFile(path, &settings)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+		for _, key := range md.Undecoded() {
+			logWarning(fmt.Sprintf("Unknown key %q in %s", key.String(), path))
+		}
+		if settings.RunBehavior != nil && *settings.RunBehavior > 4 {
+			return fmt.Errorf("invalid config file %s: run_behavior must be one of 0, 1, 2, 3 or 4", path)
+		}
+		for key, value := range settings.envVars() {
+			if getSetting(key) == "" {
+				setEnv(&bundleSettings, key, value)
+			}
+		}
+		for key, value := range settings.Env {
+			if getEnv(globalEnv, key) == "" {
+				setEnv(&globalEnv, key, value)
+			}
+		}
+	}
+
+	// The env and the config files may override what the RuntimeInfo says
+	if v := getSetting("PBUNDLE_RUN_BEHAVIOR"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 8)
+		if err != nil || n > 4 {
+			return fmt.Errorf("invalid PBUNDLE_RUN_BEHAVIOR: %q", v)
+		}
+		cfg.mountOrExtract = uint8(n)
+	}
+	if v := getSetting("PBUNDLE_DISABLE_RANDOM_WORKDIR"); v != "" {
+		cfg.disableRandomWorkDir = v == "1"
+	}
+
+	return nil
+}
+
+// envVars maps the settings that are set onto their env variables. The [env] table is not part of them
+func (s *BundleSettings) envVars() map[string]string {
+	env := map[string]string{}
+	setStr := func(key string, v *string) {
+		if v != nil {
+			env[key] = *v
+		}
+	}
+	setBool := func(key string, v *bool) {
+		if v != nil {
+			env[key] = T(*v, "1", "0")
+		}
+	}
+	// Some variables are checked for their presence rather than for "1"
+	setFlag := func(key string, v *bool) {
+		if v != nil && *v {
+			env[key] = "1"
+		}
+	}
+
+	if s.RunBehavior != nil {
+		env["PBUNDLE_RUN_BEHAVIOR"] = strconv.Itoa(int(*s.RunBehavior))
+	}
+	setBool("PBUNDLE_DISABLE_RANDOM_WORKDIR", s.DisableRandomWorkDir)
+	setStr("PBUNDLE_POOL_DIR", s.PoolDir)
+	setBool("PBUNDLE_OVERTAKE_PATH", s.OvertakePath)
+	setBool("PBUNDLE_USERNS", s.Userns)
+	setBool("NO_MEMFDEXEC", s.NoMemfdExec)
+	setFlag("ENABLE_FUSE_DEBUG", s.FuseDebug)
+
+	setBool("PBUNDLE_EXTRACT_CACHE", s.ExtractCache.Enabled)
+	setStr("PBUNDLE_EXTRACT_CACHE_DIR", s.ExtractCache.Dir)
+	setStr("PBUNDLE_EXTRACT_CACHE_SIZE", s.ExtractCache.Size)
+
+	setStr("DWARFS_CACHESIZE", s.Dwarfs.CacheSize)
+	if s.Dwarfs.Workers != nil {
+		env["DWARFS_WORKERS"] = strconv.FormatUint(uint64(*s.Dwarfs.Workers), 10)
+	}
+	setStr("DWARFS_READAHEAD", s.Dwarfs.Readahead)
+	setStr("DWARFS_BLOCKSIZE", s.Dwarfs.BlockSize)
+	setStr("DWARFS_BLOCK_ALLOCATOR", s.Dwarfs.BlockAllocator)
+	setStr("DWARFS_TIDY_STRATEGY", s.Dwarfs.TidyStrategy)
+	setFlag("DWARFS_PRELOAD_ALL", s.Dwarfs.PreloadAll)
+	setStr("DWARFS_ANALYSIS_FILE", s.Dwarfs.AnalysisFile)
+	return env
+}
@@ -37,7 +37,7 @@ func (c *memitCmd) Run() error {
 }
 
 func newMemitCmd(cfg *RuntimeConfig, binary []byte, name string, args ...string) (*memitCmd, error) {
-	if getEnv(globalEnv, "NO_MEMFDEXEC") == "1" {
+	if getSetting("NO_MEMFDEXEC") == "1" {
 		tempDir := filepath.Join(cfg.workDir, ".static")
 		if err := os.MkdirAll(tempDir, 0755); err != nil {
 			return nil, fmt.Errorf("failed to create temporary directory: %v", err)
@@ -48,6 +48,7 @@ func newMemitCmd(cfg *RuntimeConfig, binary []byte, name string, args ...string)
 		}
 		cmd := exec.Command(tempFile, args...)
 		cmd.Env = globalEnv
+		cmd.ExtraFiles = fuseExtraFiles(cfg)
 		//// Detach FUSE binary so it survives runtime death
 		//cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
 		return &memitCmd{Cmd: cmd}, nil
@@ -58,6 +59,7 @@ func newMemitCmd(cfg *RuntimeConfig, binary []byte, name string, args ...string)
 	}
 	cmd.Args[0] = name
 	cmd.Env = globalEnv
+	cmd.ExtraFiles = fuseExtraFiles(cfg)
 	//// Detach FUSE binary so it survives runtime death
 	//cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
 	return &memitCmd{Cmd: cmd, file: file}, nil
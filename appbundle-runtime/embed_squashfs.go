@@ -24,9 +24,9 @@ var Filesystems = []*Filesystem{
 				"-o", "uid=0,gid=0",
 				"-o", fmt.Sprintf("offset=%d", cfg.archiveOffset),
 				cfg.selfPath,
-				cfg.mountDir,
+				fuseMountpoint(cfg),
 			}
-			if getEnv(globalEnv, "ENABLE_FUSE_DEBUG") != "" {
+			if getSetting("ENABLE_FUSE_DEBUG") != "" {
 				logWarning("squashfuse's debug mode implies foreground. The AppRun won't be called.")
 				args = append(args, "-o", "debug")
 			}
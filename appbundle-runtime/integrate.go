@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/goccy/go-json"
+	"github.com/xplshn/pelf/pkg/integration"
+	"github.com/xplshn/pelf/pkg/utils"
+)
+
+// integrationStore is the integration.Store of the AppBundles integrated with --pbundle_integrate, kept in a file
+type integrationStore struct {
+	integration.MapStore
+	path string
+}
+
+// integrationsPath returns the per-user registry of integrated AppBundles, keyed by their path
+func integrationsPath() string {
+	p, _ := getPortableDir("state")
+	return filepath.Join(p.realDir(), "pelfbundles", "integrations.json")
+}
+
+func loadIntegrations() (*integrationStore, error) {
+	store := &integrationStore{MapStore: integration.MapStore{}, path: integrationsPath()}
+	data, err := os.ReadFile(store.path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.MapStore); err != nil {
+		return nil, fmt.Errorf("invalid registry %s: %w", store.path, err)
+	}
+	return store, nil
+}
+
+func (s *integrationStore) save() error {
+	data, err := json.MarshalIndent(s.MapStore, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(s.path, data, 0644)
+}
+
+// newIntegrator returns the integrator that --pbundle_integrate shares with pelfd. It installs the same files, under the same
+// names, so that an AppBundle integrated by both shows up once. The metadata is read from the mounted AppDir rather than by
+// running the AppBundle again
+func newIntegrator(cfg *RuntimeConfig, store integration.Store, setDefaults bool) *integration.Integrator {
+	share, _ := getPortableDir("share")
+	config, _ := getPortableDir("config")
+	cache, _ := getPortableDir("cache")
+	dataHome := share.realDir()
+
+	in := integration.New(integration.Options{
+		IconDir:             filepath.Join(dataHome, "icons"),
+		AppDir:              filepath.Join(dataHome, "applications"),
+		MimeDir:             filepath.Join(dataHome, "mime"),
+		ThumbnailDir:        filepath.Join(cache.realDir(), "thumbnails"),
+		MimeAppsList:        filepath.Join(config.realDir(), "mimeapps.list"),
+		HicolorIcons:        true,
+		CorrectDesktopFiles: true,
+		SetDefaultHandlers:  setDefaults,
+		Log: func(level, message string) {
+			if level != "INF" {
+				logWarning(message)
+			}
+		},
+	}, store)
+	// Whichever format the AppBundle is taken for, such as .AppImage for those made with --appimage-compat
+	in.RegisterExtractor(in.Format(cfg.selfPath), integration.ExtractorFunc(func(string) (*integration.Metadata, error) {
+		metadata := integration.ReadAppDir(cfg.mountDir)
+		metadata.AppBundleID = cfg.exeName
+		return metadata, nil
+	}))
+	return in
+}
+
+// integrateBundle implements --pbundle_integrate. It installs the .desktop file, icon and shared-mime-info packages of the AppBundle
+// within $XDG_DATA_HOME, along with freedesktop thumbnails of the AppBundle. If setDefaults is true, the AppBundle is also made the
+// default application for the MIME types (and URL schemes) of its .desktop file. Integrating an AppBundle again replaces what was installed the last time
+func integrateBundle(cfg *RuntimeConfig, setDefaults bool) error {
+	if matches, _ := filepath.Glob(filepath.Join(cfg.mountDir, "*.desktop")); len(matches) == 0 {
+		return fmt.Errorf("this AppBundle does not have a .desktop file")
+	}
+
+	store, err := loadIntegrations()
+	if err != nil {
+		return err
+	}
+	in := newIntegrator(cfg, store, setDefaults)
+	removeStaleIntegrations(in)
+	entry, err := in.Integrate(cfg.selfPath)
+	if saveErr := store.save(); err == nil {
+		err = saveErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if setDefaults && len(entry.DefaultHandlers) == 0 {
+		logWarning("The .desktop file of this AppBundle does not declare any MIME type")
+	}
+	for _, file := range append([]string{entry.Desktop, entry.Png, entry.Svg, entry.Thumbnail, entry.LargeThumbnail}, entry.MimeInfo...) {
+		if file != "" {
+			fmt.Println(file)
+		}
+	}
+	return nil
+}
+
+// deintegrateBundle implements --pbundle_deintegrate
+func deintegrateBundle(cfg *RuntimeConfig) error {
+	store, err := loadIntegrations()
+	if err != nil {
+		return err
+	}
+	in := newIntegrator(cfg, store, false)
+	removed := removeStaleIntegrations(in)
+	err = in.Deintegrate(cfg.selfPath)
+	if errors.Is(err, integration.ErrNotIntegrated) && removed > 0 {
+		err = nil
+	}
+	if saveErr := store.save(); err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+// removeStaleIntegrations deintegrates the AppBundles that no longer exist, as it happens when an AppBundle is moved, and returns
+// how many there were
+func removeStaleIntegrations(in *integration.Integrator) int {
+	removed := 0
+	for _, path := range in.Store.Paths() {
+		if !fileExists(path) {
+			in.Deintegrate(path)
+			removed++
+		}
+	}
+	return removed
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
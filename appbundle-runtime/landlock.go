@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/goccy/go-json"
+	"golang.org/x/sys/unix"
+)
+
+// Set by the runtime on the helper that confines itself and then execs the AppRun, it contains the confinePolicy
+const confineEnvVar = "PBUNDLE_INTERNAL_CONFINE"
+
+const (
+	landlockReadAccess = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+	// Rights that apply to files, as opposed to directories. Rules for files may not contain anything else
+	landlockFileAccess = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_READ_FILE |
+		unix.LANDLOCK_ACCESS_FS_TRUNCATE | unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+)
+
+// Devices that every program expects to be usable
+var landlockBaseDevices = []string{"null", "zero", "full", "random", "urandom", "tty", "ptmx", "pts", "shm"}
+
+// confinePolicy is what a SandboxProfile boils down to when it is enforced with Landlock and seccomp instead of bwrap
+type confinePolicy struct {
+	Readable    []string `json:"readable"`
+	Writable    []string `json:"writable"`
+	DenyNetwork bool     `json:"denyNetwork"`
+	Seccomp     string   `json:"seccomp"`
+	Env         []string `json:"env"`
+}
+
+// confineCommand makes executable+args run through the runtime itself (--pbundle_internal_Confine), which
+// restricts its own thread and then execs them. Restrictions are inherited across execve(2), and cannot be lifted
+func confineCommand(cfg *RuntimeConfig, profile *SandboxProfile, executable string, args []string) (string, []string, error) {
+	if profile.Rootfs != "" || profile.Uid0Gid0 {
+		return "", nil, fmt.Errorf("\"rootfs\" and \"uid0gid0\" cannot be honored without bwrap")
+	}
+	if landlockABI() < 1 {
+		return "", nil, fmt.Errorf("the kernel does not support Landlock, and bwrap is not available")
+	}
+
+	policy := confinePolicy{
+		DenyNetwork: !profile.Network,
+		Seccomp:     profile.Seccomp,
+	}
+	if len(profile.Env) > 0 {
+		policy.Env = append(slices.Clone(sandboxRuntimeEnv), profile.Env...)
+	}
+
+	// Everything is readable (the mount dir included), except for /dev, where only the allowed devices are
+	if entries, err := os.ReadDir("/"); err == nil {
+		for _, entry := range entries {
+			if entry.Name() != "dev" {
+				policy.Readable = append(policy.Readable, filepath.Join("/", entry.Name()))
+			}
+		}
+	}
+
+	devices := landlockBaseDevices
+	if slices.Contains(profile.Devices, "all") {
+		devices = []string{""}
+	} else {
+		devices = append(slices.Clone(devices), profile.Devices...)
+	}
+	for _, device := range devices {
+		matches, _ := filepath.Glob(filepath.Join("/dev", device))
+		policy.Writable = append(policy.Writable, matches...)
+	}
+	policy.Writable = append(policy.Writable, os.TempDir(), "/var/tmp")
+
+	for _, dir := range existingPortableDirs(cfg) {
+		policy.Writable = append(policy.Writable, dir)
+	}
+
+	binds := []SandboxBind{}
+	for _, share := range profile.Share {
+		binds = append(binds, sandboxShares[share]...)
+	}
+	binds = append(binds, profile.Binds...)
+	for _, bind := range binds {
+		src, ok := expandBindPath(bind.Src)
+		if !ok {
+			continue
+		}
+		if bind.Dest != "" && bind.Dest != bind.Src {
+			return "", nil, fmt.Errorf("the bind of %s to %s cannot be honored without bwrap", bind.Src, bind.Dest)
+		}
+		switch bind.Mode {
+		case "", "ro":
+			// Already readable, unless it's a device
+			if strings.HasPrefix(src, "/dev/") {
+				policy.Readable = append(policy.Readable, src)
+			}
+		case "rw", "dev":
+			policy.Writable = append(policy.Writable, src)
+		default:
+			return "", nil, fmt.Errorf("invalid sandbox profile: unknown bind mode %q for %s", bind.Mode, bind.Src)
+		}
+	}
+
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return "", nil, err
+	}
+	setEnv(&globalEnv, confineEnvVar, string(data))
+
+	if len(profile.Exec) > 0 {
+		executable, args = profile.Exec[0], append(slices.Clone(profile.Exec[1:]), args...)
+	}
+	return cfg.selfPath, append([]string{"--pbundle_internal_Confine", executable}, args...), nil
+}
+
+// runConfined is the --pbundle_internal_Confine helper, it never returns
+func runConfined(args []string) {
+	env := os.Environ()
+	policy := confinePolicy{}
+	if err := json.Unmarshal([]byte(getEnv(env, confineEnvVar)), &policy); err != nil {
+		logError("Invalid confinement policy", err, nil)
+	}
+	unsetEnv(&env, confineEnvVar)
+
+	if len(policy.Env) > 0 {
+		var kept []string
+		for _, key := range policy.Env {
+			if value := getEnv(env, key); value != "" {
+				kept = append(kept, key+"="+value)
+			}
+		}
+		env = kept
+	}
+
+	executable, err := lookPath(args[0], getEnv(env, "PATH"))
+	if err != nil {
+		logError("Unable to find "+args[0], err, nil)
+	}
+
+	prog, err := seccompFilter(policy.Seccomp)
+	if err != nil {
+		logError("Unable to confine the AppBundle", err, nil)
+	}
+
+	// Landlock domains and seccomp filters belong to the thread that sets them up, which must also be the one that execs
+	runtime.LockOSThread()
+	if err := applyLandlock(&policy); err != nil {
+		logError("Unable to confine the AppBundle", err, nil)
+	}
+	if err := applySeccomp(prog); err != nil {
+		logError("Unable to confine the AppBundle", err, nil)
+	}
+
+	err = syscall.Exec(executable, args, env)
+	logError("Failed to execute "+executable, err, nil)
+}
+
+// landlockABI returns the Landlock ABI version supported by the kernel, 0 if Landlock is unavailable
+func landlockABI() int {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return 0
+	}
+	return int(abi)
+}
+
+// landlockHandledAccess returns the filesystem rights known to a given ABI version, which are denied unless a rule allows them
+func landlockHandledAccess(abi int) uint64 {
+	access := uint64(unix.LANDLOCK_ACCESS_FS_MAKE_SYM<<1 - 1)
+	if abi >= 2 {
+		access |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		access |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+	if abi >= 5 {
+		access |= unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+	}
+	return access
+}
+
+// applyLandlock restricts the calling thread to the paths of the policy
+func applyLandlock(policy *confinePolicy) error {
+	abi := landlockABI()
+	if abi < 1 {
+		return fmt.Errorf("the kernel does not support Landlock")
+	}
+
+	attr := unix.LandlockRulesetAttr{Access_fs: landlockHandledAccess(abi)}
+	if policy.DenyNetwork {
+		if abi >= 4 {
+			// Handled but without any rule, so every TCP bind(2) and connect(2) is denied
+			attr.Access_net = unix.LANDLOCK_ACCESS_NET_BIND_TCP | unix.LANDLOCK_ACCESS_NET_CONNECT_TCP
+		} else {
+			logWarning("The kernel's Landlock is too old to restrict network access (ABI v4 is needed), the network remains available")
+		}
+	}
+	// Older kernels reject the fields that they do not know about
+	attrSize := unsafe.Sizeof(attr.Access_fs)
+	if attr.Access_net != 0 {
+		attrSize += unsafe.Sizeof(attr.Access_net)
+	}
+
+	rulesetFd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), attrSize, 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to create the Landlock ruleset: %w", errno)
+	}
+	defer unix.Close(int(rulesetFd))
+
+	for _, path := range policy.Readable {
+		if err := landlockAddPath(int(rulesetFd), path, landlockReadAccess&attr.Access_fs); err != nil {
+			return err
+		}
+	}
+	for _, path := range policy.Writable {
+		if err := landlockAddPath(int(rulesetFd), path, attr.Access_fs); err != nil {
+			return err
+		}
+	}
+
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to set no_new_privs: %w", err)
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_LANDLOCK_RESTRICT_SELF, rulesetFd, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to enforce the Landlock ruleset: %w", errno)
+	}
+	return nil
+}
+
+// landlockAddPath allows access to everything beneath path, paths that do not exist are skipped
+func landlockAddPath(rulesetFd int, path string, access uint64) error {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil
+	}
+	defer unix.Close(fd)
+
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return nil
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		access &= landlockFileAccess
+	}
+
+	rule := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(fd)}
+	if _, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(rulesetFd), unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&rule)), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to add a Landlock rule for %s: %w", path, errno)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// SQUASHFS_MAGIC as reported by statfs(2)
+	squashfsMagic = 0x73717368
+	capSysAdmin   = 21
+)
+
+// canLoopMount tells whether the image may be mounted by the kernel itself, skipping FUSE entirely
+func canLoopMount(cfg *RuntimeConfig) bool {
+	return cfg.appBundleFS == "squashfs" && !cfg.inUserns && hasCapability(capSysAdmin)
+}
+
+// hasCapability checks the effective capability set of the runtime
+func hasCapability(capability uint) bool {
+	file, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if capEff, ok := strings.CutPrefix(scanner.Text(), "CapEff:"); ok {
+			caps, err := strconv.ParseUint(strings.TrimSpace(capEff), 16, 64)
+			return err == nil && caps&(1<<capability) != 0
+		}
+	}
+	return false
+}
+
+// loopMountImage attaches the image at archiveOffset to a free loop device and mounts it with the kernel's squashfs driver
+func loopMountImage(cfg *RuntimeConfig, fh *fileHandler) error {
+	if !canLoopMount(cfg) {
+		return fmt.Errorf("kernel mounting is only possible for squashfs images, with CAP_SYS_ADMIN")
+	}
+	if err := cleanMountpointIfBroken(cfg.mountDir); err != nil {
+		return fmt.Errorf("failed to prepare mount directory %s: %v", cfg.mountDir, err)
+	}
+
+	if !isMounted(cfg.mountDir) {
+		loopDev, err := attachLoopDevice(fh, cfg.archiveOffset)
+		if err != nil {
+			return err
+		}
+		defer loopDev.Close()
+
+		if err := unix.Mount(loopDev.Name(), cfg.mountDir, "squashfs", unix.MS_RDONLY|unix.MS_NODEV|unix.MS_NOSUID, ""); err != nil {
+			_ = unix.IoctlSetInt(int(loopDev.Fd()), unix.LOOP_CLR_FD, 0)
+			return fmt.Errorf("failed to mount %s at %s: %w", loopDev.Name(), cfg.mountDir, err)
+		}
+	}
+
+	go func() {
+		_ = os.WriteFile(filepath.Join(cfg.workDir, ".pid"), []byte(fmt.Sprintf("%d", os.Getpid())), 0644)
+	}()
+
+	return nil
+}
+
+// attachLoopDevice sets up a read-only loop device which is detached automatically once it is unmounted
+func attachLoopDevice(fh *fileHandler, offset uint64) (*os.File, error) {
+	ctl, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open /dev/loop-control: %w", err)
+	}
+	defer ctl.Close()
+
+	info := unix.LoopInfo64{
+		Offset: offset,
+		Flags:  unix.LO_FLAGS_READ_ONLY | unix.LO_FLAGS_AUTOCLEAR,
+	}
+	copy(info.File_name[:len(info.File_name)-1], fh.path)
+
+	// Someone else may grab the same free device before we configure it
+	for range 5 {
+		n, err := unix.IoctlRetInt(int(ctl.Fd()), unix.LOOP_CTL_GET_FREE)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get a free loop device: %w", err)
+		}
+		loopDev, err := os.OpenFile("/dev/loop"+strconv.Itoa(n), os.O_RDONLY, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open loop device: %w", err)
+		}
+
+		err = unix.IoctlLoopConfigure(int(loopDev.Fd()), &unix.LoopConfig{Fd: uint32(fh.file.Fd()), Info: info})
+		if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOTTY) {
+			// LOOP_CONFIGURE appeared in Linux 5.8
+			if err = unix.IoctlSetInt(int(loopDev.Fd()), unix.LOOP_SET_FD, int(fh.file.Fd())); err == nil {
+				if err = unix.IoctlLoopSetStatus64(int(loopDev.Fd()), &info); err != nil {
+					_ = unix.IoctlSetInt(int(loopDev.Fd()), unix.LOOP_CLR_FD, 0)
+				}
+			}
+		}
+		if err == nil {
+			return loopDev, nil
+		}
+		loopDev.Close()
+		if !errors.Is(err, unix.EBUSY) {
+			return nil, fmt.Errorf("failed to configure %s: %w", loopDev.Name(), err)
+		}
+	}
+
+	return nil, fmt.Errorf("failed to configure a loop device: all attempts were raced")
+}
+
+// isLoopMounted tells whether mountDir is a kernel squashfs mount, as opposed to a FUSE one
+func isLoopMounted(mountDir string) bool {
+	var st syscall.Statfs_t
+	return syscall.Statfs(mountDir, &st) == nil && st.Type == squashfsMagic
+}
+
+// loopUnmount unmounts a kernel squashfs mount, and makes sure that its loop device is detached
+func loopUnmount(mountDir string) {
+	loopDev := mountSource(mountDir)
+	if err := unix.Unmount(mountDir, 0); err != nil {
+		return
+	}
+	if !strings.HasPrefix(loopDev, "/dev/loop") {
+		return
+	}
+	// LO_FLAGS_AUTOCLEAR should have already taken care of this
+	if f, err := os.OpenFile(loopDev, os.O_RDONLY, 0); err == nil {
+		_ = unix.IoctlSetInt(int(f.Fd()), unix.LOOP_CLR_FD, 0)
+		f.Close()
+	}
+}
+
+// mountSource returns the source of the mount at mountPoint, as listed in /proc/self/mountinfo
+func mountSource(mountPoint string) string {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	mountPoint = filepath.Clean(mountPoint)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		pre, post, ok := strings.Cut(scanner.Text(), " - ")
+		fields, postFields := strings.Fields(pre), strings.Fields(post)
+		if !ok || len(fields) < 5 || len(postFields) < 2 {
+			continue
+		}
+		if unescapeMountinfo(fields[4]) == mountPoint {
+			return unescapeMountinfo(postFields[1])
+		}
+	}
+	return ""
+}
+
+// unescapeMountinfo decodes the octal escapes (\040 and the like) used by the kernel in /proc/self/mountinfo
+func unescapeMountinfo(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -43,14 +43,15 @@ var Filesystems = []*Filesystem{
 				"-o", "uid=0,gid=0",
 				"-o", fmt.Sprintf("offset=%d", cfg.archiveOffset),
 				cfg.selfPath,
-				cfg.mountDir,
+				fuseMountpoint(cfg),
 			}
-			if getEnv(globalEnv, "ENABLE_FUSE_DEBUG") != "" {
+			if getSetting("ENABLE_FUSE_DEBUG") != "" {
 				logWarning("squashfuse's debug mode implies foreground. The AppRun won't be called.")
 				args = append(args, "-o", "debug")
 			}
 			cmd := exec.Command(executable, args...)
 			cmd.Env = globalEnv
+			cmd.ExtraFiles = fuseExtraFiles(cfg)
 			//// Detach FUSE binary so it survives runtime death
 			//cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
 			return &osExecCmd{cmd}
@@ -85,27 +86,28 @@ var Filesystems = []*Filesystem{
 			args := []string{
 				"-o", "ro,nodev",
 				"-o", "cache_files,no_cache_image,clone_fd",
-				"-o", "block_allocator=" + getEnvWithDefault(globalEnv, "DWARFS_BLOCK_ALLOCATOR", DWARFS_BLOCK_ALLOCATOR),
-				"-o", getEnvWithDefault(globalEnv, "DWARFS_TIDY_STRATEGY", DWARFS_TIDY_STRATEGY),
-				"-o", "debuglevel=" + T(getEnv(globalEnv, "ENABLE_FUSE_DEBUG") != "", "debug", "error"),
-				"-o", "readahead=" + getEnvWithDefault(globalEnv, "DWARFS_READAHEAD", DWARFS_READAHEAD),
-				"-o", "blocksize=" + getEnvWithDefault(globalEnv, "DWARFS_BLOCKSIZE", DWARFS_BLOCKSIZE),
+				"-o", "block_allocator=" + getSettingWithDefault("DWARFS_BLOCK_ALLOCATOR", DWARFS_BLOCK_ALLOCATOR),
+				"-o", getSettingWithDefault("DWARFS_TIDY_STRATEGY", DWARFS_TIDY_STRATEGY),
+				"-o", "debuglevel=" + T(getSetting("ENABLE_FUSE_DEBUG") != "", "debug", "error"),
+				"-o", "readahead=" + getSettingWithDefault("DWARFS_READAHEAD", DWARFS_READAHEAD),
+				"-o", "blocksize=" + getSettingWithDefault("DWARFS_BLOCKSIZE", DWARFS_BLOCKSIZE),
 				"-o", "cachesize=" + cacheSize,
 				"-o", "workers=" + getDwarfsWorkers(&cacheSize),
 				"-o", fmt.Sprintf("offset=%d", cfg.archiveOffset),
 				cfg.selfPath,
-				cfg.mountDir,
+				fuseMountpoint(cfg),
 			}
-			if e := getEnv(globalEnv, "DWARFS_ANALYSIS_FILE"); e != "" {
+			if e := getSetting("DWARFS_ANALYSIS_FILE"); e != "" {
 				args = append(args, "-o", "analysis_file="+e)
 			}
-			if e := getEnv(globalEnv, "DWARFS_PRELOAD_ALL"); e != "" {
+			if e := getSetting("DWARFS_PRELOAD_ALL"); e != "" {
 				args = append(args, "-o", "preload_all")
 			} else {
 				args = append(args, "-o", "preload_category=hotness")
 			}
 			cmd := exec.Command(executable, args...)
 			cmd.Env = globalEnv
+			cmd.ExtraFiles = fuseExtraFiles(cfg)
 			//// Detach FUSE binary so it survives runtime death
 			//cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
 			return &osExecCmd{cmd}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+const (
+	// TMPFS_MAGIC as reported by statfs(2)
+	tmpfsMagic = 0x01021994
+	// The extracted AppDir is usually bigger than the compressed image, this is our rough guess of how much bigger
+	extractSpaceFactor = 2
+)
+
+// getPoolDir decides where the pbundle_* work dirs should live.
+// Order of precedence: $PBUNDLE_POOL_DIR, the PoolDir of the RuntimeInfo, then
+// $XDG_RUNTIME_DIR (mounts) or $XDG_CACHE_HOME (extractions), and lastly os.TempDir()
+func getPoolDir(cfg *RuntimeConfig, extract bool) string {
+	if dir := getSetting("PBUNDLE_POOL_DIR"); dir != "" {
+		return dir
+	}
+	if cfg.defaultPoolDir != "" {
+		return os.Expand(cfg.defaultPoolDir, func(key string) string { return getEnv(globalEnv, key) })
+	}
+
+	if !extract {
+		if dir := getEnv(globalEnv, "XDG_RUNTIME_DIR"); dir != "" {
+			return filepath.Join(dir, "pelfbundles")
+		}
+	} else {
+		if dir := getEnv(globalEnv, "XDG_CACHE_HOME"); dir != "" {
+			return filepath.Join(dir, "pelfbundles")
+		}
+		if home := getEnv(globalEnv, "HOME"); home != "" {
+			return filepath.Join(home, ".cache", "pelfbundles")
+		}
+	}
+
+	// /tmp is shared, so each user gets its own pool within it
+	return filepath.Join(os.TempDir(), ".pelfbundles", strconv.Itoa(os.Getuid()))
+}
+
+// ensurePoolDir creates the pool directory and makes sure that it is not
+// usable by other users, which could otherwise tamper with our pbundle_* dirs
+func ensurePoolDir(poolDir string) error {
+	parent := filepath.Dir(poolDir)
+	if filepath.Base(parent) == ".pelfbundles" {
+		// The shared parent in /tmp must be sticky, like /tmp itself
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return err
+		}
+		if isOwnedByUs(parent) {
+			_ = os.Chmod(parent, 01777)
+		}
+	}
+
+	if err := os.MkdirAll(poolDir, 0700); err != nil {
+		return err
+	}
+
+	fi, err := os.Lstat(poolDir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("pool directory %s is not a directory", poolDir)
+	}
+	if !isOwnedByUs(poolDir) {
+		return fmt.Errorf("pool directory %s is owned by another user", poolDir)
+	}
+	if fi.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("pool directory %s is writable by other users (mode %o)", poolDir, fi.Mode().Perm())
+	}
+
+	return nil
+}
+
+func isOwnedByUs(path string) bool {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		return false
+	}
+	return int(st.Uid) == os.Getuid()
+}
+
+// setPoolDir (re)computes every path that depends on the pool directory
+func setPoolDir(cfg *RuntimeConfig, fh *fileHandler, extract bool) error {
+	poolDir := getPoolDir(cfg, extract)
+	if poolDir == cfg.poolDir {
+		return nil
+	}
+	if err := ensurePoolDir(poolDir); err != nil {
+		return fmt.Errorf("unusable pool directory (set PBUNDLE_POOL_DIR to override it): %w", err)
+	}
+
+	oldEntrypoint := filepath.Join(cfg.mountDir, "AppRun")
+	if cfg.workDir != "" {
+		rmEmptyDir(cfg.mountDir)
+		rmEmptyDir(cfg.workDir)
+	}
+
+	cfg.poolDir = poolDir
+	cfg.workDir = getWorkDir(cfg, fh)
+	cfg.mountDir = filepath.Join(cfg.workDir, "mounted")
+	if cfg.entrypoint == "" || cfg.entrypoint == oldEntrypoint {
+		cfg.entrypoint = filepath.Join(cfg.mountDir, "AppRun")
+	}
+	cfg.staticToolsDir = filepath.Join(cfg.poolDir, ".static")
+
+	return os.MkdirAll(cfg.workDir, 0755)
+}
+
+// checkFreeSpace errors out early when the filesystem that holds dir is unlikely to fit the extracted image
+func checkFreeSpace(cfg *RuntimeConfig, fh *fileHandler, dir string) error {
+	fi, err := fh.file.Stat()
+	if err != nil || uint64(fi.Size()) <= cfg.archiveOffset {
+		return nil
+	}
+	imageSize := uint64(fi.Size()) - cfg.archiveOffset
+	needed := imageSize * extractSpaceFactor
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return nil
+	}
+	avail := st.Bavail * uint64(st.Bsize)
+	if avail >= needed {
+		return nil
+	}
+
+	hint := ""
+	if st.Type == tmpfsMagic {
+		hint = fmt.Sprintf(" (%s is a tmpfs, backed by RAM)", dir)
+	}
+	return fmt.Errorf("not enough free space to extract the AppBundle in %s%s: ~%s needed, %s available.\n"+
+		"  Set PBUNDLE_POOL_DIR to a directory on a bigger filesystem, free up some space, or make FUSE available so that the AppBundle can be mounted instead",
+		dir, hint, humanSize(needed), humanSize(avail))
+}
+
+func humanSize(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/xplshn/pelf/pkg/utils"
+)
+
+// portableDir is a directory next to the AppBundle (<bundle><suffix>) which, if it exists, replaces one of the user's directories
+type portableDir struct {
+	kind    string
+	suffix  string
+	env     string
+	realEnv string
+	def     string // Relative to $HOME, used when env is unset
+}
+
+// $HOME comes last, so that the defaults of the other directories are derived from the real $HOME
+var portableDirs = []portableDir{
+	{"config", ".config", "XDG_CONFIG_HOME", "REAL_XDG_CONFIG_HOME", ".config"},
+	{"share", ".share", "XDG_DATA_HOME", "REAL_XDG_DATA_HOME", filepath.Join(".local", "share")},
+	{"cache", ".cache", "XDG_CACHE_HOME", "REAL_XDG_CACHE_HOME", ".cache"},
+	{"state", ".state", "XDG_STATE_HOME", "REAL_XDG_STATE_HOME", filepath.Join(".local", "state")},
+	{"runtime", ".runtime", "XDG_RUNTIME_DIR", "REAL_XDG_RUNTIME_DIR", ""},
+	{"home", ".home", "HOME", "REAL_HOME", "."},
+}
+
+func getPortableDir(kind string) (portableDir, bool) {
+	for _, p := range portableDirs {
+		if p.kind == kind {
+			return p, true
+		}
+	}
+	return portableDir{}, false
+}
+
+// parsePortableKinds expands "all" and validates the kinds given to the --pbundle_portable* flags
+func parsePortableKinds(args []string) ([]portableDir, error) {
+	if len(args) == 0 || slices.Contains(args, "all") {
+		return portableDirs, nil
+	}
+	var dirs []portableDir
+	for _, arg := range args {
+		for _, kind := range strings.Split(arg, ",") {
+			p, ok := getPortableDir(kind)
+			if !ok {
+				return nil, fmt.Errorf("unknown kind of portable directory %q, valid kinds are: %s, all", kind, strings.Join(portableKinds(), ", "))
+			}
+			dirs = append(dirs, p)
+		}
+	}
+	return dirs, nil
+}
+
+func portableKinds() []string {
+	kinds := make([]string, len(portableDirs))
+	for i, p := range portableDirs {
+		kinds[i] = p.kind
+	}
+	return kinds
+}
+
+// realDir returns the directory that the portable one replaces, as it'd be without the AppBundle's portable dirs
+func (p portableDir) realDir() string {
+	if dir := getEnv(globalEnv, p.realEnv); dir != "" {
+		return dir
+	}
+	if dir := getEnv(globalEnv, p.env); dir != "" {
+		return dir
+	}
+	if p.def == "" {
+		return ""
+	}
+	home := getEnv(globalEnv, "REAL_HOME")
+	if home == "" {
+		home = getEnv(globalEnv, "HOME")
+	}
+	return filepath.Join(home, p.def)
+}
+
+// existingPortableDirs returns the paths of the portable dirs of the AppBundle that exist
+func existingPortableDirs(cfg *RuntimeConfig) []string {
+	var dirs []string
+	for _, p := range portableDirs {
+		if dir := cfg.selfPath + p.suffix; isDirectory(dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// createPortableDirs implements --pbundle_portable
+func createPortableDirs(cfg *RuntimeConfig, dirs []portableDir) error {
+	for _, p := range dirs {
+		// $XDG_RUNTIME_DIR must only be accessible by its owner
+		if err := os.MkdirAll(cfg.selfPath+p.suffix, T(p.kind == "runtime", os.FileMode(0700), os.FileMode(0755))); err != nil {
+			return err
+		}
+		fmt.Println(cfg.selfPath + p.suffix)
+	}
+	return nil
+}
+
+// migrateNames returns the names under which the app probably keeps its data, derived from the AppBundleID
+func migrateNames(cfg *RuntimeConfig) []string {
+	name := cfg.exeName
+	if id, _, err := utils.ParseAppBundleID(cfg.exeName); err == nil && id.Name != "" {
+		name = id.Name
+	}
+	names := []string{name, strings.ToLower(name)}
+	if short := utils.AppStreamIDToName(name); utils.IsAppStreamID(name) && short != "" {
+		names = append(names, short, strings.ToUpper(short[:1])+short[1:])
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// migratePortableDirs implements --pbundle_portable_migrate, it copies <real dir>/<name> into each of the portable dirs that exist.
+// Within $HOME, it's the dotfiles (.<name>) that are copied. Nothing that exists already within the portable dirs is overwritten
+func migratePortableDirs(cfg *RuntimeConfig, names []string) error {
+	if len(names) == 0 {
+		names = migrateNames(cfg)
+	}
+
+	migrated := 0
+	for _, p := range portableDirs {
+		portable := cfg.selfPath + p.suffix
+		real := p.realDir()
+		if p.kind == "runtime" || real == "" || !isDirectory(portable) {
+			continue
+		}
+		for _, name := range names {
+			if p.kind == "home" {
+				name = "." + name
+			}
+			src, dest := filepath.Join(real, name), filepath.Join(portable, name)
+			if _, err := os.Lstat(src); err != nil {
+				continue
+			}
+			if _, err := os.Lstat(dest); err == nil {
+				logWarning(fmt.Sprintf("Not migrating %s, as %s exists already", src, dest))
+				continue
+			}
+			if err := copyTree(src, dest); err != nil {
+				return fmt.Errorf("failed to migrate %s: %w", src, err)
+			}
+			fmt.Printf("%s -> %s\n", src, dest)
+			migrated++
+		}
+	}
+
+	if migrated == 0 {
+		return fmt.Errorf("found nothing to migrate (looked for %s). Make sure that the portable directories exist (--pbundle_portable), or pass the names of the app's directories", strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// copyTree copies a file or directory recursively, preserving modes and symlinks
+func copyTree(src, dest string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyFile(path, target, info.Mode().Perm())
+		}
+		// Sockets, FIFOs and the like are not data worth migrating
+		return nil
+	})
+}
+
+func copyFile(src, dest string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// exportPortableDirs implements --pbundle_portable_export. The tarball contains the portable dirs under their own
+// names, so extracting it next to a copy of the AppBundle on another machine restores them. "-" writes to stdout
+func exportPortableDirs(cfg *RuntimeConfig, output string) error {
+	var dirs []string
+	for _, dir := range existingPortableDirs(cfg) {
+		// Whatever is in $XDG_RUNTIME_DIR only makes sense while the app runs
+		if !strings.HasSuffix(dir, ".runtime") {
+			dirs = append(dirs, dir)
+		}
+	}
+	if len(dirs) == 0 {
+		return fmt.Errorf("this AppBundle has no portable directories")
+	}
+
+	if output == "" {
+		output = filepath.Base(cfg.selfPath) + ".portable.tar.gz"
+	}
+	var w io.Writer = os.Stdout
+	if output != "-" {
+		f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, dir := range dirs {
+		if err := addToTar(tw, dir, filepath.Dir(dir)); err != nil {
+			return fmt.Errorf("failed to export %s: %w", dir, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+
+	if output != "-" {
+		fmt.Println(output)
+	}
+	return nil
+}
+
+func addToTar(tw *tar.Writer, dir, base string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		if hdr.Name, err = filepath.Rel(base, path); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := io.Copy(tw, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
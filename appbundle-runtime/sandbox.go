@@ -0,0 +1,271 @@
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/goccy/go-json"
+	"github.com/shamaton/msgpack/v2"
+)
+
+// SandboxProfile declares how the AppRun should be confined. It is read from (in order of precedence):
+// a <bundle>.sandbox file next to the AppBundle, the .pbundle_sandbox ELF section, the Sandbox key of
+// the RuntimeInfo, or a .pbundle_sandbox file on the top-level of the AppDir
+type SandboxProfile struct {
+	Disabled bool          `json:"disabled"` // Lets a <bundle>.sandbox override turn the sandbox off
+	Backend  string        `json:"backend"`  // "bwrap", "landlock", or empty to use bwrap if it is available and Landlock otherwise
+	Rootfs   string        `json:"rootfs"`   // Directory (relative to the AppDir) to use as "/", the host's "/" is used read-only if empty
+	Exec     []string      `json:"exec"`     // Command to run within the sandbox instead of the AppRun
+	Network  bool          `json:"network"`  // Share the host's network
+	Devices  []string      `json:"devices"`  // Devices (relative to /dev, globs are allowed) to expose. "all" exposes the host's /dev
+	Share    []string      `json:"share"`    // Predefined sets of binds, see sandboxShares
+	Binds    []SandboxBind `json:"binds"`    // Additional binds
+	Env      []string      `json:"env"`      // Env variables to pass through, all of them are passed if empty
+	Seccomp  string        `json:"seccomp"`  // Seccomp level: "off", "default" or "strict"
+	Uid0Gid0 bool          `json:"uid0gid0"` // Pretend to be root within the sandbox
+}
+
+// SandboxBind is a bind mount from the host into the sandbox, env variables are expanded in both paths
+type SandboxBind struct {
+	Src  string `json:"src"`
+	Dest string `json:"dest,omitempty"` // Defaults to Src
+	Mode string `json:"mode,omitempty"` // "ro" (default), "rw" or "dev"
+}
+
+var sandboxShares = map[string][]SandboxBind{
+	"look":  {{Src: "/usr/share/icons"}, {Src: "/usr/share/themes"}},
+	"fonts": {{Src: "/usr/share/fontconfig"}, {Src: "/usr/share/fonts"}, {Src: "/etc/fonts"}},
+	"audio": {
+		{Src: "/etc/asound.conf"},
+		{Src: "$XDG_RUNTIME_DIR/pulse"},
+		{Src: "$XDG_RUNTIME_DIR/pipewire-0"},
+		{Src: "$XDG_RUNTIME_DIR/pipewire-0.lock"},
+		{Src: "$XDG_RUNTIME_DIR/pipewire-0-manager"},
+		{Src: "$XDG_RUNTIME_DIR/pipewire-0-manager.lock"},
+	},
+	"display": {
+		{Src: "/tmp/.X11-unix"},
+		{Src: "$XAUTHORITY"},
+		{Src: "$XDG_RUNTIME_DIR/$WAYLAND_DISPLAY"},
+	},
+	"dbus":            {{Src: "$XDG_RUNTIME_DIR/bus"}, {Src: "/run/dbus"}},
+	"xdg_runtime_dir": {{Src: "$XDG_RUNTIME_DIR", Mode: "rw"}},
+	"home":            {{Src: "$HOME", Mode: "rw"}},
+	"opt":             {{Src: "/opt"}},
+}
+
+// These are always passed into the sandbox, even if the profile restricts the env
+var sandboxRuntimeEnv = []string{"PATH", "HOME", "APPDIR", "SELF", "ARGV0", "APPIMAGE", "LANG", "TERM", "XDG_RUNTIME_DIR"}
+
+// Files of the host that are needed within a rootfs-based sandbox
+var sandboxHostFiles = []string{
+	"/etc/localtime", "/etc/machine-id", "/etc/resolv.conf", "/etc/hosts", "/etc/hostname",
+	"/etc/passwd", "/etc/group", "/etc/nsswitch.conf", "/lib/firmware",
+}
+
+// loadSandboxProfile returns nil if the AppBundle does not declare a sandbox profile (or if it was disabled)
+func loadSandboxProfile(cfg *RuntimeConfig) (*SandboxProfile, error) {
+	if cfg.noSandbox {
+		return nil, nil
+	}
+
+	var data []byte
+	var source string
+
+	if d, err := os.ReadFile(cfg.selfPath + ".sandbox"); err == nil {
+		data, source = d, cfg.selfPath+".sandbox"
+	} else if elfFile, err := elf.Open(cfg.selfPath); err == nil {
+		if section := elfFile.Section(".pbundle_sandbox"); section != nil {
+			if d, err := section.Data(); err == nil {
+				data, source = d, ".pbundle_sandbox section"
+			}
+		}
+		if section := elfFile.Section(".pbundle_runtime_info"); data == nil && section != nil {
+			var runtimeInfo map[string]any
+			if d, err := section.Data(); err == nil && msgpack.Unmarshal(d, &runtimeInfo) == nil {
+				if profile, ok := runtimeInfo["Sandbox"].(string); ok && profile != "" {
+					data, source = []byte(profile), "RuntimeInfo"
+				}
+			}
+		}
+		elfFile.Close()
+	}
+	if data == nil {
+		if d, err := os.ReadFile(filepath.Join(cfg.mountDir, ".pbundle_sandbox")); err == nil {
+			data, source = d, "$APPDIR/.pbundle_sandbox"
+		}
+	}
+	if data == nil {
+		return nil, nil
+	}
+
+	profile := &SandboxProfile{}
+	if err := json.Unmarshal(data, profile); err != nil {
+		return nil, fmt.Errorf("invalid sandbox profile (%s): %w", source, err)
+	}
+	if profile.Disabled {
+		return nil, nil
+	}
+	for _, share := range profile.Share {
+		if _, ok := sandboxShares[share]; !ok {
+			return nil, fmt.Errorf("invalid sandbox profile (%s): unknown share %q", source, share)
+		}
+	}
+	if _, err := seccompFilter(profile.Seccomp); err != nil {
+		return nil, fmt.Errorf("invalid sandbox profile (%s): %w", source, err)
+	}
+	switch profile.Backend {
+	case "", "bwrap", "landlock":
+	default:
+		return nil, fmt.Errorf("invalid sandbox profile (%s): unknown backend %q", source, profile.Backend)
+	}
+
+	return profile, nil
+}
+
+// findBwrap prefers a bwrap shipped within the AppDir over the host's
+func findBwrap(cfg *RuntimeConfig) (string, error) {
+	for _, path := range []string{
+		filepath.Join(cfg.mountDir, "usr", "bin", "bwrap"),
+		filepath.Join(cfg.mountDir, "bin", "bwrap"),
+	} {
+		if isExecutableFile(path) == nil {
+			return path, nil
+		}
+	}
+	return lookPath("bwrap", globalPath)
+}
+
+// sandboxCommand returns the command that runs executable+args confined as declared by the profile,
+// along with the files that it must inherit (starting at fd 3)
+func sandboxCommand(cfg *RuntimeConfig, profile *SandboxProfile, executable string, args []string) (string, []string, []*os.File, error) {
+	if profile.Backend != "landlock" {
+		bwrap, err := findBwrap(cfg)
+		if err == nil {
+			return bwrapCommand(cfg, profile, bwrap, executable, args)
+		}
+		if profile.Backend == "bwrap" {
+			return "", nil, nil, fmt.Errorf("the sandbox profile of this AppBundle requires bwrap: %w", err)
+		}
+	}
+	executable, args, err := confineCommand(cfg, profile, executable, args)
+	return executable, args, nil, err
+}
+
+// bwrapCommand wraps executable+args in a bwrap invocation that implements the profile
+func bwrapCommand(cfg *RuntimeConfig, profile *SandboxProfile, bwrap, executable string, args []string) (string, []string, []*os.File, error) {
+	var extraFiles []*os.File
+	bwrapArgs := []string{"--unshare-all", "--die-with-parent"}
+	if profile.Network {
+		bwrapArgs = append(bwrapArgs, "--share-net")
+	}
+
+	if profile.Rootfs != "" {
+		bwrapArgs = append(bwrapArgs, "--bind", filepath.Join(cfg.mountDir, profile.Rootfs), "/")
+		for _, file := range sandboxHostFiles {
+			bwrapArgs = append(bwrapArgs, "--ro-bind-try", file, file)
+		}
+	} else {
+		bwrapArgs = append(bwrapArgs, "--ro-bind", "/", "/")
+	}
+	bwrapArgs = append(bwrapArgs, "--proc", "/proc", "--tmpfs", "/tmp")
+
+	if slices.Contains(profile.Devices, "all") {
+		bwrapArgs = append(bwrapArgs, "--dev-bind", "/dev", "/dev")
+	} else {
+		bwrapArgs = append(bwrapArgs, "--dev", "/dev")
+		for _, device := range profile.Devices {
+			matches, _ := filepath.Glob(filepath.Join("/dev", device))
+			for _, match := range matches {
+				bwrapArgs = append(bwrapArgs, "--dev-bind-try", match, match)
+			}
+		}
+	}
+
+	bwrapArgs = append(bwrapArgs, "--ro-bind", cfg.mountDir, cfg.mountDir, "--ro-bind", cfg.mountDir, "/app")
+
+	// The portable dirs are what the app sees as its $HOME, $XDG_CONFIG_HOME, etc
+	for _, dir := range existingPortableDirs(cfg) {
+		bwrapArgs = append(bwrapArgs, "--bind", dir, dir)
+	}
+
+	binds := []SandboxBind{}
+	for _, share := range profile.Share {
+		binds = append(binds, sandboxShares[share]...)
+	}
+	binds = append(binds, profile.Binds...)
+	for _, bind := range binds {
+		src, ok := expandBindPath(bind.Src)
+		if !ok {
+			continue
+		}
+		dest := src
+		if bind.Dest != "" {
+			if dest, ok = expandBindPath(bind.Dest); !ok {
+				continue
+			}
+		}
+		switch bind.Mode {
+		case "", "ro":
+			bwrapArgs = append(bwrapArgs, "--ro-bind-try", src, dest)
+		case "rw":
+			bwrapArgs = append(bwrapArgs, "--bind-try", src, dest)
+		case "dev":
+			bwrapArgs = append(bwrapArgs, "--dev-bind-try", src, dest)
+		default:
+			return "", nil, nil, fmt.Errorf("invalid sandbox profile: unknown bind mode %q for %s", bind.Mode, bind.Src)
+		}
+	}
+
+	if prog, err := seccompFilter(profile.Seccomp); err != nil {
+		return "", nil, nil, err
+	} else if prog != nil {
+		// bwrap loads the filter right before it execs the command
+		seccompFd, err := seccompFile(prog)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("failed to pass the seccomp filter to bwrap: %w", err)
+		}
+		extraFiles = append(extraFiles, seccompFd)
+		bwrapArgs = append(bwrapArgs, "--seccomp", "3")
+	}
+
+	if profile.Uid0Gid0 {
+		bwrapArgs = append(bwrapArgs, "--uid", "0", "--gid", "0")
+	}
+
+	if len(profile.Env) > 0 {
+		bwrapArgs = append(bwrapArgs, "--clearenv")
+		for _, key := range append(slices.Clone(sandboxRuntimeEnv), profile.Env...) {
+			if value := getEnv(globalEnv, key); value != "" {
+				bwrapArgs = append(bwrapArgs, "--setenv", key, value)
+			}
+		}
+	}
+
+	if len(profile.Exec) > 0 {
+		executable, args = profile.Exec[0], append(slices.Clone(profile.Exec[1:]), args...)
+	}
+	bwrapArgs = append(bwrapArgs, "--", executable)
+	return bwrap, append(bwrapArgs, args...), extraFiles, nil
+}
+
+// expandBindPath expands the env variables of a bind, binds that reference unset variables (such as $WAYLAND_DISPLAY on X11) must be skipped
+func expandBindPath(path string) (string, bool) {
+	ok := true
+	path = os.Expand(path, func(key string) string {
+		value := getEnv(globalEnv, key)
+		if value == "" {
+			ok = false
+		}
+		return value
+	})
+	return path, ok && path != ""
+}
+
+func isDirectory(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
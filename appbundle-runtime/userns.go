@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Set by the runtime on its re-executed self, contains the uid:gid of the user outside of the namespace
+const usernsEnvVar = "PBUNDLE_INTERNAL_USERNS"
+
+// useUserns tells whether we should mount the image ourselves in a user+mount namespace instead of relying on fusermount.
+// PBUNDLE_USERNS=1 forces it, PBUNDLE_USERNS=0 disables it, otherwise it is only used when there is no fusermount on the host
+func useUserns(cfg *RuntimeConfig) bool {
+	if cfg.inUserns {
+		return false
+	}
+	switch getSetting("PBUNDLE_USERNS") {
+	case "1":
+		return true
+	case "0":
+		return false
+	}
+	for _, cmd := range []string{"fusermount3", "fusermount"} {
+		if _, err := lookPath(cmd, globalPath); err == nil {
+			return false
+		}
+	}
+	f, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// execInUserns re-executes the runtime as "root" of a new user+mount namespace, where
+// it'll mount the image by itself and run the AppRun. It only returns if the namespace
+// could not be created at all, in which case the caller should proceed as usual
+func execInUserns(cfg *RuntimeConfig) error {
+	cmd := exec.Command(cfg.selfPath, os.Args[1:]...)
+	cmd.Args[0] = os.Args[0]
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append([]string{}, globalEnv...)
+	setEnv(&cmd.Env, usernsEnvVar, fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()))
+	// The child must use our workDir, so that we can clean it up afterwards
+	setEnv(&cmd.Env, cfg.rExeName+"_workDir", cfg.workDir)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to create user namespace: %w", err)
+	}
+
+	exitCode := 0
+	if err := cmd.Wait(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			logError("User namespace child failed", err, cfg)
+		}
+		exitCode = exitErr.ExitCode()
+	}
+	detachedCleanup(cfg)
+	os.Exit(exitCode)
+	return nil
+}
+
+// initUserns is called on startup, it tells whether we're the re-executed child of execInUserns
+func initUserns(cfg *RuntimeConfig) {
+	ids := getEnv(globalEnv, usernsEnvVar)
+	if ids == "" {
+		return
+	}
+	unsetEnv(&globalEnv, usernsEnvVar)
+	unsetEnv(&globalEnv, cfg.rExeName+"_workDir")
+
+	uid, gid, ok := strings.Cut(ids, ":")
+	if !ok {
+		return
+	}
+	cfg.inUserns = true
+	cfg.outerUid, _ = strconv.Atoi(uid)
+	cfg.outerGid, _ = strconv.Atoi(gid)
+	// Our parent takes care of the workDir, while the mount dies along with the namespace
+	cfg.noCleanup = true
+}
+
+// mountImageUserns opens /dev/fuse and mounts it ourselves, the FUSE driver then gets the fd as its mountpoint (/dev/fd/N)
+func mountImageUserns(cfg *RuntimeConfig, fs *Filesystem) error {
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make the mount namespace private: %w", err)
+	}
+	if err := os.MkdirAll(cfg.mountDir, 0755); err != nil {
+		return fmt.Errorf("failed to create mount directory %s: %v", cfg.mountDir, err)
+	}
+
+	fuseDev, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open /dev/fuse: %w", err)
+	}
+	defer fuseDev.Close()
+
+	opts := fmt.Sprintf("fd=%d,rootmode=40000,user_id=0,group_id=0", fuseDev.Fd())
+	if err := syscall.Mount(cfg.selfPath, cfg.mountDir, "fuse."+cfg.appBundleFS, syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_RDONLY, opts); err != nil {
+		return fmt.Errorf("failed to mount /dev/fuse at %s: %w", cfg.mountDir, err)
+	}
+
+	cfg.fuseDev = fuseDev
+	defer func() { cfg.fuseDev = nil }()
+
+	cmd := fs.MountCmd(cfg)
+	cmd.SetStdout(os.Stdout)
+	cmd.SetStderr(os.Stderr)
+	if err := cmd.Run(); err != nil {
+		_ = syscall.Unmount(cfg.mountDir, syscall.MNT_DETACH)
+		logWarning(fmt.Sprintf("Failed to mount %s archive: %v", cfg.appBundleFS, err))
+		return err
+	}
+
+	go func() {
+		_ = os.WriteFile(filepath.Join(cfg.workDir, ".pid"), []byte(fmt.Sprintf("%d", os.Getpid())), 0644)
+	}()
+
+	return nil
+}
+
+// fuseMountpoint returns the mountpoint that should be given to the FUSE driver
+func fuseMountpoint(cfg *RuntimeConfig) string {
+	if cfg.fuseDev != nil {
+		return "/dev/fd/3"
+	}
+	return cfg.mountDir
+}
+
+// fuseExtraFiles returns the files that the FUSE driver must inherit, /dev/fuse becomes its fd 3
+func fuseExtraFiles(cfg *RuntimeConfig) []*os.File {
+	if cfg.fuseDev != nil {
+		return []*os.File{cfg.fuseDev}
+	}
+	return nil
+}
+
+// usernsSysProcAttr nests the AppRun in another user namespace, so that it runs as the original user instead of "root"
+func usernsSysProcAttr(cfg *RuntimeConfig) *syscall.SysProcAttr {
+	if !cfg.inUserns {
+		return nil
+	}
+	return &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: cfg.outerUid, HostID: 0, Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: cfg.outerGid, HostID: 0, Size: 1}},
+	}
+}
+
+func unsetEnv(env *[]string, key string) {
+	for i, e := range *env {
+		if strings.HasPrefix(e, key+"=") {
+			*env = append((*env)[:i], (*env)[i+1:]...)
+			return
+		}
+	}
+}
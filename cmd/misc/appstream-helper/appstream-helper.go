@@ -5,7 +5,6 @@ import (
 	"debug/elf"
 	"encoding/base64"
 	"encoding/hex"
-	"encoding/xml"
 	"flag"
 	"fmt"
 	"io"
@@ -20,6 +19,7 @@ import (
 	"github.com/goccy/go-json"
 	"github.com/jaytaylor/html2text"
 	"github.com/shamaton/msgpack/v2"
+	"github.com/xplshn/pelf/pkg/appstream"
 	"github.com/xplshn/pelf/pkg/utils"
 	"github.com/zeebo/blake3"
 )
@@ -81,28 +81,6 @@ type AppStreamMetadata struct {
 	Screenshots     []string `json:"screenshots"`
 }
 
-type AppStreamXML struct {
-	XMLName xml.Name `xml:"component"`
-	ID      string   `xml:"id"`
-	Names   []struct {
-		Lang string `xml:"lang,attr"`
-		Text string `xml:",chardata"`
-	} `xml:"name"`
-	Summaries []struct {
-		Lang string `xml:"lang,attr"`
-		Text string `xml:",chardata"`
-	} `xml:"summary"`
-	Description struct {
-		InnerXML string `xml:",innerxml"`
-	} `xml:"description"`
-	Icon        string `xml:"icon"`
-	Screenshots struct {
-		Screenshot []struct {
-			Image string `xml:"image"`
-		} `xml:"screenshot"`
-	} `xml:"screenshots"`
-}
-
 type RuntimeInfo struct {
 	AppBundleID    string `json:"AppBundleID"`
 	FilesystemType string `json:"FilesystemType"`
@@ -250,7 +228,7 @@ func isExecutable(path string) (bool, error) {
 	return fileInfo.Mode()&0111 != 0, nil
 }
 
-func extractAppStreamXML(filename string) (*AppStreamXML, error) {
+func extractAppStreamXML(filename string) (*appstream.Component, error) {
 	cmd := exec.Command(filename, "--pbundle_appstream")
 	output, err := cmd.Output()
 	if err != nil {
@@ -262,13 +240,12 @@ func extractAppStreamXML(filename string) (*AppStreamXML, error) {
 		return nil, fmt.Errorf("%sfailed to decode base64 output from %s%s%s: %v", errorColor, blueColor, filename, resetColor, err)
 	}
 
-	var appStreamXML AppStreamXML
-	err = xml.Unmarshal(decodedOutput, &appStreamXML)
+	component, err := appstream.Parse(decodedOutput)
 	if err != nil {
 		return nil, fmt.Errorf("%sfailed to unmarshal XML from %s%s%s: %v", errorColor, blueColor, filename, resetColor, err)
 	}
 
-	return &appStreamXML, nil
+	return component, nil
 }
 
 func generateMarkdown(dbinMetadata DbinMetadata) (string, error) {
@@ -281,8 +258,12 @@ func generateMarkdown(dbinMetadata DbinMetadata) (string, error) {
 		allEntries = append(allEntries, entries...)
 	}
 
+	// The releases of an application are listed newest first
 	sort.Slice(allEntries, func(i, j int) bool {
-		return strings.ToLower(allEntries[i].Name) < strings.ToLower(allEntries[j].Name)
+		if a, b := strings.ToLower(allEntries[i].Name), strings.ToLower(allEntries[j].Name); a != b {
+			return a < b
+		}
+		return utils.CompareVersions(allEntries[i].Version, allEntries[j].Version) > 0
 	})
 
 	for _, entry := range allEntries {
@@ -397,16 +378,21 @@ func main() {
 		// Try to get name from embedded AppStream XML
 		appStreamXML, err := extractAppStreamXML(path)
 		if err == nil && appStreamXML != nil {
-			if !strings.Contains(getText(appStreamXML.Names), " ") {
-				name = getText(appStreamXML.Names)
+			if !strings.Contains(appStreamXML.Name("en"), " ") {
+				name = appStreamXML.Name("en")
 			}
-			if appStreamXML.Icon != "" {
-				item.Icon = appStreamXML.Icon
+			// Remote icons are preferred, as they can be shown without the AppBundle
+			for _, icon := range appStreamXML.Icons {
+				if item.Icon == "" || (icon.Type == "remote" && !strings.Contains(item.Icon, "://")) {
+					item.Icon = icon.Value
+				}
 			}
-			for _, screenshot := range appStreamXML.Screenshots.Screenshot {
-				item.Screenshots = append(item.Screenshots, screenshot.Image)
+			for _, screenshot := range appStreamXML.Screenshots {
+				if image := sourceImage(screenshot.Images); image != "" {
+					item.Screenshots = append(item.Screenshots, image)
+				}
 			}
-			if summary := getText(appStreamXML.Summaries); summary != "" {
+			if summary := appStreamXML.Summary("en"); summary != "" {
 				summaryText, err := html2text.FromString(summary, html2text.Options{PrettyTables: true})
 				if err != nil {
 					log.Printf("%sfailed to convert embedded AppStream summary to plain text for %s%s%s: %v", warningColor, blueColor, path, resetColor, err)
@@ -415,11 +401,11 @@ func main() {
 					item.Description = summaryText
 				}
 			}
-			if appStreamXML.Description.InnerXML != "" {
-				descText, err := html2text.FromString(appStreamXML.Description.InnerXML, html2text.Options{PrettyTables: true})
+			if description := appStreamXML.Description("en"); description != "" {
+				descText, err := html2text.FromString(description, html2text.Options{PrettyTables: true})
 				if err != nil {
 					log.Printf("%sfailed to convert embedded AppStream description to plain text for %s%s%s: %v", warningColor, blueColor, path, resetColor, err)
-					item.LongDescription = appStreamXML.Description.InnerXML
+					item.LongDescription = description
 				} else {
 					item.LongDescription = descText
 				}
@@ -543,26 +529,16 @@ func main() {
 	}
 }
 
-func getText(elements []struct {
-	Lang string `xml:"lang,attr"`
-	Text string `xml:",chardata"`
-}) string {
-	for _, elem := range elements {
-		if elem.Lang == "en" || elem.Lang == "en_US" || elem.Lang == "en_GB" {
-			return strings.TrimSpace(elem.Text)
+// sourceImage returns the URL of the original image of a screenshot, or of its first image if none is marked as such
+func sourceImage(images []appstream.Image) string {
+	for _, image := range images {
+		if image.Type == "" || image.Type == "source" {
+			return image.Value
 		}
 	}
-
-	for _, elem := range elements {
-		if elem.Lang == "" {
-			return strings.TrimSpace(elem.Text)
-		}
+	if len(images) > 0 {
+		return images[0].Value
 	}
-
-	if len(elements) > 0 {
-		return strings.TrimSpace(elements[0].Text)
-	}
-
 	return ""
 }
 
@@ -15,6 +15,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/xplshn/pelf/pkg/appstream"
 	"github.com/xplshn/pelf/pkg/utils"
 
 	"github.com/mholt/archives"
@@ -432,9 +433,42 @@ func handleEntrypoint(config Config) error {
 		}
 	}
 
+	checkMetainfo(config)
 	return nil
 }
 
+// checkMetainfo warns about the problems of the AppStream metainfo file of the application, if its package ships one. It is
+// looked up by the AppStream ID, and by the desktop ID of the entrypoint, which its launchable must match
+func checkMetainfo(config Config) {
+	var desktopIDs, names []string
+	if config.AppStreamID != "" {
+		names = append(names, config.AppStreamID)
+	}
+	if strings.HasSuffix(config.Entrypoint, ".desktop") {
+		desktopIDs = []string{config.Entrypoint}
+		names = append(names, strings.TrimSuffix(config.Entrypoint, ".desktop"))
+	}
+
+	for _, name := range names {
+		for _, file := range []string{"metainfo/" + name + ".metainfo.xml", "metainfo/" + name + ".appdata.xml", "appdata/" + name + ".appdata.xml"} {
+			path := filepath.Join(config.AppDir, "proto", "usr", "share", file)
+			if _, err := os.Stat(path); err != nil {
+				continue
+			}
+			component, err := appstream.ParseFile(path)
+			if err == nil {
+				err = component.Validate(desktopIDs)
+			}
+			if err != nil {
+				for _, problem := range strings.Split(err.Error(), "\n") {
+					log.Printf("%s %s: %s", warning, file, problem)
+				}
+			}
+			return
+		}
+	}
+}
+
 func setupExecutionMode(config Config) error {
 	switch {
 	case config.Sandbox:
@@ -674,20 +708,19 @@ func handleDesktopFile(config Config) error {
 	}
 
 	// Extract the Exec entry from [Desktop Entry] section
-	executable := df.GetValue("Desktop Entry", "Exec")
-	if executable == "" {
+	if df.GetValue(utils.DesktopEntry, "Exec") == "" {
 		return fmt.Errorf("no Exec entry in desktop file")
 	}
 
-	// Take the first part of Exec (before arguments)
-	execParts := strings.Fields(executable)
-	if len(execParts) == 0 {
-		return fmt.Errorf("invalid Exec entry in desktop file")
+	// Take the program of Exec (before arguments), which may be quoted
+	execParts, err := utils.ParseExec(df.Value(utils.DesktopEntry, "Exec"))
+	if err != nil {
+		return fmt.Errorf("invalid Exec entry in desktop file: %v", err)
 	}
-	executable = execParts[0]
+	executable := execParts[0]
 
 	// Extract the Icon entry
-	iconName := df.GetValue("Desktop Entry", "Icon")
+	iconName := df.Value(utils.DesktopEntry, "Icon")
 
 	// Update entrypoint with the executable
 	newConfig := config
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/xplshn/pelf/pkg/integration"
+	"golang.org/x/sys/unix"
+)
+
+// How long a client waiting for events is kept waiting, before it has to ask again
+const eventsTimeout = 30 * time.Second
+
+// Status describes the running daemon
+type Status struct {
+	Version     string    `json:"version"`
+	PID         int       `json:"pid"`
+	Socket      string    `json:"socket"`
+	Watching    bool      `json:"watching"`            // Whether the directories to walk are watched through inotify, rather than probed
+	Directories []string  `json:"directories_to_walk"` // Directories to scan for bundles
+	Bundles     int       `json:"bundles"`             // How many bundles are integrated
+	LastScan    time.Time `json:"last_scan"`
+}
+
+// Control is the API of the control socket, served through JSON-RPC as "Pelfd". Requests that touch the tracker are run by
+// the goroutine of the daemon, one at a time. Replies are never null, which the JSON-RPC client of net/rpc takes for an error
+type Control struct {
+	d *daemon
+}
+
+// List returns the integrated bundles, keyed by their path
+func (c *Control) List(_ struct{}, reply *map[string]*integration.Entry) error {
+	entries := make(map[string]*integration.Entry)
+	c.d.do(func() {
+		for path, entry := range c.d.config.Tracker {
+			e := *entry
+			entries[path] = &e
+		}
+	})
+	*reply = entries
+	return nil
+}
+
+// Integrate integrates the bundle at path, or those within it if it is a directory
+func (c *Control) Integrate(path string, reply *[]Event) error {
+	if !fileExists(path) {
+		return fmt.Errorf("%s does not exist", path)
+	}
+	c.d.do(func() { *reply = c.d.integrateBundle([]string{path}) })
+	return nil
+}
+
+// Deintegrate deintegrates the bundle at path
+func (c *Control) Deintegrate(path string, reply *[]Event) (err error) {
+	c.d.do(func() { *reply, err = c.d.deintegrateBundle(path) })
+	return err
+}
+
+// Approve integrates a bundle that was quarantined, or checks a refused one against the policy again
+func (c *Control) Approve(path string, reply *[]Event) (err error) {
+	c.d.do(func() { *reply, err = c.d.approveBundle(path) })
+	return err
+}
+
+// Rescan scans the directories to walk right away
+func (c *Control) Rescan(_ struct{}, reply *[]Event) error {
+	c.d.do(func() { *reply = c.d.rescan() })
+	return nil
+}
+
+// Status describes the daemon
+func (c *Control) Status(_ struct{}, reply *Status) error {
+	c.d.do(func() {
+		bundles := 0
+		for _, entry := range c.d.config.Tracker {
+			if entry.Refused == "" {
+				bundles++
+			}
+		}
+		socketPath, _ := controlPath(".sock")
+		*reply = Status{
+			Version:     Version,
+			PID:         os.Getpid(),
+			Socket:      socketPath,
+			Watching:    c.d.watching,
+			Directories: c.d.config.Options.DirectoriesToWalk,
+			Bundles:     bundles,
+			LastScan:    c.d.lastScan,
+		}
+	})
+	return nil
+}
+
+// Events returns the events that came after the one of the given ID, waiting for one to come if there are none yet
+func (c *Control) Events(since int, reply *[]Event) error {
+	*reply = c.d.eventsSince(since, eventsTimeout)
+	return nil
+}
+
+// controlPath returns the path of the control socket (ext = ".sock") or of the lock file (ext = ".lock") of the daemon. They are
+// kept in $XDG_RUNTIME_DIR or, without one, in $XDG_STATE_HOME/pelfd, rather than in a directory that other users can write to,
+// where they could create them first to keep the daemon from starting, or to stand in for it
+func controlPath(ext string) (string, error) {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" && isDirectory(dir) {
+		return filepath.Join(dir, "pelfd"+ext), nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Dir(defaultTrackerPath(homeDir))
+	if err := privateDir(dir); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "pelfd"+ext), nil
+}
+
+// privateDir creates dir if needed, and makes sure that it is a directory of the user that nobody else has access to. The
+// tracker may have been written to it first, which makes it readable by others, so it is restricted to the user if it is theirs
+func privateDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok || int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is not a directory of yours", dir)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return os.Chmod(dir, 0700)
+	}
+	return nil
+}
+
+// lock takes the lock file, which is held by whoever may write the tracker: the daemon, or the command line when the daemon isn't
+// running. It fails with unix.EWOULDBLOCK if somebody else holds it
+func lock() (*os.File, error) {
+	path, err := controlPath(".lock")
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|unix.O_NOFOLLOW, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// serve runs the daemon, along with its control socket
+func (d *daemon) serve() {
+	lockFile, err := lock()
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		logMessage("ERR", fmt.Sprintf("pelfd is already running: <red>%v</red>", err))
+		return
+	} else if err != nil {
+		logMessage("ERR", fmt.Sprintf("Failed to take the lock of the daemon: <red>%v</red>", err))
+		return
+	}
+	defer lockFile.Close()
+
+	// Any socket left behind is stale, since the lock is ours
+	socketPath, _ := controlPath(".sock")
+	os.Remove(socketPath)
+	umask := unix.Umask(0077)
+	listener, err := net.Listen("unix", socketPath)
+	unix.Umask(umask)
+	if err != nil {
+		logMessage("ERR", fmt.Sprintf("Failed to create the control socket %s: <red>%v</red>", socketPath, err))
+		return
+	}
+	defer listener.Close()
+
+	server := rpc.NewServer()
+	server.RegisterName("Pelfd", &Control{d: d})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.ServeCodec(jsonrpc.NewServerCodec(conn))
+		}
+	}()
+	logMessage("INF", fmt.Sprintf("Listening on %s", socketPath))
+	d.run()
+}
+
+// request calls method through the control socket of the daemon. If the daemon isn't running, the request is served directly
+// by d, unless d is nil. It reports whether the request succeeded
+func request(d *daemon, method string, args, reply any) bool {
+	socketPath, err := controlPath(".sock")
+	if err != nil {
+		logMessage("ERR", fmt.Sprintf("Failed to locate the control socket: <red>%v</red>", err))
+		return false
+	}
+	client, err := jsonrpc.Dial("unix", socketPath)
+	if err != nil {
+		if d == nil {
+			logMessage("ERR", fmt.Sprintf("pelfd is not running: <red>%v</red>", err))
+			return false
+		}
+		lockFile, err := lock()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			logMessage("ERR", fmt.Sprintf("pelfd is running, but its control socket %s is unreachable", socketPath))
+			return false
+		} else if err != nil {
+			logMessage("ERR", fmt.Sprintf("Failed to take the lock of the daemon: <red>%v</red>", err))
+			return false
+		}
+		defer lockFile.Close()
+
+		// Serve the request in-process, over a pipe, with d running its requests as the daemon would
+		server := rpc.NewServer()
+		server.RegisterName("Pelfd", &Control{d: d})
+		serverConn, clientConn := net.Pipe()
+		go server.ServeCodec(jsonrpc.NewServerCodec(serverConn))
+		go func() {
+			for op := range d.ops {
+				op()
+			}
+		}()
+		client = jsonrpc.NewClient(clientConn)
+	}
+	defer client.Close()
+
+	if err := client.Call(method, args, reply); err != nil {
+		logMessage("ERR", fmt.Sprintf("%s failed: <red>%v</red>", method, err))
+		return false
+	}
+	return true
+}
+
+// requestChanges calls method, and reports what happened to the bundles
+func requestChanges(d *daemon, method string, args any) {
+	var events []Event
+	if !request(d, method, args, &events) {
+		return
+	}
+	if len(events) == 0 {
+		logMessage("INF", "Nothing changed")
+	}
+	for _, event := range events {
+		logEvent(event)
+	}
+}
+
+// followEvents prints the events of the daemon as they come, one JSON object per line
+func followEvents() {
+	since := 0
+	for {
+		var events []Event
+		if !request(nil, "Pelfd.Events", since, &events) {
+			return
+		}
+		for _, event := range events {
+			data, _ := json.Marshal(event)
+			fmt.Println(string(data))
+			since = event.ID
+		}
+	}
+}
+
+func logEvent(event Event) {
+	level := "INF"
+	switch event.Kind {
+	case "error":
+		level = "ERR"
+	case "quarantined", "refused":
+		level = "WRN"
+	}
+	message := fmt.Sprintf("%s: %s", event.Kind, event.Path)
+	if event.Message != "" {
+		message += fmt.Sprintf(" (%s)", event.Message)
+	}
+	logMessage(level, message)
+}
+
+func printJSON(v any) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		logMessage("ERR", fmt.Sprintf("Failed to encode the reply: <red>%v</red>", err))
+		return
+	}
+	fmt.Println(string(data))
+}
+
+// absPath expands the tilde of path, and makes it absolute, as the daemon may not share the working directory of the client
+func absPath(path, homeDir string) string {
+	if abs, err := filepath.Abs(expand(path, homeDir)); err == nil {
+		return abs
+	}
+	return path
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestControlPath(t *testing.T) {
+	stateDir := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	t.Setenv("XDG_STATE_HOME", stateDir)
+
+	// The tracker may have made the directory readable by others, it is restricted before the lock and socket are put in it
+	dir := filepath.Join(stateDir, "pelfd")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path, err := controlPath(".lock")
+	if err != nil || path != filepath.Join(dir, "pelfd.lock") {
+		t.Fatalf("controlPath(.lock) = %q, %v", path, err)
+	}
+	if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("Expected %s to be restricted to the user, got %v (err=%v)", dir, info.Mode(), err)
+	}
+
+	// Nothing is put where a symlink leads
+	os.RemoveAll(dir)
+	if err := os.Symlink(t.TempDir(), dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := controlPath(".sock"); err == nil {
+		t.Errorf("Expected a symlink in place of the directory to be refused")
+	}
+
+	runtimeDir := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+	if path, err := controlPath(".sock"); err != nil || path != filepath.Join(runtimeDir, "pelfd.sock") {
+		t.Errorf("Expected the socket to be within $XDG_RUNTIME_DIR, got %q, %v", path, err)
+	}
+}
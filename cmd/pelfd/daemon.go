@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// How many events are kept for the clients that follow them
+const maxEvents = 256
+
+// Event is something that happened to a bundle, as reported to the clients of the control socket
+type Event struct {
+	ID      int       `json:"id"`
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"` // "integrated", "deintegrated", "quarantined", "refused" or "error"
+	Path    string    `json:"path"`
+	Message string    `json:"message,omitempty"`
+}
+
+// daemon owns the config and its tracker. Only the goroutine that runs it touches them, the control socket hands it the
+// requests of the clients through ops, so that the tracker is never written by two parties at once
+type daemon struct {
+	config          Config
+	trackerFilePath string
+	homeDir         string
+	ops             chan func()
+	lastScan        time.Time // When the directories to walk were last scanned
+	watching        bool
+	approving       string // Bundle being approved, which is let out of quarantine
+
+	mu          sync.Mutex
+	events      []Event
+	nextEventID int
+	newEvents   chan struct{} // Closed, and replaced, whenever an event is recorded
+}
+
+func newDaemon(config Config, trackerFilePath, homeDir string) *daemon {
+	return &daemon{
+		config:          config,
+		trackerFilePath: trackerFilePath,
+		homeDir:         homeDir,
+		ops:             make(chan func()),
+		nextEventID:     1,
+		newEvents:       make(chan struct{}),
+	}
+}
+
+// do runs op within the goroutine of the daemon, and waits for it to complete
+func (d *daemon) do(op func()) {
+	done := make(chan struct{})
+	d.ops <- func() {
+		defer close(done)
+		op()
+	}
+	<-done
+}
+
+// run scans the directories to walk whenever they change, and serves the requests of the clients in between. Directories are
+// watched through inotify, polling is only used for those that can't be watched
+func (d *daemon) run() {
+	probeInterval := time.Duration(d.config.Options.ProbeInterval) * time.Second
+	var wake chan struct{}
+	var watchDirs chan []string
+	if d.config.Options.Watch {
+		if w, err := newWatcher(); err != nil {
+			logMessage("WRN", fmt.Sprintf("inotify is unavailable, falling back to probing every %s: %v", probeInterval, err))
+		} else {
+			wake, watchDirs = make(chan struct{}), make(chan []string)
+			d.watching = true
+			go w.run(watchDirs, wake, probeInterval)
+		}
+	}
+
+	// Refused bundles are looked at again, as the policy may have changed since
+	for path, entry := range d.config.Tracker {
+		if entry.Refused != "" {
+			delete(d.config.Tracker, path)
+		}
+	}
+
+	for {
+		d.rescan()
+		var probe <-chan time.Time
+		if d.watching {
+			watchDirs <- d.watchedDirs()
+		} else {
+			probe = time.After(probeInterval)
+		}
+
+		for idle := true; idle; {
+			select {
+			case op := <-d.ops:
+				op()
+			case <-wake:
+				idle = false
+			case <-probe:
+				idle = false
+			}
+		}
+	}
+}
+
+// saveTracker writes the tracker to its database
+func (d *daemon) saveTracker() {
+	logMessage("INF", fmt.Sprintf("Updating %s", d.trackerFilePath))
+	if err := writeTracker(d.trackerFilePath, d.config.Tracker); err != nil {
+		logMessage("ERR", fmt.Sprintf("Failed to save the tracker database: <red>%v</red>", err))
+	}
+}
+
+// rescan integrates the bundles within the directories to walk, and deintegrates those that are gone
+func (d *daemon) rescan() []Event {
+	events := d.integrateBundle(d.config.Options.DirectoriesToWalk)
+	d.lastScan = time.Now()
+	return events
+}
+
+// watchedDirs returns the directories to walk, along with their subdirectories and the AppDirs within them
+func (d *daemon) watchedDirs() []string {
+	var dirs []string
+	for _, dir := range d.config.Options.DirectoriesToWalk {
+		root := expand(dir, d.homeDir)
+		dirs = append(dirs, root)
+		if isDirectory(root) {
+			// The AppDirs are watched too, as their AppRun and metadata files may change in place
+			bundles, subdirs := scanDirectory(root, d.config.Options.directoryOptions(dir, d.homeDir), d.config.Options.IntegrateFormats)
+			dirs = append(dirs, subdirs...)
+			for _, bundle := range bundles {
+				if isDirectory(bundle) {
+					dirs = append(dirs, bundle)
+				}
+			}
+		}
+	}
+	return dirs
+}
+
+// event records something that happened to a bundle, and wakes up the clients that wait for events
+func (d *daemon) event(kind, path, message string) Event {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	event := Event{ID: d.nextEventID, Time: time.Now(), Kind: kind, Path: path, Message: message}
+	d.events = append(d.events, event)
+	d.nextEventID++
+	if len(d.events) > maxEvents {
+		d.events = d.events[len(d.events)-maxEvents:]
+	}
+	close(d.newEvents)
+	d.newEvents = make(chan struct{})
+	return event
+}
+
+// eventsSince returns the events that came after the one of the given ID, waiting up to timeout for one to come if there are none
+func (d *daemon) eventsSince(id int, timeout time.Duration) []Event {
+	deadline := time.After(timeout)
+	for {
+		d.mu.Lock()
+		events := []Event{}
+		for _, event := range d.events {
+			if event.ID > id {
+				events = append(events, event)
+			}
+		}
+		newEvents := d.newEvents
+		d.mu.Unlock()
+		if len(events) > 0 {
+			return events
+		}
+
+		select {
+		case <-newEvents:
+		case <-deadline:
+			return events
+		}
+	}
+}
@@ -1,13 +1,15 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/user"
 	"path/filepath"
 	"strings"
-	"time"
+
+	"github.com/xplshn/pelf/pkg/integration"
 )
 
 // Version indicates the current PELFD version
@@ -15,29 +17,43 @@ const Version = "1.9"
 
 // Options defines the configuration options for the PELFD daemon.
 type Options struct {
-	DirectoriesToWalk   []string `json:"directories_to_walk"`   // Directories to scan for .AppBundle and .blob files.
-	ProbeInterval       int      `json:"probe_interval"`        // Interval in seconds between directory scans.
-	IconDir             string   `json:"icon_dir"`              // Directory to store extracted icons.
-	AppDir              string   `json:"app_dir"`               // Directory to store .desktop files.
-	CorrectDesktopFiles bool     `json:"correct_desktop_files"` // Flag to enable automatic correction of .desktop files.
-	IntegrateFormats    []string `json:"integrate_formats"`    // Formats to integrate
+	DirectoriesToWalk   []string                    `json:"directories_to_walk"`         // Directories to scan for .AppBundle and .blob files.
+	ProbeInterval       int                         `json:"probe_interval"`              // Interval in seconds between directory scans, when they can't be watched.
+	Watch               bool                        `json:"watch"`                       // Flag to watch the directories through inotify, instead of scanning them every ProbeInterval.
+	IconDir             string                      `json:"icon_dir"`                    // Directory to store extracted icons.
+	AppDir              string                      `json:"app_dir"`                     // Directory to store .desktop files.
+	CorrectDesktopFiles bool                        `json:"correct_desktop_files"`       // Flag to enable automatic correction of .desktop files.
+	IntegrateFormats    []string                    `json:"integrate_formats"`           // Formats to integrate
+	DirectoryOptions    map[string]DirectoryOptions `json:"directory_options,omitempty"` // How to scan each of DirectoriesToWalk (recursion, symlinks, globs, content sniffing), keyed like DirectoriesToWalk.
+	MimeDir             string                      `json:"mime_dir"`                    // shared-mime-info directory, whose packages/ receives the MIME types of the bundles.
+	SetDefaultHandlers  bool                        `json:"set_default_handlers"`        // Flag to make bundles the default application (in mimeapps.list) for the MIME types and URL schemes of their .desktop files.
+	Submenu             string                      `json:"submenu,omitempty"`           // Name of the submenu of the Applications menu in which the bundles are put, if any. Requires CorrectDesktopFiles.
+	Policy              Policy                      `json:"policy"`                      // Which bundles may be integrated, and whether they may be run to do so.
 }
 
 // Config represents the overall configuration structure for PELFD, including scanning options and a tracker for installed bundles.
 type Config struct {
-	Options Options                 `json:"options"` // PELFD configuration options.
-	Tracker map[string]*BundleEntry `json:"tracker"` // Tracker mapping bundle paths to their metadata entries.
+	Options Options                       `json:"options"` // PELFD configuration options.
+	Tracker map[string]*integration.Entry `json:"-"`       // Tracker mapping bundle paths to their metadata entries, stored in its own database.
 }
 
-// BundleEntry represents metadata associated with an installed bundle.
-type BundleEntry struct {
-	B3SUM       string `json:"b3sum"`               // B3SUM[0..256] hash of the bundle file.
-	Png         string `json:"png,omitempty"`       // Path to the PNG icon file, if extracted.
-	Svg         string `json:"svg,omitempty"`       // Path to the SVG icon file, if extracted.
-	Desktop     string `json:"desktop,omitempty"`   // Path to the corrected .desktop file, if processed.
-	Thumbnail   string `json:"thumbnail,omitempty"` // Path to the 128x128 png thumbnail file, if processed.
-	HasMetadata bool   `json:"has_metadata"`        // Indicates if metadata was found.
-	// LastUpdated int64  `json:"last_updated"`     // Epoch date when the entry was last updated.
+// newIntegrator returns the integrator of the bundles, which records them in the tracker of the config
+func (d *daemon) newIntegrator() *integration.Integrator {
+	options := d.config.Options
+	return integration.New(integration.Options{
+		IconDir:             options.IconDir,
+		AppDir:              options.AppDir,
+		MimeDir:             options.MimeDir,
+		CorrectDesktopFiles: options.CorrectDesktopFiles,
+		SetDefaultHandlers:  options.SetDefaultHandlers,
+		Submenu:             options.Submenu,
+		Software:            "pelfd " + Version,
+		NeverExecute:        options.Policy.NeverExecute,
+		Policy: func(path, src string, previous *integration.Entry) error {
+			return options.Policy.check(path, src, previous, path == d.approving)
+		},
+		Log: func(level, message string) { logMessage(level, message) },
+	}, integration.MapStore(d.config.Tracker))
 }
 
 func main() {
@@ -63,6 +79,11 @@ func main() {
 	version := flag.Bool("version", false, "Print the version number")
 	integratePath := flag.String("integrate", "", "Manually integrate a specific file or directory")
 	deintegratePath := flag.String("deintegrate", "", "Manually de-integrate a specific file or directory")
+	approvePath := flag.String("approve", "", "Integrate a bundle that was quarantined, or check a refused bundle against the policy again")
+	list := flag.Bool("list", false, "List the integrated bundles")
+	rescan := flag.Bool("rescan", false, "Rescan the directories to walk")
+	status := flag.Bool("status", false, "Print the status of the daemon")
+	events := flag.Bool("events", false, "Follow the bundles being integrated and deintegrated by the daemon")
 	extractPath := flag.String("extract", "", "Extract .DirIcon and .desktop to the specified directory")
 	outDir := flag.String("outdir", "", "For use with --extract")
 	flag.Parse()
@@ -73,7 +94,14 @@ func main() {
 		return
 	}
 
-	config := loadConfig(configFilePath, usr.HomeDir)
+	trackerFilePath := defaultTrackerPath(usr.HomeDir)
+	config, err := loadConfig(configFilePath, trackerFilePath, usr.HomeDir)
+	if err != nil {
+		logMessage("ERR", fmt.Sprintf("Failed to load the config: <red>%v</red>", err))
+		return
+	}
+
+	d := newDaemon(config, trackerFilePath, usr.HomeDir)
 
 	// Handle extract flag
 	if *extractPath != "" && *outDir != "" {
@@ -81,7 +109,8 @@ func main() {
 			logMessage("ERR", fmt.Sprintf("Specified file for extraction does not exist: %s", *extractPath))
 			return
 		}
-		extractMetadata(*extractPath, config.Options.IconDir, *outDir)
+		// The metadata is extracted as per the policy, which may refuse the bundle, or forbid running it
+		d.extractMetadata(absPath(*extractPath, usr.HomeDir), *outDir)
 		return
 	}
 
@@ -89,47 +118,71 @@ func main() {
 	os.MkdirAll(config.Options.IconDir, 0755)
 	os.MkdirAll(config.Options.AppDir, 0755)
 
-	// Manual integration mode
-	if *integratePath != "" {
-		integrateBundle(config, []string{*integratePath}, usr.HomeDir, configFilePath)
-		return
-	}
-
-	// Manual deintegration mode
-	if *deintegratePath != "" {
-		deintegrateBundle(config, *deintegratePath, configFilePath)
-		return
-	}
-
-	// Automatic probing loop
-	probeInterval := time.Duration(config.Options.ProbeInterval) * time.Second
-	for {
-		integrateBundle(config, config.Options.DirectoriesToWalk, usr.HomeDir, configFilePath)
-		time.Sleep(probeInterval)
+	// The other flags are requests to the daemon, which are served directly if it isn't running
+	switch {
+	case *integratePath != "":
+		requestChanges(d, "Pelfd.Integrate", absPath(*integratePath, usr.HomeDir))
+	case *deintegratePath != "":
+		requestChanges(d, "Pelfd.Deintegrate", absPath(*deintegratePath, usr.HomeDir))
+	case *approvePath != "":
+		requestChanges(d, "Pelfd.Approve", absPath(*approvePath, usr.HomeDir))
+	case *rescan:
+		requestChanges(d, "Pelfd.Rescan", struct{}{})
+	case *list:
+		var entries map[string]*integration.Entry
+		if request(d, "Pelfd.List", struct{}{}, &entries) {
+			printJSON(entries)
+		}
+	case *status:
+		var s Status
+		if request(nil, "Pelfd.Status", struct{}{}, &s) {
+			printJSON(s)
+		}
+	case *events:
+		followEvents()
+	default:
+		d.serve()
 	}
 }
 
-func integrateBundle(config Config, paths []string, homeDir string, configFilePath string) {
-	options := config.Options
-	entries := config.Tracker
+// integrateBundle integrates the bundles at paths, or within them if they're directories, deintegrates those that are gone, and
+// returns what happened to them
+func (d *daemon) integrateBundle(paths []string) []Event {
+	options := d.config.Options
+	integrator := d.newIntegrator()
 	changed := false
+	events := []Event{}
 
-	refreshBundle := func(bundle string, b3sum string, entry *BundleEntry, options Options) bool {
-		if entry == nil || entry.B3SUM != b3sum {
-			if isExecutable(bundle) {
-				integrateBundleMetadata(bundle, b3sum, entries, options.IconDir, options.AppDir, config)
-				return true
+	refreshBundle := func(bundle string) {
+		tracked := integrator.Store.Get(bundle) != nil
+		if !tracked {
+			logMessage("INF", fmt.Sprintf("New bundle detected: %s", filepath.Base(bundle)))
+		}
+		refreshed, err := integrator.Refresh(bundle)
+		switch {
+		case errors.Is(err, integration.ErrRefused):
+			kind := "refused"
+			if errors.Is(err, errQuarantined) {
+				kind = "quarantined"
+			}
+			logMessage("WRN", fmt.Sprintf("Not integrating %s: <yellow>%s</yellow>", bundle, integrator.Store.Get(bundle).Refused))
+			events = append(events, d.event(kind, bundle, integrator.Store.Get(bundle).Refused))
+		case err != nil:
+			logMessage("ERR", fmt.Sprintf("Failed to integrate %s: <red>%v</red>", bundle, err))
+			events = append(events, d.event("error", bundle, err.Error()))
+		case refreshed:
+			if integrator.Store.Get(bundle) != nil {
+				events = append(events, d.event("integrated", bundle, ""))
+			} else if tracked {
+				events = append(events, d.event("deintegrated", bundle, "no longer executable"))
 			}
-			// Bundle is not executable, remove entry
-			delete(entries, bundle)
-			return false
 		}
-		return false
+		changed = refreshed || changed
 	}
 
-	for _, filePath := range paths {
+	for _, path := range paths {
 		// Expand the tilde (~) to the user's home directory
-		filePath = expand(filePath, homeDir)
+		filePath := filepath.Clean(expand(path, d.homeDir))
 
 		// Check if the path is a file or directory
 		info, err := os.Stat(filePath)
@@ -138,160 +191,84 @@ func integrateBundle(config Config, paths []string, homeDir string, configFilePa
 			continue // Skip this file or handle it as needed
 		}
 
-		if info.IsDir() {
-			// If it's a directory, process all files within it
-			files, err := os.ReadDir(filePath)
-			if err != nil {
-				logMessage("ERR", fmt.Sprintf("Failed to read directory %s: %v", filePath, err))
-				continue // Handle directory read errors
-			}
-
-			for _, entry := range files {
-				if !entry.Type().IsRegular() {
-					logMessage("INF", fmt.Sprintf("Skipping non-regular file in directory: %s", entry.Name()))
-					continue // Skip non-regular files (like directories, symlinks, etc.)
-				}
-				// Process each file within the directory
-				filePathToIntegrate := filepath.Join(filePath, entry.Name())
-				if !isSupportedFile(filePathToIntegrate, options.IntegrateFormats) {
-					continue // Skip files that are not supported
-				}
-				b3sum := computeB3SUM(filePathToIntegrate)
-				if entry, exists := entries[filePathToIntegrate]; exists {
-					changed = refreshBundle(filePathToIntegrate, b3sum, entry, options) || changed
-					checkAndRecreateFiles(entry, filePathToIntegrate, options, &changed)
-				} else {
-					logMessage("INF", fmt.Sprintf("New bundle detected: %s", filepath.Base(filePathToIntegrate)))
-					changed = refreshBundle(filePathToIntegrate, b3sum, nil, options) || changed
-				}
+		if info.IsDir() && !isAppDir(filePath, options.IntegrateFormats) {
+			// If it's a directory, process the bundles within it (and within its subdirectories, as per its DirectoryOptions)
+			bundles, _ := scanDirectory(filePath, options.directoryOptions(path, d.homeDir), options.IntegrateFormats)
+			for _, bundle := range bundles {
+				refreshBundle(bundle)
 			}
 			continue // After processing all files, continue with the next path
 		}
 
-		// If it's a regular file, proceed as before
-		bundle := filePath
-		if !isSupportedFile(bundle, options.IntegrateFormats) {
+		// If it's a regular file or an AppDir, proceed as before
+		if !isSupportedFile(filePath, options.IntegrateFormats) && integration.SniffFormat(filePath) == "" {
 			continue // Skip files that are not supported
 		}
-		b3sum := computeB3SUM(bundle)
-
-		// Check if the bundle already exists in entries
-		if entry, exists := entries[bundle]; exists {
-			changed = refreshBundle(bundle, b3sum, entry, options) || changed
-			checkAndRecreateFiles(entry, bundle, options, &changed)
-		} else {
-			logMessage("INF", fmt.Sprintf("New bundle detected: %s", filepath.Base(bundle)))
-			changed = refreshBundle(bundle, b3sum, nil, options) || changed
-		}
+		refreshBundle(filePath)
 	}
 
 	// Check for deintegration of non-existing bundles
-	for bundlePath := range entries {
+	for _, bundlePath := range integrator.Store.Paths() {
 		if !fileExists(bundlePath) {
 			logMessage("WRN", fmt.Sprintf("Bundle %s does not exist. Deintegrating...", bundlePath))
-			deintegrateBundle(config, bundlePath, configFilePath)
+			integrator.Deintegrate(bundlePath)
+			events = append(events, d.event("deintegrated", bundlePath, "no longer exists"))
 			changed = true
 		}
 	}
 
 	if changed {
-		saveConfig(config, configFilePath)
+		d.saveTracker()
 	}
+	return events
 }
 
-func checkAndRecreateFiles(entry *BundleEntry, bundle string, options Options, changed *bool) {
-	if entry == nil {
-		return
-	}
-
-	checkAndRecreateFile := func(filePath *string, param, outputDir, extension string) {
-		if *filePath != "" && !fileExists(*filePath) {
-			logMessage("WRN", fmt.Sprintf("The file for %s doesn't exist anymore. Re-creating...", filepath.Base(bundle)))
-			newFilePath := filepath.Join(outputDir, filepath.Base(remExtension(bundle))+extension)
-			*filePath = executeAppBundle(bundle, param, newFilePath)
-			if *filePath != "" {
-				*changed = true
-			}
-		}
-	}
-
-	// Check and recreate thumbnail if missing
-	if entry.Thumbnail != "" && !fileExists(entry.Thumbnail) {
-		logMessage("WRN", fmt.Sprintf("The thumbnail file for %s doesn't exist anymore. Generating new thumbnail...", filepath.Base(bundle)))
-		thumbnailPath, err := generateThumbnail(bundle, entry.Png)
-		if err != nil {
-			logMessage("ERR", fmt.Sprintf("Failed to create thumbnail file: %v", err))
-		} else {
-			entry.Thumbnail = thumbnailPath
-			logMessage("INF", fmt.Sprintf("A new thumbnail for %s was created", filepath.Base(bundle)))
-			*changed = true
-		}
-	}
-
-	// Check and recreate PNG icon if missing
-	checkAndRecreateFile(&entry.Png, "--pbundle_pngIcon", options.IconDir, ".png")
-
-	// Check and recreate SVG icon if missing
-	checkAndRecreateFile(&entry.Svg, "--pbundle_svgIcon", options.IconDir, ".svg")
-
-	// Check and recreate desktop file if missing
-	checkAndRecreateFile(&entry.Desktop, "--pbundle_desktop", options.AppDir, ".desktop")
-}
-
-func deintegrateBundle(config Config, filePath string, configFilePath string) {
-	entries := config.Tracker
-	changed := false
-
-	if entry, checked := entries[filePath]; checked && entry != nil {
-		cleanupBundle(filePath, entries)
-		changed = true
-	} else {
+// deintegrateBundle deintegrates the bundle at filePath, which has to be integrated
+func (d *daemon) deintegrateBundle(filePath string) ([]Event, error) {
+	if err := d.newIntegrator().Deintegrate(filePath); err != nil {
 		logMessage("WRN", fmt.Sprintf("Bundle %s is not integrated.", filePath))
+		return nil, err
 	}
+	d.saveTracker()
+	return []Event{d.event("deintegrated", filePath, "")}, nil
+}
 
-	// Save config if any changes were made
-	if changed {
-		logMessage("INF", fmt.Sprintf("Updating %s", configFilePath))
-		saveConfig(config, configFilePath)
+// approveBundle integrates a bundle that the policy refused, lifting its quarantine. The rest of the policy still applies
+func (d *daemon) approveBundle(filePath string) ([]Event, error) {
+	entry := d.config.Tracker[filePath]
+	if entry == nil || entry.Refused == "" {
+		return nil, fmt.Errorf("%s is neither quarantined nor refused", filePath)
 	}
+	// Forgetting about the refusal makes it be looked at again
+	delete(d.config.Tracker, filePath)
+	d.approving = filePath
+	defer func() { d.approving = "" }()
+	return d.integrateBundle([]string{filePath}), nil
 }
 
-func cleanupBundle(path string, entries map[string]*BundleEntry) {
-	entry := entries[path]
-	if entry == nil {
+func (d *daemon) extractMetadata(filePath, outDir string) {
+	baseName := strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
+	metadata, err := d.newIntegrator().Extract(filePath)
+	if err != nil {
+		logMessage("ERR", fmt.Sprintf("Failed to extract the metadata of %s: <red>%v</red>", filePath, err))
 		return
 	}
-	filesToRemove := []string{entry.Png, entry.Svg, entry.Desktop, entry.Thumbnail}
-	for _, file := range filesToRemove {
-		if file == "" {
+
+	files := []struct {
+		name, ext string
+		data      []byte
+	}{{"Icon", ".png", metadata.PNG}, {"SVG icon", ".svg", metadata.SVG}, {"Desktop file", ".desktop", metadata.Desktop}}
+	for _, file := range files {
+		if len(file.data) == 0 {
+			logMessage("WRN", fmt.Sprintf("Failed to extract %s", strings.ToLower(file.name)))
 			continue
 		}
-		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
-			logMessage("ERR", fmt.Sprintf("Failed to remove file: %s %v", file, err))
-		} else {
-			logMessage("INF", fmt.Sprintf("Removed file: %s", file))
+		outputFile := filepath.Join(outDir, baseName+file.ext)
+		if err := os.WriteFile(outputFile, file.data, 0644); err != nil {
+			logMessage("ERR", fmt.Sprintf("Failed to write file %s: <red>%v</red>", outputFile, err))
+			continue
 		}
-	}
-	delete(entries, path)
-}
-
-func extractMetadata(filePath, iconDir, appDir string) {
-	baseName := strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
-
-	// Extract .DirIcon
-	iconPath := filepath.Join(iconDir, baseName+".png")
-	if extractedIcon := extractAppImageMetadata("icon", filePath, iconPath); extractedIcon != "" {
-		logMessage("INF", fmt.Sprintf("Icon extracted to: %s", extractedIcon))
-	} else {
-		logMessage("WRN", "Failed to extract icon")
-	}
-
-	// Extract .desktop
-	desktopPath := filepath.Join(appDir, baseName+".desktop")
-	if extractedDesktop := extractAppImageMetadata("desktop", filePath, desktopPath); extractedDesktop != "" {
-		logMessage("INF", fmt.Sprintf("Desktop file extracted to: %s", extractedDesktop))
-	} else {
-		logMessage("WRN", "Failed to extract desktop file")
+		logMessage("INF", fmt.Sprintf("%s extracted to: %s", file.name, outputFile))
 	}
 }
 
@@ -306,36 +283,3 @@ func isSupportedFile(filePath string, integrateFormats []string) bool {
 	}
 	return false
 }
-
-// Function map for handling different formats
-var formatHandlers = map[string]func(string, string, *BundleEntry){
-	".AppImage": integrateAppImage,
-	".NixAppImage": integrateAppImage,
-	".AppBundle": integrateAppBundle,
-	".AppDir": integrateAppDir,
-}
-
-func integrateMetadata(path, b3sum string, entries map[string]*BundleEntry, iconPath, appPath string, cfg Config) {
-	entry := &BundleEntry{B3SUM: b3sum, HasMetadata: false}
-	baseName := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
-
-	ext := filepath.Ext(path)
-	if handler, ok := formatHandlers[ext]; ok {
-		handler(path, appPath, entry)
-	} else {
-		logMessage("WRN", fmt.Sprintf("Unsupported format: %s", ext))
-		return
-	}
-
-	if entry.Png != "" || entry.Svg != "" || entry.Desktop != "" {
-		entry.HasMetadata = true
-		logMessage("INF", fmt.Sprintf("Adding bundle to entries: %s", path))
-		entries[path] = entry
-	} else {
-		logMessage("WRN", fmt.Sprintf("Bundle does not contain any metadata files. Skipping: %s", path))
-		entries[path] = entry
-	}
-
-	createThumbnailForBundle(entry, path)
-	updateDesktopFileIfRequired(path, baseName, appPath, entry, cfg)
-}
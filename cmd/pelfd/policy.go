@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/xplshn/pelf/pkg/integration"
+	"github.com/xplshn/pelf/pkg/utils"
+)
+
+// errQuarantined is the reason why new bundles are held back when Policy.Quarantine is enabled
+var errQuarantined = errors.New("quarantined until approved with --approve")
+
+// Policy restricts which bundles pelfd integrates, and whether it runs them to do so.
+type Policy struct {
+	NeverExecute     bool     `json:"never_execute"`           // Flag to never run bundles, reading their metadata statically instead. AppBundles whose image isn't SquashFS can't be integrated then.
+	RequireSignature bool     `json:"require_signature"`       // Flag to only integrate bundles that come with a detached signature (<bundle>.sig) made by one of TrustedKeys. Embedded signatures, such as the .sha256_sig section of AppImages, aren't verified, so they don't count.
+	TrustedKeys      []string `json:"trusted_keys,omitempty"`  // Ed25519 public keys whose signatures are trusted, base64-encoded or as written by `openssl pkey -pubout`.
+	AllowedIDs       []string `json:"allowed_ids,omitempty"`   // Globs of the AppBundleIDs that may be integrated. When either this or AllowedRepos is set, bundles without an AppBundleID are refused.
+	AllowedRepos     []string `json:"allowed_repos,omitempty"` // Globs of the repos (the part after '#' of AppBundleIDs) whose bundles may be integrated.
+	Quarantine       bool     `json:"quarantine"`              // Flag to hold new bundles back until they're approved with --approve.
+}
+
+// check decides whether a new or changed bundle may be integrated. It only reads the bundle, from src, it never runs it
+func (p Policy) check(path, src string, previous *integration.Entry, approved bool) error {
+	// Bundles that were refused before have never been integrated, so they're still new
+	if p.Quarantine && !approved && (previous == nil || previous.Refused != "") {
+		return errQuarantined
+	}
+
+	if p.RequireSignature {
+		var keys []ed25519.PublicKey
+		for _, s := range p.TrustedKeys {
+			key, err := integration.ParsePublicKey(s)
+			if err != nil {
+				logMessage("WRN", fmt.Sprintf("Ignoring invalid trusted key %q: %v", s, err))
+				continue
+			}
+			keys = append(keys, key)
+		}
+		if len(keys) == 0 {
+			return fmt.Errorf("a signature is required, but there are no trusted keys")
+		}
+		if err := integration.VerifySignatureFrom(path, src, keys); err != nil {
+			return err
+		}
+	}
+
+	if len(p.AllowedIDs) > 0 || len(p.AllowedRepos) > 0 {
+		info, err := integration.ReadRuntimeInfo(src)
+		if err != nil || info.AppBundleID == "" {
+			return fmt.Errorf("only allowed AppBundleIDs may be integrated, and %s has none", filepath.Base(path))
+		}
+		if !p.allows(info.AppBundleID) {
+			return fmt.Errorf("%s is not an allowed AppBundleID", info.AppBundleID)
+		}
+	}
+	return nil
+}
+
+// allows reports whether an AppBundleID matches AllowedIDs, or whether its repo matches AllowedRepos. A missing one never does,
+// not even a glob of "*"
+func (p Policy) allows(appBundleID string) bool {
+	if appBundleID == "" {
+		return false
+	}
+	for _, glob := range p.AllowedIDs {
+		if matched, _ := filepath.Match(glob, appBundleID); matched {
+			return true
+		}
+	}
+	if id, _, err := utils.ParseAppBundleID(appBundleID); err == nil && id.Repo != "" {
+		for _, glob := range p.AllowedRepos {
+			if matched, _ := filepath.Match(glob, id.Repo); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
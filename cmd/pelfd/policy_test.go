@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xplshn/pelf/pkg/integration"
+)
+
+func TestPolicyAllows(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      Policy
+		appBundleID string
+		expected    bool
+	}{
+		{"Exact ID", Policy{AllowedIDs: []string{"app#github.com.user.app:1.0"}}, "app#github.com.user.app:1.0", true},
+		{"ID glob", Policy{AllowedIDs: []string{"app#github.com.user.*"}}, "app#github.com.user.app:2.0@20240131", true},
+		{"ID glob that doesn't match", Policy{AllowedIDs: []string{"app#github.com.user.*"}}, "app#github.com.other.app:1.0", false},
+		{"Repo glob", Policy{AllowedRepos: []string{"github.com.user.*"}}, "tool#github.com.user.tool:1.0", true},
+		{"Repo glob of a type I ID", Policy{AllowedRepos: []string{"xplshn"}}, "some-tool-13_04_2022-xplshn", true},
+		{"Repo glob that doesn't match", Policy{AllowedRepos: []string{"github.com.user.*"}}, "tool#gitlab.com.user.tool", false},
+		{"Repo glob matching the name only", Policy{AllowedRepos: []string{"tool"}}, "tool#github.com.user.tool", false},
+		{"Repo glob of an ID that doesn't parse", Policy{AllowedRepos: []string{"*"}}, "google-chrome-stable", false},
+		{"Either list", Policy{AllowedIDs: []string{"other#*"}, AllowedRepos: []string{"github.com.user.*"}}, "app#github.com.user.app", true},
+		{"No ID", Policy{AllowedIDs: []string{"*"}, AllowedRepos: []string{"*"}}, "", false},
+		{"Empty lists", Policy{}, "app#github.com.user.app", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.allows(tt.appBundleID); got != tt.expected {
+				t.Errorf("allows(%q) = %v, expected %v", tt.appBundleID, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	tmpDir := t.TempDir()
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedKey := base64.StdEncoding.EncodeToString(public)
+
+	bundle := filepath.Join(tmpDir, "app.AppImage")
+	if err := os.WriteFile(bundle, []byte("bundle"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	unsigned := filepath.Join(tmpDir, "unsigned.AppImage")
+	if err := os.WriteFile(unsigned, []byte("bundle"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	signature, err := integration.Sign(bundle, private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bundle+".sig", signature, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	integrated := &integration.Entry{B3SUM: "abc", HasMetadata: true}
+	refused := &integration.Entry{Refused: errQuarantined.Error()}
+	tests := []struct {
+		name     string
+		policy   Policy
+		path     string
+		previous *integration.Entry
+		approved bool
+		expected string // What the error holds, "" if the bundle must be allowed
+	}{
+		{"No restrictions", Policy{}, unsigned, nil, false, ""},
+		{"New bundle in quarantine", Policy{Quarantine: true}, bundle, nil, false, "quarantined"},
+		{"New bundle approved", Policy{Quarantine: true}, bundle, nil, true, ""},
+		{"Integrated bundle that changed", Policy{Quarantine: true}, bundle, integrated, false, ""},
+		{"Refused bundle not approved yet", Policy{Quarantine: true}, bundle, refused, false, "quarantined"},
+		{"Refused bundle approved", Policy{Quarantine: true}, bundle, refused, true, ""},
+		{"Signature required without trusted keys", Policy{RequireSignature: true}, bundle, nil, false, "no trusted keys"},
+		{"Signature required with invalid trusted keys only", Policy{RequireSignature: true, TrustedKeys: []string{"invalid"}}, bundle, nil, false, "no trusted keys"},
+		{"Signed bundle", Policy{RequireSignature: true, TrustedKeys: []string{"invalid", trustedKey}}, bundle, nil, false, ""},
+		{"Unsigned bundle", Policy{RequireSignature: true, TrustedKeys: []string{trustedKey}}, unsigned, nil, false, "signature"},
+		{"Approval doesn't waive the signature", Policy{Quarantine: true, RequireSignature: true, TrustedKeys: []string{trustedKey}}, unsigned, nil, true, "signature"},
+		{"Allowlist and a bundle without an ID", Policy{AllowedIDs: []string{"*"}}, bundle, nil, false, "has none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.check(tt.path, tt.path, tt.previous, tt.approved)
+			switch {
+			case tt.expected == "" && err != nil:
+				t.Errorf("Expected the bundle to be allowed, got %v", err)
+			case tt.expected != "" && (err == nil || !strings.Contains(err.Error(), tt.expected)):
+				t.Errorf("Expected the bundle to be refused with %q, got %v", tt.expected, err)
+			}
+		})
+	}
+
+	// The signature is checked against src, the file that is then extracted, rather than against what path holds meanwhile
+	signed := Policy{RequireSignature: true, TrustedKeys: []string{trustedKey}}
+	if err := signed.check(bundle, unsigned, nil, false); err != nil {
+		t.Errorf("Expected the signature of path to be checked against the content of src, got %v", err)
+	}
+	if err := os.WriteFile(unsigned, []byte("swapped"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := signed.check(bundle, unsigned, nil, false); !errors.Is(err, integration.ErrBadSignature) {
+		t.Errorf("Expected a src that doesn't match the signature of path to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/xplshn/pelf/pkg/integration"
+)
+
+// DirectoryOptions controls how one of DirectoriesToWalk is scanned. The zero value scans the top level of the directory only,
+// skipping symlinks, and recognizes bundles by their extension.
+type DirectoryOptions struct {
+	MaxDepth       int      `json:"max_depth"`         // How many levels of subdirectories to descend into. 0 scans the directory itself only, -1 has no limit.
+	FollowSymlinks bool     `json:"follow_symlinks"`   // Flag to integrate symlinked bundles, and to descend into symlinked directories.
+	Include        []string `json:"include,omitempty"` // Globs, if any, that files must match to be integrated. Matched against the name and the path relative to the directory.
+	Exclude        []string `json:"exclude,omitempty"` // Globs of files and subdirectories to skip. Matched like Include.
+	SniffContent   bool     `json:"sniff_content"`     // Flag to recognize bundles by their magic bytes rather than by their extension.
+}
+
+// directoryOptions returns the options of one of DirectoriesToWalk, which may be keyed as written in DirectoriesToWalk or expanded.
+func (o Options) directoryOptions(dir, homeDir string) DirectoryOptions {
+	if opts, ok := o.DirectoryOptions[dir]; ok {
+		return opts
+	}
+	return o.DirectoryOptions[expand(dir, homeDir)]
+}
+
+// scanDirectory walks through root as per opts, and returns the bundles it found along with the subdirectories it went through.
+func scanDirectory(root string, opts DirectoryOptions, integrateFormats []string) ([]string, []string) {
+	var bundles, dirs []string
+	visited := make(map[string]bool)
+
+	var walk func(dir string, depth int)
+	walk = func(dir string, depth int) {
+		// Symlinks may lead back to a directory that was already walked through
+		if realDir, err := filepath.EvalSymlinks(dir); err == nil {
+			if visited[realDir] {
+				return
+			}
+			visited[realDir] = true
+		}
+		if dir != root {
+			dirs = append(dirs, dir)
+		}
+
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			logMessage("ERR", fmt.Sprintf("Failed to read directory %s: %v", dir, err))
+			return
+		}
+		for _, entry := range files {
+			path := filepath.Join(dir, entry.Name())
+			rel, _ := filepath.Rel(root, path)
+			if matchesAny(opts.Exclude, entry.Name(), rel) {
+				continue
+			}
+
+			mode := entry.Type()
+			if mode&os.ModeSymlink != 0 {
+				if !opts.FollowSymlinks {
+					logMessage("INF", fmt.Sprintf("Skipping symlink in directory: %s", path))
+					continue
+				}
+				info, err := os.Stat(path)
+				if err != nil {
+					logMessage("WRN", fmt.Sprintf("Skipping dangling symlink: %s", path))
+					continue
+				}
+				mode = info.Mode().Type()
+			}
+
+			switch {
+			case mode.IsDir() && isAppDir(path, integrateFormats):
+				// AppDirs are bundles rather than directories to look for bundles in
+				if len(opts.Include) == 0 || matchesAny(opts.Include, entry.Name(), rel) {
+					bundles = append(bundles, path)
+				}
+			case mode.IsDir():
+				if opts.MaxDepth < 0 || depth < opts.MaxDepth {
+					walk(path, depth+1)
+				}
+			case mode.IsRegular():
+				if len(opts.Include) > 0 && !matchesAny(opts.Include, entry.Name(), rel) {
+					continue
+				}
+				if isSupportedFile(path, integrateFormats) || (opts.SniffContent && integration.SniffFormat(path) != "") {
+					bundles = append(bundles, path)
+				}
+			default:
+				logMessage("INF", fmt.Sprintf("Skipping non-regular file in directory: %s", entry.Name()))
+			}
+		}
+	}
+
+	walk(root, 0)
+	return bundles, dirs
+}
+
+// isAppDir reports whether a directory is an AppDir to be integrated
+func isAppDir(path string, integrateFormats []string) bool {
+	return strings.HasSuffix(path, ".AppDir") && isSupportedFile(path, integrateFormats)
+}
+
+func matchesAny(globs []string, name, rel string) bool {
+	for _, glob := range globs {
+		if ok, _ := filepath.Match(glob, name); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(glob, rel); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/goccy/go-json"
+	"github.com/xplshn/pelf/pkg/integration"
+	"github.com/xplshn/pelf/pkg/utils"
+)
+
+// trackerVersion is the version of the layout of the tracker database. Databases of older versions are upgraded by trackerMigrations
+const trackerVersion = 1
+
+// trackerDatabase is the layout of the tracker database, which is kept apart from the options, as pelfd rewrites it all the time
+type trackerDatabase struct {
+	Version int                           `json:"version"` // trackerVersion, at the time the database was written
+	Bundles map[string]*integration.Entry `json:"bundles"` // Integrated bundles, keyed by their path
+}
+
+// errNewerTracker is returned for a tracker database written by a newer version of pelfd, which must be left alone
+var errNewerTracker = errors.New("the tracker database was written by a newer version of pelfd")
+
+// trackerMigrations[v] upgrades a tracker database of version v to version v+1
+var trackerMigrations = []func(database map[string]json.RawMessage) (map[string]json.RawMessage, error){
+	// Version 0 is the tracker of pelfd.json, before it had its own database: a bare map of the bundles
+	func(database map[string]json.RawMessage) (map[string]json.RawMessage, error) {
+		bundles, err := json.Marshal(database)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]json.RawMessage{"version": json.RawMessage("1"), "bundles": bundles}, nil
+	},
+}
+
+// defaultTrackerPath returns the path of the tracker database, within the XDG state directory
+func defaultTrackerPath(homeDir string) string {
+	stateDir := os.Getenv("XDG_STATE_HOME")
+	if stateDir == "" {
+		stateDir = filepath.Join(homeDir, ".local/state")
+	}
+	return filepath.Join(stateDir, "pelfd", "tracker.json")
+}
+
+// readTracker reads the tracker database at path, upgrading it if it was written by an older version. A missing database is empty
+func readTracker(path string) (map[string]*integration.Entry, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return make(map[string]*integration.Entry), nil
+	} else if err != nil {
+		return nil, err
+	}
+	return decodeTracker(data)
+}
+
+func decodeTracker(data []byte) (map[string]*integration.Entry, error) {
+	var database map[string]json.RawMessage
+	if err := json.Unmarshal(data, &database); err != nil {
+		return nil, err
+	}
+
+	// Bundles are keyed by their absolute path, so a database of version 0 can't have a "version" key
+	version := 0
+	if raw, ok := database["version"]; ok {
+		if err := json.Unmarshal(raw, &version); err != nil {
+			return nil, fmt.Errorf("invalid version: %w", err)
+		}
+	}
+	if version > trackerVersion {
+		return nil, fmt.Errorf("%w: version %d is newer than the one supported by pelfd %s (%d)", errNewerTracker, version, Version, trackerVersion)
+	}
+	for ; version < trackerVersion; version++ {
+		var err error
+		if database, err = trackerMigrations[version](database); err != nil {
+			return nil, fmt.Errorf("failed to upgrade from version %d: %w", version, err)
+		}
+	}
+
+	var bundles map[string]*integration.Entry
+	if raw, ok := database["bundles"]; ok {
+		if err := json.Unmarshal(raw, &bundles); err != nil {
+			return nil, err
+		}
+	}
+	if bundles == nil {
+		bundles = make(map[string]*integration.Entry)
+	}
+	for path, entry := range bundles {
+		if entry == nil {
+			delete(bundles, path)
+		}
+	}
+	return bundles, nil
+}
+
+// writeTracker replaces the tracker database at path atomically, so that it is never left half-written
+func writeTracker(path string, tracker map[string]*integration.Entry) error {
+	data, err := json.MarshalIndent(trackerDatabase{Version: trackerVersion, Bundles: tracker}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xplshn/pelf/pkg/integration"
+)
+
+func TestDecodeTracker(t *testing.T) {
+	// Version 0: the bare map of the bundles that pelfd.json used to hold
+	tracker, err := decodeTracker([]byte(`{"/apps/app.AppImage": {"b3sum": "abc", "has_metadata": true}, "/apps/gone.AppImage": null}`))
+	if err != nil {
+		t.Fatalf("Failed to decode a legacy tracker: %v", err)
+	}
+	if entry := tracker["/apps/app.AppImage"]; len(tracker) != 1 || entry == nil || entry.B3SUM != "abc" || !entry.HasMetadata {
+		t.Errorf("Unexpected bundles of a legacy tracker: %+v", tracker)
+	}
+
+	tracker, err = decodeTracker([]byte(`{"version": 1, "bundles": {"/apps/app.AppBundle": {"b3sum": "def"}}}`))
+	if err != nil || tracker["/apps/app.AppBundle"] == nil || tracker["/apps/app.AppBundle"].B3SUM != "def" {
+		t.Errorf("Unexpected bundles of a tracker of version 1: %+v (err=%v)", tracker, err)
+	}
+
+	if _, err := decodeTracker([]byte(`{"version": 2, "bundles": {}}`)); !errors.Is(err, errNewerTracker) {
+		t.Errorf("Expected a tracker of version 2 to be refused, got %v", err)
+	}
+	if _, err := decodeTracker([]byte(`{"version": "1"}`)); err == nil {
+		t.Errorf("Expected an invalid version to be refused")
+	}
+}
+
+func TestWriteTracker(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pelfd", "tracker.json")
+	tracker := map[string]*integration.Entry{
+		"/apps/app.AppBundle": {B3SUM: "abc", Desktop: "/share/applications/app.desktop", MimeInfo: []string{"/share/mime/packages/app-0.xml"}},
+	}
+	if err := writeTracker(path, tracker); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readTracker(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := read["/apps/app.AppBundle"]
+	if len(read) != 1 || entry == nil || entry.B3SUM != "abc" || entry.Desktop != tracker["/apps/app.AppBundle"].Desktop || len(entry.MimeInfo) != 1 {
+		t.Errorf("The tracker did not round-trip, got %+v", read)
+	}
+
+	if read, err := readTracker(filepath.Join(t.TempDir(), "missing.json")); err != nil || len(read) != 0 {
+		t.Errorf("Expected a missing tracker to be empty, got %+v (err=%v)", read, err)
+	}
+}
+
+func TestLoadConfigTracker(t *testing.T) {
+	homeDir := t.TempDir()
+	configPath := filepath.Join(homeDir, "pelfd.json")
+	trackerPath := filepath.Join(homeDir, "state", "tracker.json")
+	os.MkdirAll(filepath.Dir(trackerPath), 0755)
+
+	// A corrupt tracker is kept aside, and rebuilt from scratch
+	if err := os.WriteFile(trackerPath, []byte(`{"version": 1, "bundles": {`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadConfig(configPath, trackerPath, homeDir)
+	if err != nil {
+		t.Fatalf("Expected a corrupt tracker to be recovered from, got %v", err)
+	}
+	if config.Tracker == nil || len(config.Tracker) != 0 {
+		t.Errorf("Expected an empty tracker, got %+v", config.Tracker)
+	}
+	if fileExists(trackerPath) || !fileExists(trackerPath+".corrupt") {
+		t.Errorf("Expected the corrupt tracker to be renamed to %s.corrupt", trackerPath)
+	}
+
+	// That of a newer pelfd is left alone
+	newer := []byte(`{"version": 2, "bundles": {}}`)
+	if err := os.WriteFile(trackerPath, newer, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(configPath, trackerPath, homeDir); !errors.Is(err, errNewerTracker) {
+		t.Errorf("Expected a tracker of a newer version to be refused, got %v", err)
+	}
+	if data, _ := os.ReadFile(trackerPath); string(data) != string(newer) {
+		t.Errorf("Expected a tracker of a newer version to be left alone, got %s", data)
+	}
+
+	// The tracker that pelfd.json used to hold is moved to its own database
+	os.Remove(trackerPath)
+	if err := os.WriteFile(configPath, []byte(`{"options": {}, "tracker": {"/apps/app.AppImage": {"b3sum": "abc"}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err = loadConfig(configPath, trackerPath, homeDir)
+	if err != nil || config.Tracker["/apps/app.AppImage"] == nil {
+		t.Fatalf("Expected the tracker of pelfd.json to be kept, got %+v (err=%v)", config.Tracker, err)
+	}
+	if read, err := readTracker(trackerPath); err != nil || read["/apps/app.AppImage"] == nil {
+		t.Errorf("Expected the tracker of pelfd.json to be written to %s, got %+v (err=%v)", trackerPath, read, err)
+	}
+}
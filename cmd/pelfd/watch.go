@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Changes that may make a bundle appear, disappear or change. IN_ATTRIB is there because bundles only get integrated once they're executable
+const watchMask = unix.IN_CREATE | unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM | unix.IN_DELETE |
+	unix.IN_ATTRIB | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF | unix.IN_ONLYDIR
+
+// Events tend to come in bursts (a file being copied, several bundles being moved at once), which are handled as one
+const watchSettleTime = 500 * time.Millisecond
+
+// Safety net for changes that inotify does not report, such as those made to network filesystems
+const watchRescanInterval = 10 * time.Minute
+
+// watcher reports changes within the directories to walk through inotify
+type watcher struct {
+	fd  int
+	wds map[int32]string // Watch descriptors, and the directory each one is watching
+}
+
+func newWatcher() (*watcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	return &watcher{fd: fd, wds: make(map[int32]string)}, nil
+}
+
+// watch adds the directories that aren't watched yet, and returns whether all of them are.
+// Directories that do not exist (yet) can't be watched, so the caller has to poll for them
+func (w *watcher) watch(dirs []string) bool {
+	all := true
+	for _, dir := range dirs {
+		if w.isWatched(dir) {
+			continue
+		}
+		if !isDirectory(dir) {
+			all = false
+			continue
+		}
+		wd, err := unix.InotifyAddWatch(w.fd, dir, watchMask)
+		if err != nil {
+			logMessage("WRN", fmt.Sprintf("Unable to watch %s: %v", dir, err))
+			all = false
+			continue
+		}
+		w.wds[int32(wd)] = dir
+		logMessage("INF", fmt.Sprintf("Watching %s", dir))
+	}
+	return all
+}
+
+func (w *watcher) isWatched(dir string) bool {
+	for _, watched := range w.wds {
+		if watched == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// wait blocks until something changed within the watched directories, or until timeout elapses
+func (w *watcher) wait(timeout time.Duration) error {
+	changed, err := w.poll(timeout)
+	if err != nil || !changed {
+		return err
+	}
+	// Let the burst settle
+	for changed {
+		if changed, err = w.poll(watchSettleTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// poll waits for events for up to timeout, and consumes them
+func (w *watcher) poll(timeout time.Duration) (bool, error) {
+	fds := []unix.PollFd{{Fd: int32(w.fd), Events: unix.POLLIN}}
+	n, err := unix.Poll(fds, int(timeout.Milliseconds()))
+	if err == unix.EINTR {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		return false, nil
+	}
+
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := unix.Read(w.fd, buf)
+		if err == unix.EAGAIN || n <= 0 {
+			return true, nil
+		} else if err != nil {
+			return true, err
+		}
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			// The directory was removed or moved away: forget about it, so that it is watched again if it comes back
+			if event.Mask&unix.IN_IGNORED != 0 {
+				delete(w.wds, event.Wd)
+			} else if event.Mask&(unix.IN_DELETE_SELF|unix.IN_MOVE_SELF) != 0 {
+				unix.InotifyRmWatch(w.fd, uint32(event.Wd))
+				delete(w.wds, event.Wd)
+			}
+			offset += unix.SizeofInotifyEvent + int(event.Len)
+		}
+	}
+}
+
+// run waits for changes within the directories it receives through dirs, and reports each of them through wake. The daemon
+// answers with the directories to watch next, once it has scanned them
+func (w *watcher) run(dirs <-chan []string, wake chan<- struct{}, probeInterval time.Duration) {
+	failed := false
+	for {
+		watched := <-dirs
+		if failed {
+			time.Sleep(probeInterval)
+		} else {
+			timeout := watchRescanInterval
+			if !w.watch(watched) {
+				timeout = probeInterval
+			}
+			if err := w.wait(timeout); err != nil {
+				logMessage("ERR", fmt.Sprintf("Failed to wait for inotify events, falling back to probing: %v", err))
+				failed = true
+			}
+		}
+		wake <- struct{}{}
+	}
+}
@@ -17,10 +17,12 @@ import (
 	"runtime"
 	"strings"
 
+	"github.com/goccy/go-json"
 	"github.com/klauspost/compress/zstd"
 	"github.com/pkg/xattr"
 	"github.com/shamaton/msgpack/v2"
 	"github.com/urfave/cli/v3"
+	"github.com/xplshn/pelf/pkg/appstream"
 	"github.com/xplshn/pelf/pkg/utils"
 	"github.com/zeebo/blake3"
 	"golang.org/x/sys/unix"
@@ -92,13 +94,16 @@ type BuildInfo struct {
 }
 
 type RuntimeInfo struct {
-	AppBundleID          string `json:"AppBundleID"`
-	PelfVersion          string `json:"PelfVersion"`
-	HostInfo             string `json:"HostInfo"`
-	FilesystemType       string `json:"FilesystemType"`
-	Hash                 string `json:"Hash"`
-	DisableRandomWorkDir bool   `json:"DisableRandomWorkDir"`
-	MountOrExtract       uint8  `json:"MountOrExtract"`
+	AppBundleID          string            `json:"AppBundleID"`
+	PelfVersion          string            `json:"PelfVersion"`
+	HostInfo             string            `json:"HostInfo"`
+	FilesystemType       string            `json:"FilesystemType"`
+	Hash                 string            `json:"Hash"`
+	DisableRandomWorkDir bool              `json:"DisableRandomWorkDir"`
+	MountOrExtract       uint8             `json:"MountOrExtract"`
+	PoolDir              string            `json:"PoolDir"`
+	Sandbox              string            `json:"Sandbox"`
+	Commands             map[string]string `json:"Commands"`
 }
 
 type elfSectionSpec struct {
@@ -119,11 +124,14 @@ type Config struct {
 	OutputFile            string
 	CompressionArgs       string
 	CustomEmbedDir        string
+	PoolDir               string
+	SandboxProfile        string
 	FilesystemType        string
 	ArchivePath           string
 	Runtime               string
 	BinDepDir             string
 	CustomSections        []string
+	Commands              []string
 	RuntimeInfo           RuntimeInfo
 	RunBehavior           uint8
 	elfSections           []elfSectionSpec
@@ -264,8 +272,8 @@ func getFilesystemTypeFromOutputFile(outputFile string) string {
 }
 
 func validateRunBehavior(_ context.Context, _ *cli.Command, value uint) error {
-	if value > 3 {
-		return fmt.Errorf("run-behavior must be one of 0, 1, 2, or 3")
+	if value > 4 {
+		return fmt.Errorf("run-behavior must be one of 0, 1, 2, 3 or 4")
 	}
 	return nil
 }
@@ -301,12 +309,70 @@ func checkAppDir(appDir string, appBundleID *utils.AppBundleID) error {
 			if fileCheck.name == ".xml file" && !utils.IsAppStreamID(appBundleID.Name) {
 				fmt.Fprintf(os.Stderr, "%s without an AppStream file and without an AppStreamID as the AppBundleID's name part, this AppBundle will not get metadata that's automatically populated by appstream-helper\n", strings.Repeat(" ", len("warning:")))
 			}
+		} else if fileCheck.name == ".xml file" {
+			checkAppStream(appDir, path, appBundleID)
 		}
 	}
 
 	return nil
 }
 
+// checkAppStream warns about the problems of the AppStream metainfo file of the AppDir, which appstream-helper and software
+// centers would trip on
+func checkAppStream(appDir, metainfo string, appBundleID *utils.AppBundleID) {
+	component, err := appstream.ParseFile(filepath.Join(appDir, metainfo))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%swarning%s: %s is not an AppStream metainfo file: %v\n", warningColor, resetColor, metainfo, err)
+		return
+	}
+
+	// The desktop-id launchables must refer to the .desktop file of the AppDir, if it has one
+	var desktopIDs []string
+	matches, _ := filepath.Glob(filepath.Join(appDir, "*.desktop"))
+	for _, match := range matches {
+		desktopIDs = append(desktopIDs, filepath.Base(match))
+	}
+	if err := component.Validate(desktopIDs); err != nil {
+		for _, problem := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintf(os.Stderr, "%swarning%s: %s: %s\n", warningColor, resetColor, metainfo, problem)
+		}
+	}
+	if utils.IsAppStreamID(appBundleID.Name) && component.ID != "" && component.ID != appBundleID.Name {
+		fmt.Fprintf(os.Stderr, "%swarning%s: the AppBundleID's name (%s) differs from the ID of %s (%s)\n", warningColor, resetColor, appBundleID.Name, metainfo, component.ID)
+	}
+}
+
+// resolveCommands turns the "name[=path]" specs of --add-command into the command table of the RuntimeInfo
+func resolveCommands(appDir string, specs []string) (map[string]string, error) {
+	commands := map[string]string{}
+	for _, spec := range specs {
+		name, path, hasPath := strings.Cut(spec, "=")
+		if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+			return nil, fmt.Errorf("invalid command name: %q", name)
+		}
+		if !hasPath {
+			for _, dir := range []string{"bin", "usr/bin"} {
+				if _, err := os.Stat(filepath.Join(appDir, dir, name)); err == nil {
+					path = filepath.Join(dir, name)
+					break
+				}
+			}
+			if path == "" {
+				return nil, fmt.Errorf("command %s was not found within bin/ or usr/bin/ of the AppDir", name)
+			}
+		}
+		path = filepath.Clean(strings.TrimPrefix(path, "/"))
+		if !filepath.IsLocal(path) {
+			return nil, fmt.Errorf("the path of command %s must be within the AppDir: %s", name, path)
+		}
+		if fi, err := os.Stat(filepath.Join(appDir, path)); err != nil || fi.IsDir() || fi.Mode()&0111 == 0 {
+			return nil, fmt.Errorf("the path of command %s is not an executable within the AppDir: %s", name, path)
+		}
+		commands[name] = path
+	}
+	return commands, nil
+}
+
 func main() {
 	app := &cli.Command{
 		Name:  "pelf",
@@ -323,9 +389,12 @@ func main() {
 			&cli.BoolFlag{Name: "prefer-tools-in-path", Usage: "Prefer tools in PATH over embedded binary dependencies"},
 			&cli.BoolFlag{Name: "list-static-tools", Usage: "List all binary dependencies with their B3SUMs"},
 			&cli.BoolFlag{Name: "disable-use-random-workdir", Aliases: []string{"d"}, Usage: "Disable the use of a random working directory"},
+			&cli.StringFlag{Name: "pool-dir", Usage: "Specify the default directory in which the AppBundle will create its work directories (env vars such as $XDG_RUNTIME_DIR are expanded at runtime)"},
+			&cli.StringSliceFlag{Name: "add-command", Usage: "Declare a command (e.g. --add-command ffmpeg=usr/bin/ffmpeg), which is run directly when the AppBundle is invoked through a symlink with that name. If the path is omitted, the command is looked up in bin/ and usr/bin/ of the AppDir"},
+			&cli.StringFlag{Name: "sandbox-profile", Usage: "Embed a JSON sandbox profile (see the runtime's documentation) in the runtime info"},
 			&cli.BoolFlag{Name: "appimage-compat", Aliases: []string{"A"}, Usage: "Use AI as magic bytes for AppImage compatibility"},
 			&cli.StringSliceFlag{Name: "add-runtime-info-section", Usage: "Add a custom section to runtime info in format '.sectionName:contentsOfSection'"},
-			&cli.UintFlag{Name: "run-behavior", Aliases: []string{"b"}, Usage: "Specify the run behavior of the output AppBundle (0[Only FUSE mounting], 1[Only Extract & Run], 2[Try FUSE, fallback to Extract & Run], 3[2, but only if the file is <= 350MB])", Value: 3, Action: validateRunBehavior},
+			&cli.UintFlag{Name: "run-behavior", Aliases: []string{"b"}, Usage: "Specify the run behavior of the output AppBundle (0[Only FUSE mounting], 1[Only Extract & Run], 2[Try FUSE, fallback to Extract & Run], 3[2, but only if the file is <= 350MB], 4[Try a kernel mount (squashfs, needs CAP_SYS_ADMIN), fallback to 2])", Value: 3, Action: validateRunBehavior},
 			&cli.StringSliceFlag{Name: "add-elf-section", Usage: "Add custom ELF sections from an .elfS file (e.g. --add-elf-section=./foo.elfS); section name is file name without .elfS extension, section contents are file contents"},
 			&cli.StringFlag{Name: "add-updinfo", Usage: "Add an ELF section named upd_info, with a string as its contents"},
 		},
@@ -336,12 +405,15 @@ func main() {
 				OutputFile:           c.String("output-to"),
 				CompressionArgs:      c.String("compression"),
 				CustomEmbedDir:       c.String("static-tools-dir"),
+				PoolDir:              c.String("pool-dir"),
+				SandboxProfile:       c.String("sandbox-profile"),
 				Runtime:              c.String("runtime"),
 				UseUPX:               c.Bool("upx"),
 				PreferToolsInPath:    c.Bool("prefer-tools-in-path"),
 				DisableRandomWorkDir: c.Bool("disable-use-random-workdir"),
 				AppImageCompat:       c.Bool("appimage-compat"),
 				CustomSections:       c.StringSlice("add-runtime-info-section"),
+				Commands:             c.StringSlice("add-command"),
 				RunBehavior:          uint8(c.Uint("run-behavior")),
 			}
 
@@ -766,8 +838,23 @@ func createSelfExtractingArchive(config *Config, workDir string) error {
 	}
 
 	config.RuntimeInfo.DisableRandomWorkDir = config.DisableRandomWorkDir
-
+	config.RuntimeInfo.PoolDir = config.PoolDir
+	if config.SandboxProfile != "" {
+		profile, err := os.ReadFile(config.SandboxProfile)
+		if err != nil {
+			return fmt.Errorf("failed to read sandbox profile: %w", err)
+		}
+		if !json.Valid(profile) {
+			return fmt.Errorf("sandbox profile %s is not valid JSON", config.SandboxProfile)
+		}
+		config.RuntimeInfo.Sandbox = string(profile)
+	}
 	var err error
+	config.RuntimeInfo.Commands, err = resolveCommands(config.AppDir, config.Commands)
+	if err != nil {
+		return err
+	}
+
 	config.RuntimeInfo.Hash, err = calculateB3Sum(config.ArchivePath)
 	if err != nil {
 		return fmt.Errorf("failed to calculate hash of filesystem image: %w", err)
@@ -0,0 +1,308 @@
+// Package appstream parses AppStream metainfo files, which describe a component (usually an application) to software
+// centers and repository indexes, and checks them for the mistakes that would keep them from being used. AppDirs ship theirs
+// at their top level, as the *.xml that the AppBundle runtime outputs with --pbundle_appstream.
+package appstream
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/xplshn/pelf/pkg/utils"
+)
+
+// Text is a translatable element, such as <name> or <summary>. Lang is empty for the untranslated one
+type Text struct {
+	Lang  string `xml:"lang,attr"`
+	Value string `xml:",chardata"`
+}
+
+// Markup is an element holding markup, such as <description>, kept as it is written
+type Markup struct {
+	Lang     string `xml:"lang,attr"`
+	InnerXML string `xml:",innerxml"`
+}
+
+// Component is the root of a metainfo file
+type Component struct {
+	XMLName         xml.Name        `xml:"component"`
+	Type            string          `xml:"type,attr"` // Such as "desktop-application" or "console-application"
+	ID              string          `xml:"id"`        // Reverse-DNS name of the component, such as org.gnome.gedit
+	MetadataLicense string          `xml:"metadata_license"`
+	ProjectLicense  string          `xml:"project_license"`
+	Names           []Text          `xml:"name"`
+	Summaries       []Text          `xml:"summary"`
+	Descriptions    []Markup        `xml:"description"`
+	DeveloperNames  []Text          `xml:"developer_name"` // Deprecated in favor of Developer
+	Developer       *Developer      `xml:"developer"`
+	Icons           []Icon          `xml:"icon"`
+	Categories      []string        `xml:"categories>category"`
+	Keywords        []Text          `xml:"keywords>keyword"`
+	URLs            []URL           `xml:"url"`
+	Launchables     []Launchable    `xml:"launchable"`
+	Provides        Provides        `xml:"provides"`
+	Releases        []Release       `xml:"releases>release"`
+	ContentRatings  []ContentRating `xml:"content_rating"`
+	Screenshots     []Screenshot    `xml:"screenshots>screenshot"`
+	Translations    []Translation   `xml:"translation"`
+	Branding        Branding        `xml:"branding"`
+}
+
+// Developer is the person or organization that develops the component
+type Developer struct {
+	ID    string `xml:"id,attr"`
+	Names []Text `xml:"name"`
+}
+
+// Icon is an icon of the component. Value is a stock icon name, a file name, a path or an URL, depending on Type
+type Icon struct {
+	Type   string `xml:"type,attr"` // "stock", "cached", "local" or "remote"
+	Width  int    `xml:"width,attr"`
+	Height int    `xml:"height,attr"`
+	Scale  int    `xml:"scale,attr"`
+	Value  string `xml:",chardata"`
+}
+
+// URL is a web link of the component
+type URL struct {
+	Type  string `xml:"type,attr"` // Such as "homepage", "bugtracker" or "vcs-browser"
+	Value string `xml:",chardata"`
+}
+
+// Launchable tells how the component is launched
+type Launchable struct {
+	Type  string `xml:"type,attr"` // "desktop-id", "service", "cockpit-manifest" or "url"
+	Value string `xml:",chardata"` // Such as "org.gnome.gedit.desktop", for a desktop-id
+}
+
+// Provides lists what the component provides to the system
+type Provides struct {
+	Binaries   []string `xml:"binary"`
+	Libraries  []string `xml:"library"`
+	MediaTypes []string `xml:"mediatype"`
+	Modaliases []string `xml:"modalias"`
+	Fonts      []string `xml:"font"`
+	Firmware   []string `xml:"firmware"`
+	Python3    []string `xml:"python3"`
+	IDs        []string `xml:"id"` // IDs of other components that this one replaces
+	DBus       []DBus   `xml:"dbus"`
+}
+
+// DBus is a D-Bus service that the component provides
+type DBus struct {
+	Type  string `xml:"type,attr"` // "user" or "system"
+	Value string `xml:",chardata"`
+}
+
+// Release is a release of the component, releases being listed newest first
+type Release struct {
+	Version      string   `xml:"version,attr"`
+	Date         string   `xml:"date,attr"`      // ISO 8601, such as 2024-01-31
+	Timestamp    string   `xml:"timestamp,attr"` // UNIX timestamp, which older files use instead of Date
+	Type         string   `xml:"type,attr"`      // "stable" (if empty), "snapshot" or "development"
+	Urgency      string   `xml:"urgency,attr"`   // "low", "medium", "high" or "critical"
+	Descriptions []Markup `xml:"description"`
+	URLs         []URL    `xml:"url"`
+}
+
+// ContentRating is an age rating of the component, as per the Open Age Ratings Service
+type ContentRating struct {
+	Type       string             `xml:"type,attr"` // Such as "oars-1.1"
+	Attributes []ContentAttribute `xml:"content_attribute"`
+}
+
+// ContentAttribute rates one kind of content, such as "violence-cartoon"
+type ContentAttribute struct {
+	ID    string `xml:"id,attr"`
+	Value string `xml:",chardata"` // "none", "mild", "moderate" or "intense"
+}
+
+// Screenshot is a screenshot of the component, or a video of it
+type Screenshot struct {
+	Type     string  `xml:"type,attr"` // "default" for the one to show first
+	Captions []Text  `xml:"caption"`
+	Images   []Image `xml:"image"`
+}
+
+// Image is a screenshot, at one size
+type Image struct {
+	Type   string `xml:"type,attr"` // "source" (if empty) for the original, or "thumbnail"
+	Width  int    `xml:"width,attr"`
+	Height int    `xml:"height,attr"`
+	Value  string `xml:",chardata"` // URL of the image
+}
+
+// Translation tells where the translations of the component are found, so that their completeness can be checked
+type Translation struct {
+	Type  string `xml:"type,attr"` // Such as "gettext" or "qt"
+	Value string `xml:",chardata"` // Translation domain
+}
+
+// Branding holds the colors that software centers may use to show the component
+type Branding struct {
+	Colors []Color `xml:"color"`
+}
+
+// Color is a brand color of the component
+type Color struct {
+	Type             string `xml:"type,attr"`              // "primary"
+	SchemePreference string `xml:"scheme_preference,attr"` // "light" or "dark", if it is only meant for one of them
+	Value            string `xml:",chardata"`              // Such as "#ff00ff"
+}
+
+// Parse parses the content of a metainfo file
+func Parse(data []byte) (*Component, error) {
+	var component Component
+	if err := xml.Unmarshal(data, &component); err != nil {
+		return nil, fmt.Errorf("invalid metainfo file: %w", err)
+	}
+	component.trim()
+	return &component, nil
+}
+
+// ParseFile parses the metainfo file at path
+func ParseFile(path string) (*Component, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// trim removes the whitespace that surrounds the text of the elements, as it is usually indented along with them
+func (c *Component) trim() {
+	trimTexts := func(texts []Text) {
+		for i := range texts {
+			texts[i].Value = strings.TrimSpace(texts[i].Value)
+		}
+	}
+	c.ID = strings.TrimSpace(c.ID)
+	c.MetadataLicense = strings.TrimSpace(c.MetadataLicense)
+	c.ProjectLicense = strings.TrimSpace(c.ProjectLicense)
+	trimTexts(c.Names)
+	trimTexts(c.Summaries)
+	trimTexts(c.DeveloperNames)
+	trimTexts(c.Keywords)
+	if c.Developer != nil {
+		trimTexts(c.Developer.Names)
+	}
+	for i := range c.Icons {
+		c.Icons[i].Value = strings.TrimSpace(c.Icons[i].Value)
+	}
+	for i := range c.Categories {
+		c.Categories[i] = strings.TrimSpace(c.Categories[i])
+	}
+	for i := range c.URLs {
+		c.URLs[i].Value = strings.TrimSpace(c.URLs[i].Value)
+	}
+	for i := range c.Launchables {
+		c.Launchables[i].Value = strings.TrimSpace(c.Launchables[i].Value)
+	}
+	for i := range c.ContentRatings {
+		for j := range c.ContentRatings[i].Attributes {
+			c.ContentRatings[i].Attributes[j].Value = strings.TrimSpace(c.ContentRatings[i].Attributes[j].Value)
+		}
+	}
+	for i := range c.Screenshots {
+		trimTexts(c.Screenshots[i].Captions)
+		for j := range c.Screenshots[i].Images {
+			c.Screenshots[i].Images[j].Value = strings.TrimSpace(c.Screenshots[i].Images[j].Value)
+		}
+	}
+	for i := range c.Translations {
+		c.Translations[i].Value = strings.TrimSpace(c.Translations[i].Value)
+	}
+	for i := range c.Branding.Colors {
+		c.Branding.Colors[i].Value = strings.TrimSpace(c.Branding.Colors[i].Value)
+	}
+}
+
+// Localized returns the value of the text that matches locale (such as "de_DE.UTF-8") best, falling back to the untranslated
+// one, and then to the first one
+func Localized(texts []Text, locale string) string {
+	for _, lang := range append(utils.LocaleFallbacks(locale), "") {
+		for _, text := range texts {
+			if text.Lang == lang {
+				return text.Value
+			}
+		}
+	}
+	if len(texts) > 0 {
+		return texts[0].Value
+	}
+	return ""
+}
+
+// Name returns the name of the component in locale
+func (c *Component) Name(locale string) string {
+	return Localized(c.Names, locale)
+}
+
+// Summary returns the summary of the component in locale
+func (c *Component) Summary(locale string) string {
+	return Localized(c.Summaries, locale)
+}
+
+// Description returns the markup of the description of the component in locale
+func (c *Component) Description(locale string) string {
+	texts := make([]Text, len(c.Descriptions))
+	for i, description := range c.Descriptions {
+		texts[i] = Text{Lang: description.Lang, Value: strings.TrimSpace(description.InnerXML)}
+	}
+	return Localized(texts, locale)
+}
+
+// DeveloperName returns the name of the developer of the component in locale
+func (c *Component) DeveloperName(locale string) string {
+	if c.Developer != nil && len(c.Developer.Names) > 0 {
+		return Localized(c.Developer.Names, locale)
+	}
+	return Localized(c.DeveloperNames, locale)
+}
+
+// KeywordsIn returns the keywords of the component in locale. Keywords are translated as a whole, so those of the language that
+// matches locale best are returned, falling back to the untranslated ones
+func (c *Component) KeywordsIn(locale string) []string {
+	for _, lang := range append(utils.LocaleFallbacks(locale), "") {
+		var keywords []string
+		for _, keyword := range c.Keywords {
+			if keyword.Lang == lang {
+				keywords = append(keywords, keyword.Value)
+			}
+		}
+		if len(keywords) > 0 {
+			return keywords
+		}
+	}
+	return nil
+}
+
+// URL returns the URL of the given type, such as "homepage", or "" if there is none
+func (c *Component) URL(urlType string) string {
+	for _, url := range c.URLs {
+		if url.Type == urlType {
+			return url.Value
+		}
+	}
+	return ""
+}
+
+// DesktopIDs returns the desktop IDs (the names of the .desktop files) that launch the component
+func (c *Component) DesktopIDs() []string {
+	var ids []string
+	for _, launchable := range c.Launchables {
+		if launchable.Type == "desktop-id" {
+			ids = append(ids, launchable.Value)
+		}
+	}
+	return ids
+}
+
+// Latest returns the latest release, which comes first, or nil if there are none
+func (c *Component) Latest() *Release {
+	if len(c.Releases) == 0 {
+		return nil
+	}
+	return &c.Releases[0]
+}
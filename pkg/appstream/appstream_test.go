@@ -0,0 +1,157 @@
+package appstream
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+const metainfo = `<?xml version="1.0" encoding="UTF-8"?>
+<component type="desktop-application">
+  <id>org.example.Editor</id>
+  <metadata_license>CC0-1.0</metadata_license>
+  <project_license>GPL-3.0-or-later</project_license>
+  <name>Editor</name>
+  <name xml:lang="de">Bearbeiter</name>
+  <name xml:lang="pt_BR">Editor de texto</name>
+  <summary>
+    Edits text
+  </summary>
+  <summary xml:lang="de">Bearbeitet Text</summary>
+  <description>
+    <p>Edits <em>plain</em> text.</p>
+  </description>
+  <developer id="org.example">
+    <name>Example</name>
+  </developer>
+  <icon type="stock">org.example.Editor</icon>
+  <icon type="remote" width="128" height="128">https://example.org/editor.png</icon>
+  <categories>
+    <category>Utility</category>
+    <category>TextEditor</category>
+  </categories>
+  <keywords>
+    <keyword>text</keyword>
+    <keyword>notes</keyword>
+    <keyword xml:lang="de">Text</keyword>
+  </keywords>
+  <url type="homepage">https://example.org</url>
+  <url type="bugtracker">https://example.org/issues</url>
+  <launchable type="desktop-id">org.example.Editor.desktop</launchable>
+  <provides>
+    <binary>editor</binary>
+    <mediatype>text/plain</mediatype>
+    <dbus type="user">org.example.Editor</dbus>
+  </provides>
+  <releases>
+    <release version="1.2.0" date="2024-03-01" urgency="high">
+      <description><p>Faster.</p></description>
+    </release>
+    <release version="1.1.0" timestamp="1700000000"/>
+  </releases>
+  <content_rating type="oars-1.1">
+    <content_attribute id="social-chat">mild</content_attribute>
+  </content_rating>
+  <screenshots>
+    <screenshot type="default">
+      <caption>The main window</caption>
+      <image type="source" width="1600" height="900">https://example.org/main.png</image>
+      <image type="thumbnail" width="320" height="180">https://example.org/main-small.png</image>
+    </screenshot>
+  </screenshots>
+  <translation type="gettext">editor</translation>
+  <branding>
+    <color type="primary" scheme_preference="light">#ff00ff</color>
+    <color type="primary" scheme_preference="dark">#993d3d</color>
+  </branding>
+</component>
+`
+
+func TestParse(t *testing.T) {
+	c, err := Parse([]byte(metainfo))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	if c.ID != "org.example.Editor" || c.Type != "desktop-application" || c.ProjectLicense != "GPL-3.0-or-later" {
+		t.Errorf("Unexpected component %q of type %q, licensed %q", c.ID, c.Type, c.ProjectLicense)
+	}
+	if c.Summary("") != "Edits text" {
+		t.Errorf("Expected the summary to be trimmed, got %q", c.Summary(""))
+	}
+	if c.Description("") != "<p>Edits <em>plain</em> text.</p>" {
+		t.Errorf("Unexpected description %q", c.Description(""))
+	}
+	if c.DeveloperName("") != "Example" {
+		t.Errorf("Unexpected developer %q", c.DeveloperName(""))
+	}
+	if len(c.Icons) != 2 || c.Icons[1].Type != "remote" || c.Icons[1].Width != 128 {
+		t.Errorf("Unexpected icons %+v", c.Icons)
+	}
+	if !reflect.DeepEqual(c.Categories, []string{"Utility", "TextEditor"}) {
+		t.Errorf("Unexpected categories %q", c.Categories)
+	}
+	if c.URL("bugtracker") != "https://example.org/issues" || c.URL("donation") != "" {
+		t.Errorf("Unexpected URLs %+v", c.URLs)
+	}
+	if !reflect.DeepEqual(c.DesktopIDs(), []string{"org.example.Editor.desktop"}) {
+		t.Errorf("Unexpected desktop IDs %q", c.DesktopIDs())
+	}
+	if !reflect.DeepEqual(c.Provides.Binaries, []string{"editor"}) || len(c.Provides.DBus) != 1 || c.Provides.DBus[0].Type != "user" {
+		t.Errorf("Unexpected provides %+v", c.Provides)
+	}
+	if latest := c.Latest(); latest == nil || latest.Version != "1.2.0" || latest.Urgency != "high" || len(latest.Descriptions) != 1 {
+		t.Errorf("Unexpected latest release %+v", latest)
+	}
+	if released, err := c.Releases[1].Time(); err != nil || !released.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("Unexpected time of release 1.1.0: %v (%v)", released, err)
+	}
+	if len(c.ContentRatings) != 1 || c.ContentRatings[0].Attributes[0] != (ContentAttribute{ID: "social-chat", Value: "mild"}) {
+		t.Errorf("Unexpected content ratings %+v", c.ContentRatings)
+	}
+	if len(c.Screenshots) != 1 || len(c.Screenshots[0].Images) != 2 || c.Screenshots[0].Captions[0].Value != "The main window" {
+		t.Errorf("Unexpected screenshots %+v", c.Screenshots)
+	}
+	if len(c.Translations) != 1 || c.Translations[0] != (Translation{Type: "gettext", Value: "editor"}) {
+		t.Errorf("Unexpected translations %+v", c.Translations)
+	}
+	if len(c.Branding.Colors) != 2 || c.Branding.Colors[1].SchemePreference != "dark" || c.Branding.Colors[1].Value != "#993d3d" {
+		t.Errorf("Unexpected branding %+v", c.Branding)
+	}
+
+	if _, err := Parse([]byte("<components><component/></components>")); err == nil {
+		t.Errorf("Expected a collection to be rejected, as it isn't a metainfo file")
+	}
+}
+
+func TestLocalized(t *testing.T) {
+	c, err := Parse([]byte(metainfo))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	names := map[string]string{
+		"":            "Editor",
+		"C":           "Editor",
+		"de_AT.UTF-8": "Bearbeiter",
+		"pt_BR":       "Editor de texto",
+		"pt_PT":       "Editor",
+		"fr":          "Editor",
+	}
+	for locale, name := range names {
+		if c.Name(locale) != name {
+			t.Errorf("Name(%q) = %q, expected %q", locale, c.Name(locale), name)
+		}
+	}
+	if keywords := c.KeywordsIn("de_DE"); !reflect.DeepEqual(keywords, []string{"Text"}) {
+		t.Errorf("Unexpected German keywords %q", keywords)
+	}
+	if keywords := c.KeywordsIn("fr"); !reflect.DeepEqual(keywords, []string{"text", "notes"}) {
+		t.Errorf("Unexpected fallback keywords %q", keywords)
+	}
+
+	// Without an untranslated text, the first one is used
+	if name := Localized([]Text{{Lang: "de", Value: "Bearbeiter"}}, "fr"); name != "Bearbeiter" {
+		t.Errorf("Expected the first text to be used, got %q", name)
+	}
+}
@@ -0,0 +1,163 @@
+package appstream
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// Reverse-DNS names, whose segments must not start with a digit, such as io.github.user.App
+	idRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*(\.[A-Za-z_][A-Za-z0-9_-]*)+$`)
+	// Versions are compared by software centers segment by segment, so they have to start with a digit, and hold no spaces
+	versionRegex = regexp.MustCompile(`^[0-9][0-9A-Za-z.+~_:-]*$`)
+	colorRegex   = regexp.MustCompile(`^#[0-9A-Fa-f]{6}$`)
+)
+
+// The values that the attributes and elements of a metainfo file may take
+var (
+	launchableTypes  = []string{"desktop-id", "service", "cockpit-manifest", "url"}
+	urlTypes         = []string{"homepage", "bugtracker", "faq", "help", "donation", "translate", "contact", "vcs-browser", "contribute"}
+	iconTypes        = []string{"stock", "cached", "local", "remote"}
+	releaseTypes     = []string{"", "stable", "snapshot", "development"}
+	urgencies        = []string{"", "low", "medium", "high", "critical"}
+	ratingTypes      = []string{"oars-1.0", "oars-1.1"}
+	ratingValues     = []string{"none", "mild", "moderate", "intense"}
+	translationTypes = []string{"gettext", "qt"}
+	schemes          = []string{"", "light", "dark"}
+)
+
+// Time returns when the release was made, from its date or, failing that, its timestamp
+func (r *Release) Time() (time.Time, error) {
+	if r.Date != "" {
+		for _, layout := range []string{"2006-01-02", time.RFC3339, "2006-01-02T15:04:05"} {
+			if t, err := time.Parse(layout, r.Date); err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("invalid date %q, expected YYYY-MM-DD", r.Date)
+	}
+	if r.Timestamp != "" {
+		seconds, err := strconv.ParseInt(r.Timestamp, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp %q", r.Timestamp)
+		}
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+	return time.Time{}, errors.New("missing date")
+}
+
+// Validate checks the component for the mistakes that keep software centers and repository indexes from using it.
+// desktopIDs are the names of the .desktop files shipped along with the component, which its desktop-id launchables must
+// refer to; the check is skipped if it is nil. It returns every problem found, joined, or nil if there are none.
+func (c *Component) Validate(desktopIDs []string) error {
+	var errs []error
+	problem := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	switch {
+	case c.ID == "":
+		problem("missing the component ID")
+	case !idRegex.MatchString(c.ID):
+		problem("the component ID %q is not a reverse-DNS name, such as io.github.user.App", c.ID)
+	}
+	if c.MetadataLicense == "" {
+		problem("missing the metadata license")
+	}
+	if c.Name("") == "" {
+		problem("missing the name")
+	}
+	if c.Summary("") == "" {
+		problem("missing the summary")
+	}
+
+	if (c.Type == "desktop-application" || c.Type == "desktop") && len(c.DesktopIDs()) == 0 {
+		problem("desktop applications need a launchable of type desktop-id")
+	}
+	for _, launchable := range c.Launchables {
+		switch {
+		case !slices.Contains(launchableTypes, launchable.Type):
+			problem("unknown launchable type %q", launchable.Type)
+		case launchable.Type != "desktop-id":
+		case !strings.HasSuffix(launchable.Value, ".desktop"):
+			problem("the desktop-id launchable %q does not end in .desktop", launchable.Value)
+		case desktopIDs != nil && !slices.Contains(desktopIDs, launchable.Value):
+			problem("the desktop-id launchable %q does not match any of the .desktop files (%s)", launchable.Value, strings.Join(desktopIDs, ", "))
+		}
+	}
+	for _, url := range c.URLs {
+		if !slices.Contains(urlTypes, url.Type) {
+			problem("unknown URL type %q", url.Type)
+		}
+		if !strings.HasPrefix(url.Value, "https://") && !strings.HasPrefix(url.Value, "http://") {
+			problem("the %s URL %q is not a web link", url.Type, url.Value)
+		}
+	}
+	for _, icon := range c.Icons {
+		if !slices.Contains(iconTypes, icon.Type) {
+			problem("unknown icon type %q", icon.Type)
+		}
+	}
+
+	var previous time.Time
+	seen := make(map[string]bool)
+	for i, release := range c.Releases {
+		switch {
+		case release.Version == "":
+			problem("release %d has no version", i+1)
+		case !versionRegex.MatchString(release.Version):
+			problem("invalid release version %q: versions must start with a digit, and hold no spaces", release.Version)
+		case seen[release.Version]:
+			problem("release %s is listed twice", release.Version)
+		}
+		seen[release.Version] = true
+		if !slices.Contains(releaseTypes, release.Type) {
+			problem("unknown type %q of release %s", release.Type, release.Version)
+		}
+		if !slices.Contains(urgencies, release.Urgency) {
+			problem("unknown urgency %q of release %s", release.Urgency, release.Version)
+		}
+		t, err := release.Time()
+		if err != nil {
+			problem("release %s: %v", release.Version, err)
+			continue
+		}
+		if !previous.IsZero() && t.After(previous) {
+			problem("release %s is newer than the one listed before it, releases must be listed newest first", release.Version)
+		}
+		previous = t
+	}
+
+	for _, rating := range c.ContentRatings {
+		if !slices.Contains(ratingTypes, rating.Type) {
+			problem("unknown content rating type %q", rating.Type)
+		}
+		for _, attribute := range rating.Attributes {
+			if !slices.Contains(ratingValues, attribute.Value) {
+				problem("invalid value %q of the content attribute %s", attribute.Value, attribute.ID)
+			}
+		}
+	}
+	for _, translation := range c.Translations {
+		if !slices.Contains(translationTypes, translation.Type) {
+			problem("unknown translation type %q", translation.Type)
+		}
+	}
+	for _, color := range c.Branding.Colors {
+		if color.Type != "primary" {
+			problem("unknown branding color type %q", color.Type)
+		}
+		if !slices.Contains(schemes, color.SchemePreference) {
+			problem("unknown scheme preference %q of a branding color", color.SchemePreference)
+		}
+		if !colorRegex.MatchString(color.Value) {
+			problem("invalid branding color %q, expected #RRGGBB", color.Value)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,64 @@
+package appstream
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	c, err := Parse([]byte(metainfo))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if err := c.Validate([]string{"org.example.Editor.desktop"}); err != nil {
+		t.Errorf("Expected the component to be valid, got: %v", err)
+	}
+	if err := c.Validate(nil); err != nil {
+		t.Errorf("Expected the component to be valid without checking its desktop IDs, got: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(c *Component)
+		errs   []string
+	}{
+		{"missing ID", func(c *Component) { c.ID = "" }, []string{"missing the component ID"}},
+		{"invalid ID", func(c *Component) { c.ID = "org.example.2048" }, []string{"not a reverse-DNS name"}},
+		{"single segment ID", func(c *Component) { c.ID = "editor" }, []string{"not a reverse-DNS name"}},
+		{"missing required elements", func(c *Component) { c.MetadataLicense, c.Names, c.Summaries = "", nil, nil }, []string{"metadata license", "missing the name", "missing the summary"}},
+		{"missing launchable", func(c *Component) { c.Launchables = nil }, []string{"launchable of type desktop-id"}},
+		{"mismatched launchable", func(c *Component) { c.Launchables[0].Value = "editor.desktop" }, []string{`"editor.desktop" does not match`}},
+		{"launchable without .desktop", func(c *Component) { c.Launchables[0].Value = "org.example.Editor" }, []string{"does not end in .desktop"}},
+		{"unknown launchable", func(c *Component) { c.Launchables = append(c.Launchables, Launchable{Type: "binary", Value: "editor"}) }, []string{`launchable type "binary"`}},
+		{"invalid URL", func(c *Component) { c.URLs[0] = URL{Type: "website", Value: "example.org"} }, []string{`URL type "website"`, "not a web link"}},
+		{"invalid icon", func(c *Component) { c.Icons[0].Type = "svg" }, []string{`icon type "svg"`}},
+		{"missing version", func(c *Component) { c.Releases[1].Version = "" }, []string{"release 2 has no version"}},
+		{"invalid versions", func(c *Component) { c.Releases[0].Version, c.Releases[1].Version = "v1.2", "1.1 beta" }, []string{`"v1.2"`, `"1.1 beta"`}},
+		{"duplicate version", func(c *Component) { c.Releases[1].Version = "1.2.0" }, []string{"listed twice"}},
+		{"invalid date", func(c *Component) { c.Releases[0].Date = "01/03/2024" }, []string{"invalid date"}},
+		{"missing date", func(c *Component) { c.Releases[1].Timestamp = "" }, []string{"missing date"}},
+		{"unordered releases", func(c *Component) { c.Releases[0], c.Releases[1] = c.Releases[1], c.Releases[0] }, []string{"newest first"}},
+		{"invalid release type", func(c *Component) { c.Releases[0].Type, c.Releases[0].Urgency = "beta", "urgent" }, []string{`type "beta"`, `urgency "urgent"`}},
+		{"invalid content rating", func(c *Component) {
+			c.ContentRatings[0].Type, c.ContentRatings[0].Attributes[0].Value = "oars-2.0", "some"
+		}, []string{`"oars-2.0"`, `"some"`}},
+		{"invalid translation", func(c *Component) { c.Translations[0].Type = "po" }, []string{`translation type "po"`}},
+		{"invalid branding", func(c *Component) {
+			c.Branding.Colors[0] = Color{Type: "accent", SchemePreference: "dim", Value: "red"}
+		}, []string{`"accent"`, `"dim"`, `"red"`}},
+	}
+	for _, tt := range tests {
+		c, _ := Parse([]byte(metainfo))
+		tt.modify(c)
+		err := c.Validate([]string{"org.example.Editor.desktop"})
+		if err == nil {
+			t.Errorf("%s: expected the component to be invalid", tt.name)
+			continue
+		}
+		for _, e := range tt.errs {
+			if !strings.Contains(err.Error(), e) {
+				t.Errorf("%s: expected the errors to mention %q, got: %v", tt.name, e, err)
+			}
+		}
+	}
+}
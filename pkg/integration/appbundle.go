@@ -0,0 +1,84 @@
+package integration
+
+import (
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/shamaton/msgpack/v2"
+)
+
+// RuntimeInfo is what the .pbundle_runtime_info section of an AppBundle tells about it
+type RuntimeInfo struct {
+	AppBundleID    string
+	PelfVersion    string
+	FilesystemType string // "squashfs" or "dwarfs"
+}
+
+// ReadRuntimeInfo reads the runtime info of an AppBundle, without running it
+func ReadRuntimeInfo(path string) (*RuntimeInfo, error) {
+	ef, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer ef.Close()
+	return readRuntimeInfo(path, ef)
+}
+
+func readRuntimeInfo(path string, ef *elf.File) (*RuntimeInfo, error) {
+	section := ef.Section(".pbundle_runtime_info")
+	if section == nil {
+		return nil, fmt.Errorf("%s is not an AppBundle: it has no .pbundle_runtime_info section", path)
+	}
+	data, err := section.Data()
+	if err != nil {
+		return nil, err
+	}
+	var runtimeInfo map[string]any
+	if err := msgpack.Unmarshal(data, &runtimeInfo); err != nil {
+		return nil, fmt.Errorf("failed to parse the .pbundle_runtime_info section of %s: %w", path, err)
+	}
+	info := &RuntimeInfo{}
+	info.AppBundleID, _ = runtimeInfo["AppBundleID"].(string)
+	info.PelfVersion, _ = runtimeInfo["PelfVersion"].(string)
+	info.FilesystemType, _ = runtimeInfo["FilesystemType"].(string)
+	return info, nil
+}
+
+// readAppBundle reads the metadata of an AppBundle straight out of its image, without running it. Only SquashFS images can be read
+func readAppBundle(path string) (*Metadata, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ef, err := elf.NewFile(f)
+	if err != nil {
+		return nil, err
+	}
+	info, err := readRuntimeInfo(path, ef)
+	if err != nil {
+		return nil, err
+	}
+	if info.FilesystemType != "squashfs" {
+		return nil, fmt.Errorf("the %s image of %s can't be read without running it", info.FilesystemType, path)
+	}
+	// The image follows the runtime, like that of AppImages
+	offset, err := elfSize(f, ef)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	sq, err := openSquashfs(io.NewSectionReader(f, offset, stat.Size()-offset))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	metadata := readAppDir(sq)
+	metadata.AppBundleID = info.AppBundleID
+	return metadata, nil
+}
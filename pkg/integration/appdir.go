@@ -0,0 +1,69 @@
+package integration
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// extractAppDir reads the metadata of an AppDir in place. The AppDir is run through its AppRun
+func extractAppDir(path string) (*Metadata, error) {
+	if info, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not an AppDir", path)
+	}
+	metadata := readAppDir(diskAppDir(path))
+	if absPath, err := filepath.Abs(path); err == nil {
+		metadata.Exec = filepath.Join(absPath, "AppRun")
+	}
+	return metadata, nil
+}
+
+// ReadAppDir reads the metadata of an AppDir in place, without running anything, such as the mounted image of an AppBundle
+func ReadAppDir(dir string) *Metadata {
+	return readAppDir(diskAppDir(dir))
+}
+
+// bundleFiles returns the files whose content tells whether a bundle changed: the bundle itself, or the AppRun and
+// metadata files of an AppDir
+func bundleFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	appDir := diskAppDir(path)
+	names := []string{"AppRun", ".DirIcon", ".DirIcon.svg"}
+	desktopFiles, _ := appDir.glob(".", "*.desktop")
+	packages, _ := appDir.glob("usr/share/mime/packages", "*.xml")
+	names = append(names, append(desktopFiles, packages...)...)
+	sort.Strings(names)
+
+	var files []string
+	for _, name := range names {
+		if file := filepath.Join(path, name); fileExists(file) {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// diskAppDir is an AppDir on disk
+type diskAppDir string
+
+func (d diskAppDir) readFile(name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(string(d), name))
+}
+
+func (d diskAppDir) glob(dir, pattern string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(string(d), dir, pattern))
+	for i, match := range matches {
+		matches[i], _ = filepath.Rel(string(d), match)
+	}
+	return matches, err
+}
@@ -0,0 +1,82 @@
+package integration
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// extractAppImage reads the metadata of a type-2 AppImage straight out of its SquashFS image, without running it
+func extractAppImage(path string) (*Metadata, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header := make([]byte, 11)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return nil, err
+	}
+	if string(header[8:11]) != "AI\x02" {
+		return nil, fmt.Errorf("%s is not a type-2 AppImage", path)
+	}
+	ef, err := elf.NewFile(f)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := elfSize(f, ef)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	sq, err := openSquashfs(io.NewSectionReader(f, offset, info.Size()-offset))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	metadata := readAppDir(sq)
+	// Both sections are zero-filled when unused
+	if section := ef.Section(".upd_info"); section != nil {
+		if data, err := section.Data(); err == nil {
+			metadata.UpdateInfo = string(bytes.TrimRight(data, "\x00"))
+		}
+	}
+	if section := ef.Section(".sha256_sig"); section != nil {
+		if data, err := section.Data(); err == nil {
+			if data = bytes.TrimRight(data, "\x00"); len(data) > 0 {
+				metadata.Signature = data
+			}
+		}
+	}
+	return metadata, nil
+}
+
+// elfSize returns the size of the ELF runtime of an AppImage, which ends with its section headers. The SquashFS image follows it
+func elfSize(f io.ReaderAt, ef *elf.File) (int64, error) {
+	var shoff, shentsize, shnum uint64
+	sr := io.NewSectionReader(f, 0, 64)
+	switch ef.Class {
+	case elf.ELFCLASS64:
+		var hdr elf.Header64
+		if err := binary.Read(sr, ef.ByteOrder, &hdr); err != nil {
+			return 0, err
+		}
+		shoff, shentsize, shnum = hdr.Shoff, uint64(hdr.Shentsize), uint64(hdr.Shnum)
+	case elf.ELFCLASS32:
+		var hdr elf.Header32
+		if err := binary.Read(sr, ef.ByteOrder, &hdr); err != nil {
+			return 0, err
+		}
+		shoff, shentsize, shnum = uint64(hdr.Shoff), uint64(hdr.Shentsize), uint64(hdr.Shnum)
+	default:
+		return 0, fmt.Errorf("unsupported ELF class: %v", ef.Class)
+	}
+	return int64(shoff + shentsize*shnum), nil
+}
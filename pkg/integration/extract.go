@@ -0,0 +1,174 @@
+package integration
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/base64"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/xplshn/pelf/pkg/integration/freedesktop"
+	"github.com/xplshn/pelf/pkg/utils"
+)
+
+// Metadata is what an Extractor retrieves from a bundle. Any of it may be missing
+type Metadata struct {
+	Desktop  []byte   // The .desktop file, as shipped by the bundle
+	PNG      []byte   // The .DirIcon, if it is a PNG image
+	SVG      []byte   // The .DirIcon.svg, or the .DirIcon if it is an SVG image
+	MimeInfo [][]byte // The shared-mime-info packages (usr/share/mime/packages/*.xml)
+
+	// The icons that an AppDir ships within the hicolor theme (usr/share/icons/hicolor) for the Icon= of its .desktop file, keyed
+	// by their path within the theme, such as "48x48/apps/app.png"
+	ThemeIcons map[string][]byte
+
+	Exec        string // What the .desktop file should run, if not the bundle itself, such as the AppRun of an AppDir
+	AppBundleID string // The AppBundleID of an AppBundle, recorded in its .desktop file
+	UpdateInfo  string // The update information of an AppImage (its .upd_info section), such as "gh-releases-zsync|owner|repo|latest|*.zsync"
+	Signature   []byte // The embedded signature of an AppImage (its .sha256_sig section), if it has one. It is not verified
+}
+
+// Extractor retrieves the metadata of the bundles of one format
+type Extractor interface {
+	Extract(path string) (*Metadata, error)
+}
+
+// ExtractorFunc lets an ordinary function be used as an Extractor
+type ExtractorFunc func(path string) (*Metadata, error)
+
+// Extract calls f(path)
+func (f ExtractorFunc) Extract(path string) (*Metadata, error) {
+	return f(path)
+}
+
+// DefaultExtractors returns the extractors of the formats that are supported out of the box, keyed by their extension
+func DefaultExtractors() map[string]Extractor {
+	return map[string]Extractor{
+		".AppBundle":   ExtractorFunc(extractAppBundle),
+		".AppImage":    ExtractorFunc(extractAppImage),
+		".NixAppImage": ExtractorFunc(extractAppImage),
+		".AppDir":      ExtractorFunc(extractAppDir),
+	}
+}
+
+// extractAppBundle asks the AppBundle for its metadata, which its runtime outputs base64-encoded
+func extractAppBundle(path string) (*Metadata, error) {
+	metadata := &Metadata{}
+	if info, err := ReadRuntimeInfo(path); err == nil {
+		metadata.AppBundleID = info.AppBundleID
+	}
+	metadata.PNG = runAppBundle(path, "--pbundle_pngIcon")
+	metadata.SVG = runAppBundle(path, "--pbundle_svgIcon")
+	metadata.Desktop = runAppBundle(path, "--pbundle_desktop")
+	// One package per line
+	for _, line := range strings.Fields(string(runAppBundle(path, "--pbundle_mimeInfo"))) {
+		if data, err := base64.StdEncoding.DecodeString(line); err == nil {
+			metadata.MimeInfo = append(metadata.MimeInfo, data)
+		}
+	}
+	return metadata, nil
+}
+
+// runAppBundle returns the output of the AppBundle when run with param, decoded unless param is --pbundle_mimeInfo, or nil if
+// it didn't return anything
+func runAppBundle(path, param string) []byte {
+	cmd := exec.Command(path, param)
+	// The runtime dispatches on argv[0], which must not be the /proc/self/fd/N under which an open bundle is run
+	if target, err := os.Readlink(path); err == nil {
+		cmd.Args[0] = target
+	}
+	output, err := cmd.Output()
+	if err != nil {
+		return nil
+	}
+	// The runtime may clear the line that it printed while mounting the AppBundle
+	output = bytes.ReplaceAll(output, []byte("\x1b[1F\x1b[2K"), nil)
+	if param == "--pbundle_mimeInfo" {
+		return output
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(output)))
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	return data
+}
+
+// appDirReader gives access to the files of an AppDir, be it on disk or within the SquashFS image of an AppImage
+type appDirReader interface {
+	readFile(name string) ([]byte, error)
+	glob(dir, pattern string) ([]string, error)
+}
+
+// readAppDir reads the metadata of an AppDir: its .DirIcon (and .DirIcon.svg), its .desktop file, the icons it ships for it within
+// the hicolor theme and its shared-mime-info packages
+func readAppDir(appDir appDirReader) *Metadata {
+	metadata := &Metadata{}
+	// .DirIcon is usually a symlink to the icon of the application
+	if data, err := appDir.readFile(".DirIcon"); err == nil {
+		if bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+			metadata.PNG = data
+		} else if bytes.Contains(data, []byte("<svg")) {
+			metadata.SVG = data
+		}
+	}
+	if data, err := appDir.readFile(".DirIcon.svg"); err == nil {
+		metadata.SVG = data
+	}
+	if matches, _ := appDir.glob(".", "*.desktop"); len(matches) > 0 {
+		if data, err := appDir.readFile(matches[0]); err == nil {
+			metadata.Desktop = data
+		}
+	}
+	// Icon= may be a path, but then it would not be within the theme anyway
+	if icon := utils.ParseDesktop(metadata.Desktop).Value(utils.DesktopEntry, "Icon"); icon != "" && !strings.ContainsRune(icon, '/') {
+		for _, size := range append([]int{0}, freedesktop.HicolorSizes...) {
+			ext := ".png"
+			if size == 0 {
+				ext = ".svg"
+			}
+			name := path.Join(freedesktop.HicolorDir(size), icon+ext)
+			if data, err := appDir.readFile(path.Join("usr/share/icons/hicolor", name)); err == nil {
+				if metadata.ThemeIcons == nil {
+					metadata.ThemeIcons = make(map[string][]byte)
+				}
+				metadata.ThemeIcons[name] = data
+			}
+		}
+	}
+	packages, _ := appDir.glob("usr/share/mime/packages", "*.xml")
+	for _, file := range packages {
+		if data, err := appDir.readFile(file); err == nil {
+			metadata.MimeInfo = append(metadata.MimeInfo, data)
+		}
+	}
+	return metadata
+}
+
+// SniffFormat recognizes bundles by their magic bytes, which follow the ELF magic: "AB\x02" for AppBundles,
+// "AI\x02" for type-2 AppImages, and AppBundles made with --appimage-compat, which are told apart by their .pbundle_runtime_info section.
+// It returns the extension of the format, as used by DefaultExtractors, or "" if the file isn't a bundle.
+func SniffFormat(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	header := make([]byte, 11)
+	if _, err := io.ReadFull(f, header); err != nil || !bytes.Equal(header[:4], []byte(elf.ELFMAG)) {
+		return ""
+	}
+	switch string(header[8:11]) {
+	case "AB\x02":
+		return ".AppBundle"
+	case "AI\x02":
+		if ef, err := elf.NewFile(f); err == nil && ef.Section(".pbundle_runtime_info") != nil {
+			return ".AppBundle"
+		}
+		return ".AppImage"
+	}
+	return ""
+}
@@ -0,0 +1,135 @@
+// Package freedesktop implements the parts of the freedesktop.org specifications that integrating a bundle involves: rewriting
+// its .desktop file, putting it in a submenu, and making its thumbnails as per the Thumbnail Managing Standard. It is kept apart
+// from package integration, which rasterizes SVG icons, so that the AppBundle runtime can use it without growing much.
+package freedesktop
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/xplshn/pelf/pkg/utils"
+)
+
+// MenuCategory is the category of the applications put in the submenu written by WriteSubmenu
+const MenuCategory = "X-AppBundle"
+
+// Keys that RewriteDesktopFile adds to the [Desktop Entry] group, replacing those of a previous rewrite
+const (
+	KeyAppBundleID = "X-AppBundle-ID"         // AppBundleID of the bundle
+	KeyAppBundle   = "X-AppBundle-Path"       // Path of the bundle
+	KeyCategories  = "X-AppBundle-Categories" // Categories of the application, when they were replaced by MenuCategory
+)
+
+// DesktopRewrite describes how RewriteDesktopFile changes a .desktop file
+type DesktopRewrite struct {
+	Exec        string // What the Exec= lines of every group (actions included) run, instead of their program. Their arguments, field codes included, are kept. TryExec= is set to it.
+	Icon        string // Replaces the Icon= lines, if not empty
+	AppBundleID string // Recorded as X-AppBundle-ID, if not empty
+	Path        string // Recorded as X-AppBundle-Path, if not empty
+	Submenu     bool   // Flag to replace the Categories= of the application by MenuCategory, so that it only shows up within the submenu
+	LinkArg     string // If not empty, the Exec= lines that run another program than that of the [Desktop Entry] group run it through Exec, as "<Exec> <LinkArg> <program>", such as with the --pbundle_link of AppBundles
+}
+
+// RewriteDesktopFile applies the rewrite to the content of a .desktop file. Comments, blank lines and the keys that aren't
+// rewritten are kept as they are
+func RewriteDesktopFile(content string, rewrite DesktopRewrite) string {
+	df := utils.ParseDesktop([]byte(content))
+	mainProgram := ""
+	if args, err := utils.ParseExec(df.Value(utils.DesktopEntry, "Exec")); err == nil {
+		_, program, _ := splitEnv(args)
+		mainProgram = filepath.Base(program)
+	}
+
+	for _, group := range df.Groups() {
+		keys := df.Sections[group]
+		if _, ok := keys["Exec"]; ok {
+			df.SetString(group, "Exec", rewriteExec(df.Value(group, "Exec"), rewrite, group == utils.DesktopEntry, mainProgram))
+		}
+		if _, ok := keys["TryExec"]; ok {
+			df.SetString(group, "TryExec", rewrite.Exec)
+		}
+		if _, ok := keys["Icon"]; ok && rewrite.Icon != "" {
+			df.SetString(group, "Icon", rewrite.Icon)
+		}
+	}
+	if !slices.Contains(df.Groups(), utils.DesktopEntry) {
+		return string(df.Bytes())
+	}
+
+	// The keys of a previous rewrite are added again below
+	categories, inSubmenu := df.GetValue(utils.DesktopEntry, KeyCategories), false
+	df.Delete(utils.DesktopEntry, KeyAppBundleID)
+	df.Delete(utils.DesktopEntry, KeyAppBundle)
+	df.Delete(utils.DesktopEntry, KeyCategories)
+	if value := df.GetValue(utils.DesktopEntry, "Categories"); rewrite.Submenu || value == MenuCategory+";" {
+		// The categories are put back below, unless a previous rewrite put the application within the submenu
+		if value != MenuCategory+";" {
+			categories = value
+		}
+		inSubmenu = true
+		df.Delete(utils.DesktopEntry, "Categories")
+	}
+
+	if rewrite.AppBundleID != "" {
+		df.SetString(utils.DesktopEntry, KeyAppBundleID, rewrite.AppBundleID)
+	}
+	if rewrite.Path != "" {
+		df.SetString(utils.DesktopEntry, KeyAppBundle, rewrite.Path)
+	}
+	if rewrite.Submenu {
+		df.SetValue(utils.DesktopEntry, "Categories", MenuCategory+";")
+		if categories != "" {
+			df.SetValue(utils.DesktopEntry, KeyCategories, categories)
+		}
+	} else if inSubmenu && categories != "" {
+		df.SetValue(utils.DesktopEntry, "Categories", categories)
+	}
+	return string(df.Bytes())
+}
+
+// rewriteExec rewrites the (unescaped) value of an Exec key: its program is replaced by rewrite.Exec, keeping its arguments
+// and the `env VAR=value...` that precedes it, if any. Within an action, a program other than mainProgram is run through
+// rewrite.LinkArg instead. A value that can't be parsed is replaced by rewrite.Exec alone
+func rewriteExec(value string, rewrite DesktopRewrite, isMain bool, mainProgram string) string {
+	args, err := utils.ParseExec(value)
+	if err != nil {
+		return execQuote(rewrite.Exec)
+	}
+	prefix, program, rest := splitEnv(args)
+	command := append(prefix, rewrite.Exec)
+	if rewrite.LinkArg != "" && !isMain && mainProgram != "" && filepath.Base(program) != mainProgram {
+		command = append(command, rewrite.LinkArg, program)
+	}
+	command = append(command, rest...)
+
+	quoted := make([]string, len(command))
+	for i, arg := range command {
+		quoted[i] = execQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// splitEnv separates the program of the arguments returned by ParseExec from its own arguments, and from the
+// `env VAR=value...` that precedes it, if any
+func splitEnv(args []string) ([]string, string, []string) {
+	i := 0
+	if filepath.Base(args[0]) == "env" {
+		for i = 1; i < len(args) && strings.Contains(args[i], "="); i++ {
+		}
+	}
+	if i == len(args) {
+		return args, "", nil
+	}
+	return args[:i:i], args[i], args[i+1:]
+}
+
+// execQuote quotes an argument of an Exec key as per the Desktop Entry Specification, if it contains any reserved character.
+// The result still has to be escaped as a string value, which SetString does
+func execQuote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\n\"'\\><~|&;$*?#()`") {
+		return arg
+	}
+	r := strings.NewReplacer(`"`, `\"`, "`", "\\`", `$`, `\$`, `\`, `\\`)
+	return `"` + r.Replace(arg) + `"`
+}
@@ -0,0 +1,79 @@
+package freedesktop
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRewriteDesktopFile(t *testing.T) {
+	content := "[Desktop Entry]\nName=App\nExec=app %F\nTryExec=app\nIcon=app\n\n[Desktop Action new]\nExec=\"/usr/bin/app\" --new %U\n"
+	expected := "[Desktop Entry]\nName=App\nExec=\"/home/user/My Apps/app.AppBundle\" %F\nTryExec=/home/user/My Apps/app.AppBundle\nIcon=/icons/app.png\n\n[Desktop Action new]\nExec=\"/home/user/My Apps/app.AppBundle\" --new %U\n"
+	if got := RewriteDesktopFile(content, DesktopRewrite{Exec: "/home/user/My Apps/app.AppBundle", Icon: "/icons/app.png"}); got != expected {
+		t.Errorf("Unexpected .desktop file:\n%s\nexpected:\n%s", got, expected)
+	}
+}
+
+func TestRewriteDesktopFileKeys(t *testing.T) {
+	content := "# Comment\n[Desktop Entry]\nName=App\nExec = env GDK_BACKEND=x11 LANG=C app -q %u\nCategories=Graphics;Viewer;\n\n" +
+		"[Desktop Action edit]\nName=Edit\nExec=app-editor %f\nIcon=edit\n"
+	rewrite := DesktopRewrite{Exec: "/apps/app.AppBundle", AppBundleID: "app#github.com/owner/repo", Path: "/apps/app.AppBundle", Submenu: true}
+	expected := "# Comment\n[Desktop Entry]\nName=App\nExec=env GDK_BACKEND=x11 LANG=C /apps/app.AppBundle -q %u\n" +
+		"X-AppBundle-ID=app#github.com/owner/repo\nX-AppBundle-Path=/apps/app.AppBundle\nCategories=X-AppBundle;\nX-AppBundle-Categories=Graphics;Viewer;\n\n" +
+		"[Desktop Action edit]\nName=Edit\nExec=/apps/app.AppBundle %f\nIcon=edit\n"
+	got := RewriteDesktopFile(content, rewrite)
+	if got != expected {
+		t.Fatalf("Unexpected .desktop file:\n%s\nexpected:\n%s", got, expected)
+	}
+
+	// Rewriting again changes nothing, and leaving the submenu puts the categories back
+	if again := RewriteDesktopFile(got, rewrite); again != expected {
+		t.Errorf("Expected the rewrite to be idempotent, got:\n%s", again)
+	}
+	rewrite.Submenu = false
+	if left := RewriteDesktopFile(got, rewrite); !strings.Contains(left, "\nCategories=Graphics;Viewer;\n") || strings.Contains(left, "Categories="+MenuCategory) {
+		t.Errorf("Expected the categories to be put back, got:\n%s", left)
+	}
+}
+
+func TestWriteSubmenu(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "menu-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	menuDir, directoryDir := filepath.Join(tmpDir, "menus"), filepath.Join(tmpDir, "desktop-directories")
+
+	if written, err := WriteSubmenu(menuDir, directoryDir, "Apps & Bundles"); err != nil || !written {
+		t.Fatalf("Expected the submenu to be written, got written=%v err=%v", written, err)
+	}
+	menu, _ := os.ReadFile(filepath.Join(menuDir, menuFile))
+	if !strings.Contains(string(menu), "<Name>Apps &amp; Bundles</Name>") || !strings.Contains(string(menu), "<Category>"+MenuCategory+"</Category>") {
+		t.Errorf("Unexpected .menu file:\n%s", menu)
+	}
+	if written, err := WriteSubmenu(menuDir, directoryDir, "Apps & Bundles"); err != nil || written {
+		t.Errorf("Expected an up to date submenu to be left alone, got written=%v err=%v", written, err)
+	}
+	if !RemoveSubmenu(menuDir, directoryDir) || RemoveSubmenu(menuDir, directoryDir) {
+		t.Errorf("Expected the submenu to be removed once")
+	}
+}
+
+func TestRewriteDesktopFileLink(t *testing.T) {
+	content := "[Desktop Entry]\nExec=app %U\n\n[Desktop Action window]\nExec=/usr/bin/app --new-window\n\n[Desktop Action edit]\nExec=env LANG=C app-editor %f\n"
+	expected := "[Desktop Entry]\nExec=/apps/app.AppBundle %U\n\n[Desktop Action window]\nExec=/apps/app.AppBundle --new-window\n\n" +
+		"[Desktop Action edit]\nExec=env LANG=C /apps/app.AppBundle --pbundle_link app-editor %f\n"
+	if got := RewriteDesktopFile(content, DesktopRewrite{Exec: "/apps/app.AppBundle", LinkArg: "--pbundle_link"}); got != expected {
+		t.Errorf("Unexpected .desktop file:\n%s\nexpected:\n%s", got, expected)
+	}
+}
+
+func TestRewriteDesktopFileEscapes(t *testing.T) {
+	// The quote within the program is escaped once for Exec=, and once more as a string value
+	content := "[Desktop Entry]\nExec=\"/opt/a\\\\\"b/app\" --title \"My App\" %U\n\n[Desktop Action edit]\nExec=\"/opt/a\\\\\"b/editor\" %f\n"
+	expected := "[Desktop Entry]\nExec=/apps/app.AppBundle --title \"My App\" %U\n\n[Desktop Action edit]\nExec=/apps/app.AppBundle --pbundle_link \"/opt/a\\\\\"b/editor\" %f\n"
+	if got := RewriteDesktopFile(content, DesktopRewrite{Exec: "/apps/app.AppBundle", LinkArg: "--pbundle_link"}); got != expected {
+		t.Errorf("Unexpected .desktop file:\n%s\nexpected:\n%s", got, expected)
+	}
+}
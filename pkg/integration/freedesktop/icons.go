@@ -0,0 +1,26 @@
+package freedesktop
+
+import "fmt"
+
+// HicolorSizes are the sizes of the directories of the hicolor icon theme, icons of any other size are ignored by the desktop
+var HicolorSizes = []int{16, 22, 24, 32, 48, 64, 96, 128, 256, 512}
+
+// HicolorSize returns the size of the theme that an icon of w*h pixels belongs to: the biggest one that does not need upscaling
+func HicolorSize(w, h int) int {
+	size := HicolorSizes[0]
+	for _, s := range HicolorSizes {
+		if s <= max(w, h) {
+			size = s
+		}
+	}
+	return size
+}
+
+// HicolorDir returns the directory of the hicolor theme that holds the application icons of the given size, 0 being that of
+// the scalable (SVG) ones
+func HicolorDir(size int) string {
+	if size == 0 {
+		return "scalable/apps"
+	}
+	return fmt.Sprintf("%dx%d/apps", size, size)
+}
@@ -0,0 +1,66 @@
+package freedesktop
+
+import (
+	"fmt"
+	"html"
+	"os"
+	"path/filepath"
+
+	"github.com/xplshn/pelf/pkg/utils"
+)
+
+// Names of the files that WriteSubmenu writes
+const (
+	menuFile      = "appbundles.menu"
+	directoryFile = "appbundles.directory"
+)
+
+// WriteSubmenu adds a submenu to the Applications menu, as per the Desktop Menu Specification: a .menu file merged into the
+// Applications menu, within menuDir (usually $XDG_CONFIG_HOME/menus/applications-merged), and the .directory file that names
+// the submenu, within directoryDir (usually $XDG_DATA_HOME/desktop-directories). The submenu gathers the applications of the
+// MenuCategory. It returns whether anything was written, as the files are left alone if they're up to date
+func WriteSubmenu(menuDir, directoryDir, name string) (bool, error) {
+	menu := fmt.Sprintf(`<!DOCTYPE Menu PUBLIC "-//freedesktop//DTD Menu 1.0//EN"
+ "http://www.freedesktop.org/standards/menu-spec/1.0/menu.dtd">
+<Menu>
+  <Name>Applications</Name>
+  <Menu>
+    <Name>%s</Name>
+    <Directory>%s</Directory>
+    <Include>
+      <Category>%s</Category>
+    </Include>
+  </Menu>
+</Menu>
+`, html.EscapeString(name), directoryFile, MenuCategory)
+	directory := fmt.Sprintf("[Desktop Entry]\nType=Directory\nName=%s\nIcon=application-x-executable\n", name)
+
+	written := false
+	for _, file := range []struct{ path, content string }{
+		{filepath.Join(menuDir, menuFile), menu},
+		{filepath.Join(directoryDir, directoryFile), directory},
+	} {
+		if current, err := os.ReadFile(file.path); err == nil && string(current) == file.content {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(file.path), 0755); err != nil {
+			return written, err
+		}
+		if err := utils.WriteFileAtomic(file.path, []byte(file.content), 0644); err != nil {
+			return written, err
+		}
+		written = true
+	}
+	return written, nil
+}
+
+// RemoveSubmenu removes what WriteSubmenu wrote, if anything. It returns whether anything was removed
+func RemoveSubmenu(menuDir, directoryDir string) bool {
+	removed := false
+	for _, path := range []string{filepath.Join(menuDir, menuFile), filepath.Join(directoryDir, directoryFile)} {
+		if os.Remove(path) == nil {
+			removed = true
+		}
+	}
+	return removed
+}
@@ -0,0 +1,129 @@
+package freedesktop
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/xplshn/pelf/pkg/utils"
+	"golang.org/x/image/draw"
+)
+
+// ThumbnailSizes are the sizes of the "normal" and "large" thumbnails, as per the freedesktop Thumbnail Managing Standard
+var ThumbnailSizes = map[string]int{"normal": 128, "large": 256}
+
+// ThumbnailPath returns where the thumbnail of the given kind ("normal" or "large") of a file goes within thumbnailDir,
+// which is usually $XDG_CACHE_HOME/thumbnails
+func ThumbnailPath(thumbnailDir, kind, path string) (string, error) {
+	if _, ok := ThumbnailSizes[kind]; !ok {
+		return "", fmt.Errorf("invalid thumbnail type: %s", kind)
+	}
+	uri, err := canonicalURI(path)
+	if err != nil {
+		return "", err
+	}
+	sum := md5.Sum([]byte(uri))
+	return filepath.Join(thumbnailDir, kind, hex.EncodeToString(sum[:])+".png"), nil
+}
+
+// WriteThumbnails creates the "normal" and "large" thumbnails of a file from img, within thumbnailDir. The thumbnails carry the
+// Thumb::URI and Thumb::MTime of the file, which file managers check to tell whether they're stale, and software, if not empty.
+// It returns the paths of the thumbnails, normal first
+func WriteThumbnails(path string, img image.Image, thumbnailDir, software string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	uri, err := canonicalURI(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't generate canonical URI: %w", err)
+	}
+	text := [][2]string{
+		{"Thumb::URI", uri},
+		{"Thumb::MTime", strconv.FormatInt(info.ModTime().Unix(), 10)},
+		{"Thumb::Size", strconv.FormatInt(info.Size(), 10)},
+	}
+	if software != "" {
+		text = append(text, [2]string{"Software", software})
+	}
+
+	var thumbnails []string
+	for _, kind := range []string{"normal", "large"} {
+		size := ThumbnailSizes[kind]
+		// Thumbnails are never bigger than the image they're made from
+		if b := img.Bounds(); b.Dx() < size && b.Dy() < size {
+			size = max(b.Dx(), b.Dy())
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, ScaleToFit(img, size)); err != nil {
+			return thumbnails, err
+		}
+
+		thumbnailPath, err := ThumbnailPath(thumbnailDir, kind, path)
+		if err != nil {
+			return thumbnails, err
+		}
+		// The thumbnails must only be accessible by the user
+		if err := os.MkdirAll(filepath.Dir(thumbnailPath), 0700); err != nil {
+			return thumbnails, err
+		}
+		// Replaced atomically, so that file managers never read a partial thumbnail
+		if err := utils.WriteFileAtomic(thumbnailPath, PNGWithText(buf.Bytes(), text), 0600); err != nil {
+			return thumbnails, err
+		}
+		thumbnails = append(thumbnails, thumbnailPath)
+	}
+	return thumbnails, nil
+}
+
+// ScaleToFit fits img within a transparent size*size square, keeping its aspect ratio
+func ScaleToFit(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	if b.Dx() == size && b.Dy() == size {
+		return img
+	}
+	w, h := size, size
+	if b.Dx() > b.Dy() {
+		h = b.Dy() * size / b.Dx()
+	} else if b.Dy() > b.Dx() {
+		w = b.Dx() * size / b.Dy()
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, size, size))
+	offset := image.Pt((size-w)/2, (size-h)/2)
+	draw.CatmullRom.Scale(dst, image.Rectangle{offset, offset.Add(image.Pt(w, h))}, img, b, draw.Over, nil)
+	return dst
+}
+
+// PNGWithText inserts tEXt chunks right after the IHDR chunk of an encoded PNG
+func PNGWithText(data []byte, text [][2]string) []byte {
+	// Signature (8 bytes) + IHDR (length, type, 13 bytes of data and CRC)
+	const ihdrEnd = 8 + 4 + 4 + 13 + 4
+	var out bytes.Buffer
+	out.Write(data[:ihdrEnd])
+	for _, kv := range text {
+		chunk := append([]byte("tEXt"+kv[0]+"\x00"), kv[1]...)
+		binary.Write(&out, binary.BigEndian, uint32(len(chunk)-4))
+		out.Write(chunk)
+		binary.Write(&out, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+	}
+	out.Write(data[ihdrEnd:])
+	return out.Bytes()
+}
+
+// canonicalURI returns the file:// URI of a path, whose MD5 names its thumbnails
+func canonicalURI(path string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return (&url.URL{Scheme: "file", Path: absPath}).String(), nil
+}
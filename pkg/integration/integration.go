@@ -0,0 +1,648 @@
+// Package integration integrates AppBundles, AppImages and AppDirs into the desktop: it installs their icons, .desktop files and
+// shared-mime-info packages, makes freedesktop thumbnails of them and, optionally, makes them the default applications for their
+// MIME types. It keeps track of what it installed for each bundle in a Store, so that it can be refreshed or removed later on.
+package integration
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/xplshn/pelf/pkg/integration/freedesktop"
+	"github.com/xplshn/pelf/pkg/utils"
+	"github.com/zeebo/blake3"
+)
+
+var (
+	// ErrUnsupportedFormat is returned when there is no Extractor for the format of a bundle
+	ErrUnsupportedFormat = errors.New("unsupported format")
+	// ErrNotIntegrated is returned when deintegrating a bundle that the Store does not know about
+	ErrNotIntegrated = errors.New("bundle is not integrated")
+	// ErrRefused is returned when the Policy keeps a bundle from being integrated
+	ErrRefused = errors.New("bundle was refused")
+)
+
+// Options defines where and how bundles are integrated
+type Options struct {
+	IconDir             string                                        // Directory to store extracted icons.
+	AppDir              string                                        // Directory to store .desktop files.
+	MimeDir             string                                        // shared-mime-info directory, whose packages/ receives the MIME types of the bundles.
+	ThumbnailDir        string                                        // Directory of the freedesktop thumbnails. Defaults to $XDG_CACHE_HOME/thumbnails.
+	MimeAppsList        string                                        // mimeapps.list in which the default applications are set. Defaults to $XDG_CONFIG_HOME/mimeapps.list.
+	HicolorIcons        bool                                          // Flag to install the icons into the hicolor theme of IconDir (hicolor/<N>x<N>/apps and hicolor/scalable/apps) at the sizes of the theme, rather than as IconDir/<name>.png and .svg.
+	CorrectDesktopFiles bool                                          // Flag to point the Exec=, TryExec= and Icon= lines of the .desktop files to the bundle and its icon.
+	SetDefaultHandlers  bool                                          // Flag to make bundles the default application for the MIME types and URL schemes of their .desktop files.
+	Submenu             string                                        // Name of the submenu of the Applications menu in which the bundles are put, if any. Requires CorrectDesktopFiles.
+	MenuDir             string                                        // Directory of the .menu files merged into the Applications menu. Defaults to $XDG_CONFIG_HOME/menus/applications-merged.
+	Software            string                                        // Name of the program, recorded in the thumbnails.
+	NeverExecute        bool                                          // Flag to never run bundles to get their metadata. AppBundles are read like AppImages then, which only works for those whose image is SquashFS.
+	Policy              func(path, src string, previous *Entry) error // Decides whether a new or changed bundle may be integrated, before anything of it is extracted. Its content must be read from src, the open file that is then hashed and extracted, rather than from path, which may have been swapped meanwhile. previous is its entry, if any.
+	Log                 func(level, message string)                   // Receives the progress of the integration, with a level of "INF", "WRN" or "ERR". May be nil.
+}
+
+// Entry represents metadata associated with an integrated bundle.
+type Entry struct {
+	B3SUM                string            `json:"b3sum"`                            // B3SUM[0..256] hash of the bundle file.
+	Png                  string            `json:"png,omitempty"`                    // Path to the PNG icon file, if extracted.
+	Svg                  string            `json:"svg,omitempty"`                    // Path to the SVG icon file, if extracted.
+	Icons                []string          `json:"icons,omitempty"`                  // Paths to the other icons installed into the hicolor theme, if HicolorIcons is enabled.
+	Desktop              string            `json:"desktop,omitempty"`                // Path to the corrected .desktop file, if processed.
+	Thumbnail            string            `json:"thumbnail,omitempty"`              // Path to the 128x128 png thumbnail file, if processed.
+	LargeThumbnail       string            `json:"large_thumbnail,omitempty"`        // Path to the 256x256 png thumbnail file, if processed.
+	ThumbnailMTime       int64             `json:"thumbnail_mtime,omitempty"`        // Modification time of the bundle when its thumbnails were made.
+	Size                 int64             `json:"size,omitempty"`                   // Size of the bundle file when it was last hashed.
+	MTime                int64             `json:"mtime,omitempty"`                  // Modification time (ns) of the bundle file when it was last hashed.
+	Inode                uint64            `json:"inode,omitempty"`                  // Inode of the bundle file when it was last hashed.
+	HasMetadata          bool              `json:"has_metadata"`                     // Indicates if metadata was found.
+	MimeInfo             []string          `json:"mime_info,omitempty"`              // Paths to the installed shared-mime-info packages, if any.
+	DefaultHandlers      map[string]string `json:"default_handlers,omitempty"`       // MIME types of which the bundle was made the default application, mapped to the mimeapps.list value it replaced.
+	UpdateInfo           string            `json:"update_info,omitempty"`            // Update information embedded in the bundle (the .upd_info section of AppImages), if any.
+	HasEmbeddedSignature bool              `json:"has_embedded_signature,omitempty"` // Indicates if the bundle carries an embedded signature (the .sha256_sig section of AppImages). It is NOT verified: this only tells that the section isn't empty, and Policy has to check detached signatures to trust a bundle.
+	Refused              string            `json:"refused,omitempty"`                // Why the Policy kept the bundle from being integrated, if it did. Nothing else is recorded then.
+	Submenu              string            `json:"submenu,omitempty"`                // Submenu in which the .desktop file puts the bundle, if any.
+}
+
+// Store keeps track of the integrated bundles, keyed by their path. Persisting it is up to its owner
+type Store interface {
+	Get(path string) *Entry // Returns nil if the bundle is not integrated
+	Put(path string, entry *Entry)
+	Delete(path string)
+	Paths() []string
+}
+
+// MapStore is a Store kept in memory, which can be embedded in a configuration file as is
+type MapStore map[string]*Entry
+
+func (s MapStore) Get(path string) *Entry        { return s[path] }
+func (s MapStore) Put(path string, entry *Entry) { s[path] = entry }
+func (s MapStore) Delete(path string)            { delete(s, path) }
+
+func (s MapStore) Paths() []string {
+	paths := make([]string, 0, len(s))
+	for path := range s {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Integrator integrates bundles as per its Options, and records them in its Store
+type Integrator struct {
+	Options
+	Store      Store
+	extractors map[string]Extractor
+}
+
+// New returns an Integrator that knows about the formats of DefaultExtractors
+func New(opts Options, store Store) *Integrator {
+	extractors := DefaultExtractors()
+	if opts.NeverExecute {
+		extractors[".AppBundle"] = ExtractorFunc(readAppBundle)
+	}
+	return &Integrator{Options: opts, Store: store, extractors: extractors}
+}
+
+// RegisterExtractor adds support for a format, or replaces the extractor of a supported one. format is the extension of the
+// bundles, such as ".AppImage"
+func (in *Integrator) RegisterExtractor(format string, extractor Extractor) {
+	in.extractors[format] = extractor
+}
+
+// Format returns the extension under which the format of a bundle is known, sniffing its content if its own extension isn't
+// known. It returns "" if the format is not supported
+func (in *Integrator) Format(path string) string {
+	return in.format(path, path)
+}
+
+// format is Format for a bundle whose content is read from src
+func (in *Integrator) format(path, src string) string {
+	if ext := filepath.Ext(path); in.extractors[ext] != nil {
+		return ext
+	}
+	if format := SniffFormat(src); in.extractors[format] != nil {
+		return format
+	}
+	return ""
+}
+
+// Extract retrieves the metadata of a bundle, without integrating it. The bundle has to be accepted by the Policy first, as
+// extracting it may run it
+func (in *Integrator) Extract(path string) (*Metadata, error) {
+	src, bundle, err := openBundle(path)
+	if err != nil {
+		return nil, err
+	}
+	defer bundle.Close()
+	if in.Policy != nil {
+		if err := in.Policy(path, src, in.Store.Get(path)); err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrRefused, path, err)
+		}
+	}
+	return in.extract(path, src)
+}
+
+// extract retrieves the metadata of a bundle, reading it from src
+func (in *Integrator) extract(path, src string) (*Metadata, error) {
+	extractor := in.extractors[in.format(path, src)]
+	if extractor == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedFormat, path)
+	}
+	return extractor.Extract(src)
+}
+
+// Integrate installs the metadata of a bundle, replacing what was installed for it before, if anything
+func (in *Integrator) Integrate(path string) (*Entry, error) {
+	src, bundle, err := openBundle(path)
+	if err != nil {
+		return nil, err
+	}
+	defer bundle.Close()
+	b3sum, err := computeB3SUM(src)
+	if err != nil {
+		return nil, err
+	}
+	return in.integrate(path, src, b3sum)
+}
+
+// integrate integrates a bundle whose content is read from src, and whose hash is b3sum
+func (in *Integrator) integrate(path, src, b3sum string) (*Entry, error) {
+	previous := in.Store.Get(path)
+	if in.Policy != nil {
+		if err := in.Policy(path, src, previous); err != nil {
+			// The refusal is recorded, so that the bundle isn't looked at again until it changes
+			if previous != nil && previous.Refused == "" {
+				in.Deintegrate(path)
+			}
+			entry := &Entry{B3SUM: b3sum, Refused: err.Error()}
+			updateFileStamp(src, entry)
+			in.Store.Put(path, entry)
+			return entry, fmt.Errorf("%w: %s: %w", ErrRefused, path, err)
+		}
+	}
+
+	metadata, err := in.extract(path, src)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &Entry{B3SUM: b3sum, UpdateInfo: metadata.UpdateInfo, HasEmbeddedSignature: len(metadata.Signature) > 0}
+	baseName := installName(path)
+	if in.HicolorIcons {
+		in.installHicolorIcons(baseName, metadata, entry)
+	} else {
+		entry.Png = in.writeMetadata(filepath.Join(in.IconDir, baseName+".png"), metadata.PNG)
+		entry.Svg = in.writeMetadata(filepath.Join(in.IconDir, baseName+".svg"), metadata.SVG)
+	}
+	entry.Desktop = in.writeMetadata(filepath.Join(in.AppDir, baseName+".desktop"), in.desktopFile(path, metadata, entry))
+	if entry.Desktop != "" && in.CorrectDesktopFiles {
+		entry.Submenu = in.Submenu
+		// Without a submenu of its own, the Integrator leaves alone that of others, such as pelfd's
+		if in.Submenu != "" || (previous != nil && previous.Submenu != "") {
+			in.updateSubmenu()
+		}
+	}
+
+	if entry.Png != "" || entry.Svg != "" || len(entry.Icons) > 0 || entry.Desktop != "" {
+		entry.HasMetadata = true
+		in.log("INF", "Adding bundle to entries: %s", path)
+	} else {
+		in.log("WRN", "Bundle does not contain any metadata files: %s", path)
+	}
+	if entry.UpdateInfo != "" {
+		in.log("INF", "%s carries update information (embedded signature, unverified: %t): %s", filepath.Base(path), entry.HasEmbeddedSignature, entry.UpdateInfo)
+	}
+
+	// Files that the bundle no longer ships
+	if previous != nil {
+		for _, file := range [][2]string{{previous.Png, entry.Png}, {previous.Svg, entry.Svg}, {previous.Desktop, entry.Desktop}} {
+			if file[0] != "" && file[0] != file[1] {
+				in.removeFile(file[0])
+			}
+		}
+		for _, file := range previous.Icons {
+			if !slices.Contains(entry.Icons, file) && file != entry.Png && file != entry.Svg {
+				in.removeFile(file)
+			}
+		}
+		in.unregisterMimeInfo(previous)
+	}
+
+	// Thumbnails are made for files only, file managers show the icons of directories otherwise
+	if (entry.Png != "" || entry.Svg != "") && !isDirectory(path) {
+		if err := in.generateThumbnails(path, entry); err != nil {
+			in.log("ERR", "Failed to create thumbnail file: %v", err)
+		} else {
+			in.log("INF", "The thumbnails for %s were created at: %s and %s", path, entry.Thumbnail, entry.LargeThumbnail)
+		}
+	}
+	in.registerMimeTypes(path, baseName, metadata, entry, previous)
+	updateFileStamp(src, entry)
+	in.Store.Put(path, entry)
+	return entry, nil
+}
+
+// Deintegrate removes what was installed for a bundle, and forgets about it
+func (in *Integrator) Deintegrate(path string) error {
+	entry := in.Store.Get(path)
+	if entry == nil {
+		return fmt.Errorf("%w: %s", ErrNotIntegrated, path)
+	}
+	in.unregisterMimeTypes(entry)
+	for _, file := range append([]string{entry.Png, entry.Svg, entry.Desktop, entry.Thumbnail, entry.LargeThumbnail}, entry.Icons...) {
+		if file != "" {
+			in.removeFile(file)
+		}
+	}
+	in.Store.Delete(path)
+	return nil
+}
+
+// Refresh integrates a bundle if it is new or if it changed, deintegrates it if it is no longer executable, and re-creates the
+// files of an integrated bundle that went missing along with its stale thumbnails. It returns whether its entry changed, which
+// it also does when the Policy refuses the bundle
+func (in *Integrator) Refresh(path string) (bool, error) {
+	entry := in.Store.Get(path)
+	src, bundle, err := openBundle(path)
+	if err != nil {
+		return false, err
+	}
+	defer bundle.Close()
+	b3sum, err := bundleB3SUM(src, entry)
+	if err != nil {
+		return false, err
+	}
+
+	if entry == nil || entry.B3SUM != b3sum {
+		if !isExecutable(src) {
+			if entry == nil {
+				return false, nil
+			}
+			in.log("WRN", "%s is not executable anymore. Deintegrating...", path)
+			return true, in.Deintegrate(path)
+		}
+		if _, err := in.integrate(path, src, b3sum); err != nil {
+			return errors.Is(err, ErrRefused), err
+		}
+		return true, nil
+	}
+
+	// The content is the same, but the file may have been touched or replaced by a copy of itself
+	changed := updateFileStamp(src, entry)
+	return in.recreateFiles(path, src, entry) || changed, nil
+}
+
+// recreateFiles re-creates the files of an entry that don't exist anymore, and the thumbnails if they're stale. The bundle is
+// read from src
+func (in *Integrator) recreateFiles(path, src string, entry *Entry) bool {
+	changed := false
+	// The .desktop file is rewritten as well when the submenu changed
+	moved := entry.Desktop != "" && in.CorrectDesktopFiles && entry.Submenu != in.Submenu
+	iconsMissing := missing(entry.Png) || missing(entry.Svg) || slices.ContainsFunc(entry.Icons, missing)
+	if iconsMissing || missing(entry.Desktop) || moved {
+		in.log("WRN", "The files for %s don't exist anymore or are out of date. Re-creating...", filepath.Base(path))
+		if metadata, err := in.extract(path, src); err != nil {
+			in.log("ERR", "Failed to retrieve the metadata of %s: %v", path, err)
+		} else {
+			recreate := func(file *string, data []byte) {
+				if missing(*file) {
+					*file = in.writeMetadata(*file, data)
+					changed = true
+				}
+			}
+			if in.HicolorIcons && iconsMissing {
+				// The icons are scaled to the sizes of the theme, so they are all installed again
+				entry.Png, entry.Svg, entry.Icons = "", "", nil
+				in.installHicolorIcons(installName(path), metadata, entry)
+				changed = true
+			} else {
+				recreate(&entry.Png, metadata.PNG)
+				recreate(&entry.Svg, metadata.SVG)
+			}
+			if moved {
+				entry.Submenu = in.Submenu
+				entry.Desktop = in.writeMetadata(entry.Desktop, in.desktopFile(path, metadata, entry))
+				in.updateSubmenu()
+				changed = true
+			} else {
+				recreate(&entry.Desktop, in.desktopFile(path, metadata, entry))
+			}
+		}
+	}
+
+	// The thumbnails record the mtime of the bundle, so they're stale once it is modified
+	if thumbnailIsStale(path, entry) {
+		in.log("WRN", "The thumbnails for %s are missing or stale. Generating new thumbnails...", filepath.Base(path))
+		if err := in.generateThumbnails(path, entry); err != nil {
+			in.log("ERR", "Failed to create thumbnail file: %v", err)
+		} else {
+			in.log("INF", "New thumbnails for %s were created", filepath.Base(path))
+			changed = true
+		}
+	}
+	return changed
+}
+
+// desktopFile returns the .desktop file of a bundle, corrected if CorrectDesktopFiles is enabled
+func (in *Integrator) desktopFile(path string, metadata *Metadata, entry *Entry) []byte {
+	if metadata.Desktop == nil || !in.CorrectDesktopFiles {
+		return metadata.Desktop
+	}
+	execPath := metadata.Exec
+	if execPath == "" {
+		var err error
+		if execPath, err = filepath.Abs(path); err != nil {
+			execPath = path
+		}
+	}
+	icon := entry.Png
+	if icon == "" {
+		icon = entry.Svg
+	}
+	// Icons within a theme are looked up by their name
+	if in.HicolorIcons && (icon != "" || len(entry.Icons) > 0) {
+		icon = installName(path)
+	}
+	bundlePath, err := filepath.Abs(path)
+	if err != nil {
+		bundlePath = path
+	}
+	// Only AppBundles can run the other programs they ship
+	linkArg := ""
+	if metadata.AppBundleID != "" {
+		linkArg = "--pbundle_link"
+	}
+	return []byte(freedesktop.RewriteDesktopFile(string(metadata.Desktop), freedesktop.DesktopRewrite{
+		Exec:        execPath,
+		Icon:        icon,
+		AppBundleID: metadata.AppBundleID,
+		Path:        bundlePath,
+		Submenu:     in.Submenu != "",
+		LinkArg:     linkArg,
+	}))
+}
+
+// installHicolorIcons installs the icons of a bundle into the hicolor theme of IconDir under name: those it ships within the theme,
+// its .DirIcon, scaled down to the closest size of the theme unless it ships an icon of that size, and its .DirIcon.svg. Png and
+// Svg are set to the latter two, from which thumbnails are made
+func (in *Integrator) installHicolorIcons(name string, metadata *Metadata, entry *Entry) {
+	hicolor := filepath.Join(in.IconDir, "hicolor")
+	files := make(map[string][]byte)
+	for icon, data := range metadata.ThemeIcons {
+		files[filepath.Join(hicolor, filepath.Dir(icon), name+filepath.Ext(icon))] = data
+	}
+	var pngFile, svgFile string
+	if metadata.PNG != nil {
+		if size, data, err := hicolorPNG(metadata.PNG); err != nil {
+			in.log("ERR", "Failed to scale the icon %s to the sizes of the hicolor theme: %v", name, err)
+		} else {
+			pngFile = filepath.Join(hicolor, freedesktop.HicolorDir(size), name+".png")
+			if _, ok := files[pngFile]; !ok {
+				files[pngFile] = data
+			}
+		}
+	}
+	if metadata.SVG != nil {
+		svgFile = filepath.Join(hicolor, freedesktop.HicolorDir(0), name+".svg")
+		if _, ok := files[svgFile]; !ok {
+			files[svgFile] = metadata.SVG
+		}
+	}
+
+	for _, file := range slices.Sorted(maps.Keys(files)) {
+		if in.writeMetadata(file, files[file]) == "" {
+			continue
+		}
+		switch file {
+		case pngFile:
+			entry.Png = file
+		case svgFile:
+			entry.Svg = file
+		default:
+			entry.Icons = append(entry.Icons, file)
+		}
+	}
+}
+
+// updateSubmenu writes the submenu in which the bundles are put, or removes it if there's none
+func (in *Integrator) updateSubmenu() {
+	menuDir := in.MenuDir
+	if menuDir == "" {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			in.log("ERR", "Failed to locate the menus: %v", err)
+			return
+		}
+		menuDir = filepath.Join(configDir, "menus", "applications-merged")
+	}
+	// desktop-directories is a sibling of applications, within $XDG_DATA_HOME
+	directoryDir := filepath.Join(filepath.Dir(in.AppDir), "desktop-directories")
+
+	if in.Submenu == "" {
+		if freedesktop.RemoveSubmenu(menuDir, directoryDir) {
+			in.log("INF", "Removed the submenu of the bundles")
+		}
+		return
+	}
+	if written, err := freedesktop.WriteSubmenu(menuDir, directoryDir, in.Submenu); err != nil {
+		in.log("ERR", "Failed to write the submenu of the bundles: %v", err)
+	} else if written {
+		in.log("INF", "The bundles are put in the %q submenu", in.Submenu)
+	}
+}
+
+// generateThumbnails creates the thumbnails of a bundle from its PNG icon, or from its SVG icon if it has no PNG one
+func (in *Integrator) generateThumbnails(path string, entry *Entry) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	icon, err := loadIcon(entry)
+	if err != nil {
+		return err
+	}
+	thumbnailDir := in.ThumbnailDir
+	if thumbnailDir == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return err
+		}
+		thumbnailDir = filepath.Join(cacheDir, "thumbnails")
+	}
+	thumbnails, err := freedesktop.WriteThumbnails(path, icon, thumbnailDir, in.Software)
+	if err != nil {
+		return err
+	}
+	entry.Thumbnail, entry.LargeThumbnail = thumbnails[0], thumbnails[1]
+	entry.ThumbnailMTime = info.ModTime().Unix()
+	return nil
+}
+
+// unregisterMimeInfo removes the shared-mime-info packages of a previous entry, which are re-installed on re-integration
+func (in *Integrator) unregisterMimeInfo(entry *Entry) {
+	for _, file := range entry.MimeInfo {
+		in.removeFile(file)
+	}
+}
+
+// writeMetadata writes data to path, and returns path, or "" if there's no data or it couldn't be written
+func (in *Integrator) writeMetadata(path string, data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	if err := utils.WriteFileAtomic(path, data, 0644); err != nil {
+		in.log("ERR", "Failed to write file %s: %v", path, err)
+		return ""
+	}
+	in.log("INF", "Successfully wrote file: %s", path)
+	return path
+}
+
+func (in *Integrator) removeFile(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		in.log("ERR", "Failed to remove file: %s %v", path, err)
+		return
+	}
+	in.log("INF", "Removed file: %s", path)
+}
+
+func (in *Integrator) log(level, format string, args ...any) {
+	if in.Log != nil {
+		in.Log(level, fmt.Sprintf(format, args...))
+	}
+}
+
+func isDirectory(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// missing reports whether path was recorded but doesn't exist anymore
+func missing(path string) bool {
+	return path != "" && !fileExists(path)
+}
+
+// openBundle opens a bundle file, so that it is hashed, checked by the Policy and extracted from the same file, even if another
+// one is put at path meanwhile. It returns the path under which the open file is read (/proc/self/fd/N) along with the file,
+// which has to be closed once done with. AppDirs are read in place, their path is returned as is, along with a nil file
+func openBundle(path string) (string, *os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	if info, err := f.Stat(); err != nil || info.IsDir() {
+		f.Close()
+		return path, nil, err
+	}
+	return "/proc/self/fd/" + strconv.Itoa(int(f.Fd())), f, nil
+}
+
+// isExecutable reports whether a bundle can be run, which for an AppDir depends on its AppRun
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	if err == nil && info.IsDir() {
+		info, err = os.Stat(filepath.Join(path, "AppRun"))
+	}
+	return err == nil && info.Mode()&0111 != 0
+}
+
+// installName returns the name, without extension, of the files installed for the bundle at path: its own name followed by
+// a hash of its absolute path, so that bundles of the same name in different directories don't overwrite each other's files
+func installName(path string) string {
+	if absPath, err := filepath.Abs(path); err == nil {
+		path = absPath
+	}
+	sum := blake3.Sum256([]byte(path))
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)) + "-" + hex.EncodeToString(sum[:4])
+}
+
+// computeB3SUM computes the Blake3 hash of the file at the given path. The hash of an AppDir covers its AppRun and metadata files,
+// hashing the whole tree would take too long and tell nothing about what is integrated.
+func computeB3SUM(path string) (string, error) {
+	files, err := bundleFiles(path)
+	if err != nil {
+		return "", err
+	}
+
+	hasher := blake3.New()
+	for _, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			return "", err
+		}
+		// The names of the files of an AppDir are part of what is hashed, so that renaming them is noticed
+		if name != path {
+			rel, _ := filepath.Rel(path, name)
+			hasher.Write([]byte(rel + "\x00"))
+		}
+		_, err = io.Copy(hasher, file)
+		file.Close()
+		if err != nil {
+			return "", fmt.Errorf("failed to compute the Blake3 hash of %s: %w", name, err)
+		}
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// fileStamp returns what tells whether a file may have changed since it was last hashed: its size, mtime (ns) and inode.
+// Those of an AppDir are the total size and latest mtime of the files that are hashed, and the inode of the AppDir itself.
+func fileStamp(path string) (int64, int64, uint64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	var inode uint64
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		inode = st.Ino
+	}
+	if !info.IsDir() {
+		return info.Size(), info.ModTime().UnixNano(), inode, nil
+	}
+
+	files, err := bundleFiles(path)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	size, mtime := int64(0), info.ModTime().UnixNano()
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		size += fi.Size()
+		mtime = max(mtime, fi.ModTime().UnixNano())
+	}
+	return size, mtime, inode, nil
+}
+
+// bundleB3SUM returns the Blake3 hash of a bundle. It is only recomputed if the size, mtime or inode of the file changed since the entry was made.
+func bundleB3SUM(path string, entry *Entry) (string, error) {
+	size, mtime, inode, err := fileStamp(path)
+	if entry != nil && entry.B3SUM != "" && err == nil && entry.Size == size && entry.MTime == mtime && entry.Inode == inode {
+		return entry.B3SUM, nil
+	}
+	return computeB3SUM(path)
+}
+
+// updateFileStamp records the size, mtime and inode of a bundle in its entry, and returns whether they changed.
+func updateFileStamp(path string, entry *Entry) bool {
+	size, mtime, inode, err := fileStamp(path)
+	if err != nil || (entry.Size == size && entry.MTime == mtime && entry.Inode == inode) {
+		return false
+	}
+	entry.Size, entry.MTime, entry.Inode = size, mtime, inode
+	return true
+}
@@ -0,0 +1,464 @@
+package integration
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestIntegrator(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "integration-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	bundle := filepath.Join(tmpDir, "app.Fake")
+	if err := os.WriteFile(bundle, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var icon bytes.Buffer
+	if err := png.Encode(&icon, image.NewNRGBA(image.Rect(0, 0, 512, 512))); err != nil {
+		t.Fatal(err)
+	}
+	metadata := &Metadata{
+		Desktop:  []byte("[Desktop Entry]\nName=App\nExec=app %F\nIcon=app\nMimeType=text/x-fake;\n"),
+		PNG:      icon.Bytes(),
+		MimeInfo: [][]byte{[]byte("<mime-info/>")},
+	}
+
+	store := MapStore{}
+	in := New(Options{
+		IconDir:             filepath.Join(tmpDir, "icons"),
+		AppDir:              filepath.Join(tmpDir, "applications"),
+		MimeDir:             filepath.Join(tmpDir, "mime"),
+		ThumbnailDir:        filepath.Join(tmpDir, "thumbnails"),
+		MimeAppsList:        filepath.Join(tmpDir, "mimeapps.list"),
+		CorrectDesktopFiles: true,
+		SetDefaultHandlers:  true,
+	}, store)
+	in.RegisterExtractor(".Fake", ExtractorFunc(func(string) (*Metadata, error) { return metadata, nil }))
+
+	changed, err := in.Refresh(bundle)
+	if err != nil || !changed {
+		t.Fatalf("Expected the new bundle to be integrated, got changed=%v err=%v", changed, err)
+	}
+	entry := store.Get(bundle)
+	if entry == nil || !entry.HasMetadata {
+		t.Fatalf("Expected the bundle to be tracked with its metadata, got %+v", entry)
+	}
+	desktop, err := os.ReadFile(entry.Desktop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(desktop), "Exec="+bundle+" %F\n") || !strings.Contains(string(desktop), "Icon="+entry.Png+"\n") {
+		t.Errorf("The .desktop file was not corrected:\n%s", desktop)
+	}
+	for _, file := range append([]string{entry.Thumbnail, entry.LargeThumbnail}, entry.MimeInfo...) {
+		if !fileExists(file) {
+			t.Errorf("Expected %s to exist", file)
+		}
+	}
+	if entry.DefaultHandlers["text/x-fake"] != "" || len(entry.DefaultHandlers) != 1 {
+		t.Errorf("Expected the bundle to be the default application for text/x-fake, got %v", entry.DefaultHandlers)
+	}
+
+	// Nothing changed
+	if changed, err := in.Refresh(bundle); err != nil || changed {
+		t.Errorf("Expected nothing to change, got changed=%v err=%v", changed, err)
+	}
+
+	// Missing files are re-created
+	os.Remove(entry.Desktop)
+	if changed, err := in.Refresh(bundle); err != nil || !changed || !fileExists(entry.Desktop) {
+		t.Errorf("Expected the .desktop file to be re-created, got changed=%v err=%v", changed, err)
+	}
+
+	files := []string{entry.Png, entry.Desktop, entry.Thumbnail, entry.LargeThumbnail}
+	if err := in.Deintegrate(bundle); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range append(files, entry.MimeInfo...) {
+		if fileExists(file) {
+			t.Errorf("Expected %s to be removed", file)
+		}
+	}
+	if store.Get(bundle) != nil {
+		t.Errorf("Expected the bundle to be forgotten")
+	}
+	mimeApps, _ := os.ReadFile(filepath.Join(tmpDir, "mimeapps.list"))
+	if strings.Contains(string(mimeApps), filepath.Base(entry.Desktop)) {
+		t.Errorf("Expected the default application to be restored, got:\n%s", mimeApps)
+	}
+	if err := in.Deintegrate(bundle); err == nil {
+		t.Errorf("Expected an error when deintegrating a bundle that is not integrated")
+	}
+}
+
+func TestIntegrateSameName(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "integration-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	store := MapStore{}
+	in := New(Options{
+		IconDir: filepath.Join(tmpDir, "icons"),
+		AppDir:  filepath.Join(tmpDir, "applications"),
+		MimeDir: filepath.Join(tmpDir, "mime"),
+	}, store)
+	in.RegisterExtractor(".Fake", ExtractorFunc(func(string) (*Metadata, error) {
+		return &Metadata{Desktop: []byte("[Desktop Entry]\nName=App\nExec=app\n"), MimeInfo: [][]byte{[]byte("<mime-info/>")}}, nil
+	}))
+
+	var bundles []string
+	for _, dir := range []string{"a", "b"} {
+		bundle := filepath.Join(tmpDir, dir, "app.Fake")
+		os.MkdirAll(filepath.Dir(bundle), 0755)
+		if err := os.WriteFile(bundle, []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := in.Integrate(bundle); err != nil {
+			t.Fatal(err)
+		}
+		bundles = append(bundles, bundle)
+	}
+	first, second := store.Get(bundles[0]), store.Get(bundles[1])
+	if first.Desktop == second.Desktop || first.MimeInfo[0] == second.MimeInfo[0] {
+		t.Fatalf("Expected bundles of the same name to get files of their own, got %s and %s", first.Desktop, second.Desktop)
+	}
+	if err := in.Deintegrate(bundles[0]); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{second.Desktop, second.MimeInfo[0]} {
+		if !fileExists(file) {
+			t.Errorf("Expected %s to be left alone when deintegrating another bundle of the same name", file)
+		}
+	}
+}
+
+func TestIntegrateAppDir(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "integration-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	appDir := filepath.Join(tmpDir, "app.AppDir")
+	var icon bytes.Buffer
+	png.Encode(&icon, image.NewNRGBA(image.Rect(0, 0, 64, 64)))
+	files := map[string]string{
+		"AppRun":                  "#!/bin/sh\n",
+		"app.desktop":             "[Desktop Entry]\nName=App\nExec=app %U\n",
+		".DirIcon":                icon.String(),
+		"usr/bin/app":             "",
+		"usr/share/doc/README.md": "",
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(appDir, name)), 0755)
+		if err := os.WriteFile(filepath.Join(appDir, name), []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := MapStore{}
+	in := New(Options{
+		IconDir:             filepath.Join(tmpDir, "icons"),
+		AppDir:              filepath.Join(tmpDir, "applications"),
+		MimeDir:             filepath.Join(tmpDir, "mime"),
+		ThumbnailDir:        filepath.Join(tmpDir, "thumbnails"),
+		CorrectDesktopFiles: true,
+	}, store)
+	if changed, err := in.Refresh(appDir); err != nil || !changed {
+		t.Fatalf("Expected the AppDir to be integrated, got changed=%v err=%v", changed, err)
+	}
+	entry := store.Get(appDir)
+	desktop, _ := os.ReadFile(entry.Desktop)
+	if !strings.Contains(string(desktop), "Exec="+filepath.Join(appDir, "AppRun")+" %U\n") {
+		t.Errorf("Expected Exec= to point to the AppRun of the AppDir:\n%s", desktop)
+	}
+	if entry.Png == "" || entry.Thumbnail != "" {
+		t.Errorf("Expected the icon to be installed, but no thumbnails to be made, got %+v", entry)
+	}
+
+	// Files other than the AppRun and the metadata files do not matter
+	os.WriteFile(filepath.Join(appDir, "usr/share/doc/README.md"), []byte("changed"), 0644)
+	if _, err := in.Refresh(appDir); err != nil || store.Get(appDir).B3SUM != entry.B3SUM {
+		t.Errorf("Expected the hash of the AppDir to stay the same (err=%v)", err)
+	}
+	os.WriteFile(filepath.Join(appDir, "AppRun"), []byte("#!/bin/sh\nexec app\n"), 0755)
+	if changed, err := in.Refresh(appDir); err != nil || !changed || store.Get(appDir).B3SUM == entry.B3SUM {
+		t.Errorf("Expected the AppDir to be re-integrated once its AppRun changed, got changed=%v err=%v", changed, err)
+	}
+}
+
+func TestHicolorIcons(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "integration-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	appDir := filepath.Join(tmpDir, "app.AppDir")
+	encode := func(size int) string {
+		var buf bytes.Buffer
+		png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, size, size)))
+		return buf.String()
+	}
+	files := map[string]string{
+		"AppRun":       "#!/bin/sh\n",
+		"app.desktop":  "[Desktop Entry]\nName=App\nExec=app\nIcon=app-icon\n",
+		".DirIcon":     encode(300),
+		".DirIcon.svg": `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 16 16"/>`,
+		"usr/share/icons/hicolor/48x48/apps/app-icon.png": encode(48),
+		"usr/share/icons/hicolor/50x50/apps/app-icon.png": encode(50),
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(appDir, name)), 0755)
+		if err := os.WriteFile(filepath.Join(appDir, name), []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := MapStore{}
+	iconDir := filepath.Join(tmpDir, "icons")
+	in := New(Options{
+		IconDir:             iconDir,
+		AppDir:              filepath.Join(tmpDir, "applications"),
+		MimeDir:             filepath.Join(tmpDir, "mime"),
+		HicolorIcons:        true,
+		CorrectDesktopFiles: true,
+	}, store)
+	entry, err := in.Integrate(appDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := installName(appDir)
+	hicolor := filepath.Join(iconDir, "hicolor")
+	if expected := filepath.Join(hicolor, "256x256", "apps", name+".png"); entry.Png != expected {
+		t.Errorf("Expected the .DirIcon to be scaled down to %s, got %q", expected, entry.Png)
+	}
+	if expected := filepath.Join(hicolor, "scalable", "apps", name+".svg"); entry.Svg != expected {
+		t.Errorf("Expected the .DirIcon.svg to be installed as %s, got %q", expected, entry.Svg)
+	}
+	if expected := []string{filepath.Join(hicolor, "48x48", "apps", name+".png")}; !slices.Equal(entry.Icons, expected) {
+		t.Errorf("Expected the icons shipped at the sizes of the theme to be installed as %v, got %v", expected, entry.Icons)
+	}
+	if img, err := os.Open(entry.Png); err != nil {
+		t.Error(err)
+	} else if config, err := png.DecodeConfig(img); err != nil || config.Width != 256 {
+		t.Errorf("Expected a 256px icon, got %+v (err=%v)", config, err)
+	}
+	desktop, _ := os.ReadFile(entry.Desktop)
+	if !strings.Contains(string(desktop), "Icon="+name+"\n") {
+		t.Errorf("Expected Icon= to name the icon within the theme:\n%s", desktop)
+	}
+
+	// Missing icons are installed again at their sizes
+	os.Remove(entry.Icons[0])
+	if _, err := in.Refresh(appDir); err != nil || !fileExists(entry.Icons[0]) {
+		t.Errorf("Expected the missing icon to be re-created (err=%v)", err)
+	}
+	if err := in.Deintegrate(appDir); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range append([]string{entry.Png, entry.Svg}, entry.Icons...) {
+		if fileExists(file) {
+			t.Errorf("Expected %s to be removed", file)
+		}
+	}
+}
+
+func TestIconLimits(t *testing.T) {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 1, 1)))
+	if _, err := decodePNG(buf.Bytes()); err != nil {
+		t.Fatalf("Failed to decode a 1px icon: %v", err)
+	}
+
+	// The IHDR chunk (its type, then its data) declares a 60000x60000 image, whose pixels would take gigabytes
+	huge := bytes.Clone(buf.Bytes())
+	binary.BigEndian.PutUint32(huge[16:], 60000)
+	binary.BigEndian.PutUint32(huge[20:], 60000)
+	binary.BigEndian.PutUint32(huge[29:], crc32.ChecksumIEEE(huge[12:29]))
+	if _, err := decodePNG(huge); err == nil || !strings.Contains(err.Error(), "too big") {
+		t.Errorf("Expected a PNG icon declared as 60000x60000 to be refused, got %v", err)
+	}
+
+	svg := `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 16 16">` + strings.Repeat(" ", maxSVGSize) + `</svg>`
+	if _, err := RasterizeSVG([]byte(svg), 128); err == nil {
+		t.Errorf("Expected an SVG icon bigger than %d bytes to be refused", maxSVGSize)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "integration-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	bundle := filepath.Join(tmpDir, "app.Fake")
+	if err := os.WriteFile(bundle, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	store := MapStore{}
+	allowed, extracted := false, 0
+	in := New(Options{
+		IconDir: filepath.Join(tmpDir, "icons"),
+		AppDir:  filepath.Join(tmpDir, "applications"),
+		MimeDir: filepath.Join(tmpDir, "mime"),
+		Policy: func(path, src string, previous *Entry) error {
+			if !allowed {
+				return fmt.Errorf("not allowed")
+			}
+			return nil
+		},
+	}, store)
+	in.RegisterExtractor(".Fake", ExtractorFunc(func(string) (*Metadata, error) {
+		extracted++
+		return &Metadata{Desktop: []byte("[Desktop Entry]\nName=App\nExec=app\n")}, nil
+	}))
+
+	changed, err := in.Refresh(bundle)
+	if !errors.Is(err, ErrRefused) || !changed {
+		t.Fatalf("Expected the bundle to be refused, got changed=%v err=%v", changed, err)
+	}
+	if entry := store.Get(bundle); entry == nil || entry.Refused != "not allowed" || entry.Desktop != "" || extracted != 0 {
+		t.Fatalf("Expected the refusal to be recorded without reading the bundle, got %+v (extracted %d times)", entry, extracted)
+	}
+
+	// A refused bundle isn't looked at again until it changes
+	allowed = true
+	if changed, err := in.Refresh(bundle); err != nil || changed {
+		t.Errorf("Expected nothing to change, got changed=%v err=%v", changed, err)
+	}
+	if err := os.WriteFile(bundle, []byte("#!/bin/sh\necho\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := in.Refresh(bundle); err != nil || !changed {
+		t.Fatalf("Expected the changed bundle to be integrated, got changed=%v err=%v", changed, err)
+	}
+	entry := store.Get(bundle)
+	if entry.Refused != "" || !fileExists(entry.Desktop) {
+		t.Fatalf("Expected the bundle to be integrated, got %+v", entry)
+	}
+
+	// Refusing an integrated bundle deintegrates it
+	allowed = false
+	if err := os.WriteFile(bundle, []byte("#!/bin/sh\necho changed\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := in.Refresh(bundle); !errors.Is(err, ErrRefused) {
+		t.Fatalf("Expected the bundle to be refused, got %v", err)
+	}
+	if fileExists(entry.Desktop) {
+		t.Errorf("Expected the files of the refused bundle to be removed")
+	}
+}
+
+func TestPolicySwap(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "integration-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	bundle, swapped := filepath.Join(tmpDir, "app.Fake"), filepath.Join(tmpDir, "swapped")
+	if err := os.WriteFile(bundle, []byte("#!/bin/sh\necho verified\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(swapped, []byte("#!/bin/sh\necho swapped\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	verified, err := computeB3SUM(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The bundle is swapped once the policy accepted it, which must not change what is extracted
+	var extracted []byte
+	in := New(Options{
+		IconDir: filepath.Join(tmpDir, "icons"),
+		AppDir:  filepath.Join(tmpDir, "applications"),
+		Policy: func(path, src string, previous *Entry) error {
+			if data, err := os.ReadFile(src); err != nil || !bytes.Contains(data, []byte("verified")) {
+				return fmt.Errorf("unexpected content %q (%v)", data, err)
+			}
+			return os.Rename(swapped, bundle)
+		},
+	}, MapStore{})
+	in.RegisterExtractor(".Fake", ExtractorFunc(func(src string) (*Metadata, error) {
+		extracted, err = os.ReadFile(src)
+		return &Metadata{}, err
+	}))
+
+	entry, err := in.Integrate(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(extracted, []byte("verified")) || entry.B3SUM != verified {
+		t.Errorf("Expected the verified bundle to be extracted and hashed, got %q and %s", extracted, entry.B3SUM)
+	}
+}
+
+func TestSubmenu(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "integration-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	bundle := filepath.Join(tmpDir, "app.Fake")
+	if err := os.WriteFile(bundle, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	store := MapStore{}
+	in := New(Options{
+		IconDir:             filepath.Join(tmpDir, "share", "icons"),
+		AppDir:              filepath.Join(tmpDir, "share", "applications"),
+		MimeDir:             filepath.Join(tmpDir, "share", "mime"),
+		MenuDir:             filepath.Join(tmpDir, "menus"),
+		CorrectDesktopFiles: true,
+		Submenu:             "Bundles",
+	}, store)
+	in.RegisterExtractor(".Fake", ExtractorFunc(func(string) (*Metadata, error) {
+		return &Metadata{Desktop: []byte("[Desktop Entry]\nName=App\nExec=app\nCategories=Game;\n\n[Desktop Action new]\nExec=app --new\n\n[Desktop Action edit]\nExec=app-editor %f\n"), AppBundleID: "app#github.com/owner/repo"}, nil
+	}))
+
+	if _, err := in.Refresh(bundle); err != nil {
+		t.Fatal(err)
+	}
+	entry := store.Get(bundle)
+	desktop, _ := os.ReadFile(entry.Desktop)
+	for _, line := range []string{"Categories=X-AppBundle;", "X-AppBundle-Categories=Game;", "X-AppBundle-ID=app#github.com/owner/repo", "X-AppBundle-Path=" + bundle, "Exec=" + bundle + " --new", "Exec=" + bundle + " --pbundle_link app-editor %f"} {
+		if !strings.Contains(string(desktop), line+"\n") {
+			t.Errorf("Expected %q within the .desktop file:\n%s", line, desktop)
+		}
+	}
+	menu := filepath.Join(tmpDir, "menus", "appbundles.menu")
+	if !fileExists(menu) || !fileExists(filepath.Join(tmpDir, "share", "desktop-directories", "appbundles.directory")) {
+		t.Fatalf("Expected the submenu to be written")
+	}
+
+	// Leaving the submenu rewrites the .desktop files
+	in.Submenu = ""
+	if changed, err := in.Refresh(bundle); err != nil || !changed {
+		t.Fatalf("Expected the .desktop file to be rewritten, got changed=%v err=%v", changed, err)
+	}
+	desktop, _ = os.ReadFile(entry.Desktop)
+	if !strings.Contains(string(desktop), "\nCategories=Game;\n") || fileExists(menu) {
+		t.Errorf("Expected the bundle to leave the submenu, got:\n%s", desktop)
+	}
+}
@@ -0,0 +1,154 @@
+package integration
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/xplshn/pelf/pkg/utils"
+)
+
+// registerMimeTypes installs the shared-mime-info packages of the bundle, and, if SetDefaultHandlers is enabled, makes it the
+// default application for the MIME types and URL schemes (x-scheme-handler/*) declared by its .desktop file.
+// previous is the entry of the bundle before it was re-integrated, if any, so that the defaults that it replaced are not lost
+func (in *Integrator) registerMimeTypes(path, baseName string, metadata *Metadata, entry, previous *Entry) {
+	for i, data := range metadata.MimeInfo {
+		outputFile := filepath.Join(in.MimeDir, "packages", fmt.Sprintf("%s-%d.xml", baseName, i))
+		if err := utils.WriteFileAtomic(outputFile, data, 0644); err != nil {
+			in.log("ERR", "Failed to write file %s: %v", outputFile, err)
+			continue
+		}
+		in.log("INF", "Successfully wrote file: %s", outputFile)
+		entry.MimeInfo = append(entry.MimeInfo, outputFile)
+	}
+	if len(entry.MimeInfo) > 0 {
+		in.updateMimeDatabase(in.MimeDir)
+	}
+
+	var mimeTypes []string
+	if entry.Desktop != "" {
+		if df, err := utils.ParseDesktopFile(entry.Desktop); err == nil {
+			mimeTypes = df.MimeTypes()
+		}
+	}
+	if len(mimeTypes) > 0 {
+		in.updateDesktopDatabase(filepath.Dir(entry.Desktop))
+	}
+
+	var previousDefaults map[string]string
+	if previous != nil {
+		previousDefaults = previous.DefaultHandlers
+	}
+	if !in.SetDefaultHandlers || len(mimeTypes) == 0 {
+		// The bundle may have been the default application before the option was disabled or its MIME types changed
+		if len(previousDefaults) > 0 {
+			in.restoreDefaultHandlers(filepath.Base(previous.Desktop), previousDefaults)
+		}
+		return
+	}
+
+	mimeAppsList, err := in.mimeAppsPath()
+	if err != nil {
+		in.log("ERR", "Failed to locate mimeapps.list: %v", err)
+		return
+	}
+	mimeApps, err := utils.ParseMimeApps(mimeAppsList)
+	if err != nil {
+		in.log("ERR", "Failed to read %s: %v", mimeAppsList, err)
+		return
+	}
+
+	desktopID := filepath.Base(entry.Desktop)
+	entry.DefaultHandlers = make(map[string]string)
+	for _, mimeType := range mimeTypes {
+		replaced := mimeApps.SetDefault(mimeType, desktopID)
+		if old, ok := previousDefaults[mimeType]; ok && strings.Split(replaced, ";")[0] == desktopID {
+			replaced = old
+		}
+		entry.DefaultHandlers[mimeType] = replaced
+	}
+	for mimeType, old := range previousDefaults {
+		if _, ok := entry.DefaultHandlers[mimeType]; !ok {
+			mimeApps.RestoreDefault(mimeType, filepath.Base(previous.Desktop), old)
+		}
+	}
+
+	if err := mimeApps.Write(mimeAppsList); err != nil {
+		in.log("ERR", "Failed to update %s: %v", mimeAppsList, err)
+		return
+	}
+	in.log("INF", "%s is now the default application for: %s", filepath.Base(path), strings.Join(mimeTypes, ", "))
+}
+
+// unregisterMimeTypes undoes registerMimeTypes
+func (in *Integrator) unregisterMimeTypes(entry *Entry) {
+	if len(entry.DefaultHandlers) > 0 {
+		in.restoreDefaultHandlers(filepath.Base(entry.Desktop), entry.DefaultHandlers)
+	}
+
+	mimeDirs := make(map[string]bool)
+	for _, file := range entry.MimeInfo {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			in.log("ERR", "Failed to remove file: %s %v", file, err)
+			continue
+		}
+		in.log("INF", "Removed file: %s", file)
+		mimeDirs[filepath.Dir(filepath.Dir(file))] = true
+	}
+	for mimeDir := range mimeDirs {
+		in.updateMimeDatabase(mimeDir)
+	}
+}
+
+// restoreDefaultHandlers gives the MIME types back to the applications that were their defaults, unless the user changed them since
+func (in *Integrator) restoreDefaultHandlers(desktopID string, defaults map[string]string) {
+	mimeAppsList, err := in.mimeAppsPath()
+	if err != nil {
+		in.log("ERR", "Failed to locate mimeapps.list: %v", err)
+		return
+	}
+	mimeApps, err := utils.ParseMimeApps(mimeAppsList)
+	if err != nil {
+		in.log("ERR", "Failed to read %s: %v", mimeAppsList, err)
+		return
+	}
+	for mimeType, previous := range defaults {
+		mimeApps.RestoreDefault(mimeType, desktopID, previous)
+	}
+	if err := mimeApps.Write(mimeAppsList); err != nil {
+		in.log("ERR", "Failed to update %s: %v", mimeAppsList, err)
+		return
+	}
+	in.log("INF", "Restored the default applications that %s replaced", desktopID)
+}
+
+func (in *Integrator) mimeAppsPath() (string, error) {
+	if in.MimeAppsList != "" {
+		return in.MimeAppsList, nil
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "mimeapps.list"), nil
+}
+
+func (in *Integrator) updateMimeDatabase(mimeDir string) {
+	in.runIfAvailable("update-mime-database", mimeDir)
+}
+
+func (in *Integrator) updateDesktopDatabase(appDir string) {
+	in.runIfAvailable("update-desktop-database", "-q", appDir)
+}
+
+// runIfAvailable runs the tools that refresh the caches of the desktop, which are not installed everywhere
+func (in *Integrator) runIfAvailable(name string, args ...string) {
+	if _, err := exec.LookPath(name); err != nil {
+		return
+	}
+	if output, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		in.log("WRN", "%s failed: %v: %s", name, err, strings.TrimSpace(string(output)))
+	}
+}
@@ -0,0 +1,95 @@
+package integration
+
+import (
+	"crypto/ed25519"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ErrBadSignature is returned when a bundle isn't signed by any of the trusted keys
+var ErrBadSignature = errors.New("no valid signature")
+
+// VerifySignature checks the detached signature of a bundle, <bundle>.sig, against the trusted keys. The signature is the
+// base64-encoded Ed25519 signature of the SHA-512 digest of the bundle, such as made by Sign, or by
+// `openssl dgst -sha512 -binary <bundle> > digest && openssl pkeyutl -sign -rawin -inkey <key.pem> -in digest | base64 -w0 > <bundle>.sig`
+func VerifySignature(path string, keys []ed25519.PublicKey) error {
+	return VerifySignatureFrom(path, path, keys)
+}
+
+// VerifySignatureFrom is VerifySignature for a bundle whose content is read from src, such as the open file that an Integrator
+// passes to its Policy, rather than from path. The signature is still read from <path>.sig
+func VerifySignatureFrom(path, src string, keys []ed25519.PublicKey) error {
+	data, err := os.ReadFile(path + ".sig")
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return fmt.Errorf("%w: %s.sig is malformed", ErrBadSignature, path)
+	}
+	digest, err := fileDigest(src)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if ed25519.Verify(key, digest, signature) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s is not signed by any of the trusted keys", ErrBadSignature, path)
+}
+
+// Sign returns the detached signature of a bundle, as checked by VerifySignature
+func Sign(path string, key ed25519.PrivateKey) ([]byte, error) {
+	digest, err := fileDigest(path)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, digest)) + "\n"), nil
+}
+
+// ParsePublicKey decodes a base64-encoded Ed25519 public key: either the raw key, or its PKIX form, which is the content of the
+// PEM file written by `openssl pkey -pubout`
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "-----BEGIN PUBLIC KEY-----")
+	s = strings.TrimSuffix(s, "-----END PUBLIC KEY-----")
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == ed25519.PublicKeySize {
+		return ed25519.PublicKey(data), nil
+	}
+	key, err := x509.ParsePKIXPublicKey(data)
+	if err != nil {
+		return nil, err
+	}
+	if key, ok := key.(ed25519.PublicKey); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("not an Ed25519 public key")
+}
+
+// fileDigest returns the SHA-512 digest of a bundle. Directories can't be signed
+func fileDigest(path string) ([]byte, error) {
+	if isDirectory(path) {
+		return nil, fmt.Errorf("%w: %s is a directory, which can't be signed", ErrBadSignature, path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hasher := sha512.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return nil, err
+	}
+	return hasher.Sum(nil), nil
+}
@@ -0,0 +1,76 @@
+package integration
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifySignature(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "signature-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, _ := ed25519.GenerateKey(nil)
+	bundle := filepath.Join(tmpDir, "app.AppBundle")
+	if err := os.WriteFile(bundle, []byte("bundle"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifySignature(bundle, []ed25519.PublicKey{public}); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Expected an unsigned bundle to be rejected, got %v", err)
+	}
+	signature, err := Sign(bundle, private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bundle+".sig", signature, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifySignature(bundle, []ed25519.PublicKey{other, public}); err != nil {
+		t.Errorf("Expected the signature to be valid, got %v", err)
+	}
+	if err := VerifySignature(bundle, []ed25519.PublicKey{other}); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Expected a signature by an untrusted key to be rejected, got %v", err)
+	}
+	if err := os.WriteFile(bundle, []byte("tampered"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifySignature(bundle, []ed25519.PublicKey{public}); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Expected a tampered bundle to be rejected, got %v", err)
+	}
+	if err := VerifySignature(tmpDir, []ed25519.PublicKey{public}); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Expected a directory to be rejected, got %v", err)
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	public, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pem := "-----BEGIN PUBLIC KEY-----\n" + base64.StdEncoding.EncodeToString(der) + "\n-----END PUBLIC KEY-----\n"
+	for _, s := range []string{base64.StdEncoding.EncodeToString(public), base64.StdEncoding.EncodeToString(der), pem} {
+		key, err := ParsePublicKey(s)
+		if err != nil || !key.Equal(public) {
+			t.Errorf("Failed to parse %q: %v", s, err)
+		}
+	}
+	if _, err := ParsePublicKey("not a key"); err == nil {
+		t.Errorf("Expected an invalid key to fail")
+	}
+}
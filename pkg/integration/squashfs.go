@@ -0,0 +1,518 @@
+package integration
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// squashfs reads files out of a SquashFS 4.0 image, such as the one that follows the runtime of a type-2 AppImage. It only
+// implements what is needed to retrieve metadata: looking up paths, listing directories, and reading regular files and symlinks
+type squashfs struct {
+	r       io.ReaderAt // Relative to the start of the image
+	super   squashfsSuperblock
+	decoder func(data []byte, limit int) ([]byte, error) // Decompresses data, which may not expand beyond limit bytes
+}
+
+type squashfsSuperblock struct {
+	Magic               uint32
+	InodeCount          uint32
+	ModificationTime    uint32
+	BlockSize           uint32
+	FragmentEntryCount  uint32
+	CompressionID       uint16
+	BlockLog            uint16
+	Flags               uint16
+	IDCount             uint16
+	VersionMajor        uint16
+	VersionMinor        uint16
+	RootInodeRef        uint64
+	BytesUsed           uint64
+	IDTableStart        uint64
+	XattrIDTableStart   uint64
+	InodeTableStart     uint64
+	DirectoryTableStart uint64
+	FragmentTableStart  uint64
+	ExportTableStart    uint64
+}
+
+const (
+	squashfsMagic           = 0x73717368
+	squashfsMetadataSize    = 8192
+	squashfsNoFragment      = 0xFFFFFFFF
+	squashfsUncompressed    = 1 << 15 // Of the header of a metadata block
+	squashfsBlockUncompress = 1 << 24 // Of the size of a data block
+	squashfsMaxSymlinks     = 16
+	squashfsMinBlockSize    = 4 << 10
+	squashfsMaxBlockSize    = 1 << 20
+	squashfsMaxFileSize     = 64 << 20 // Metadata files are small, anything big enough to hurt is not what is being looked for
+)
+
+// Types of inodes
+const (
+	squashfsDir        = 1
+	squashfsFile       = 2
+	squashfsSymlink    = 3
+	squashfsExtDir     = 8
+	squashfsExtFile    = 9
+	squashfsExtSymlink = 10
+)
+
+// squashfsInode is the part of an inode that is needed to read a directory, a file or a symlink
+type squashfsInode struct {
+	kind        uint16
+	size        uint64   // Of the file, or of the directory listing
+	start       uint64   // Of the first data block, or of the metadata block of the directory listing
+	offset      uint32   // Within the fragment, or within the metadata block of the directory listing
+	fragment    uint32   // Index of the fragment that holds the tail of the file
+	blockSizes  []uint32 // Sizes of the data blocks of the file
+	symlinkDest string
+}
+
+func openSquashfs(r io.ReaderAt) (*squashfs, error) {
+	sq := &squashfs{r: r}
+	if err := binary.Read(io.NewSectionReader(r, 0, 96), binary.LittleEndian, &sq.super); err != nil {
+		return nil, err
+	}
+	if sq.super.Magic != squashfsMagic {
+		return nil, fmt.Errorf("not a SquashFS image")
+	}
+	if sq.super.VersionMajor != 4 {
+		return nil, fmt.Errorf("unsupported SquashFS version %d.%d", sq.super.VersionMajor, sq.super.VersionMinor)
+	}
+	// Everything else is sized after the block size, so the image is refused before anything is read if it is not a valid one
+	blockSize := sq.super.BlockSize
+	if blockSize < squashfsMinBlockSize || blockSize > squashfsMaxBlockSize || blockSize&(blockSize-1) != 0 || sq.super.BlockLog >= 32 || blockSize != 1<<sq.super.BlockLog {
+		return nil, fmt.Errorf("corrupt SquashFS image: invalid block size %d", blockSize)
+	}
+
+	switch sq.super.CompressionID {
+	case 1:
+		sq.decoder = func(data []byte, limit int) ([]byte, error) {
+			zr, err := zlib.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			defer zr.Close()
+			return readAtMost(zr, limit)
+		}
+	case 4:
+		sq.decoder = func(data []byte, limit int) ([]byte, error) {
+			xr, err := xz.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			return readAtMost(xr, limit)
+		}
+	case 5:
+		sq.decoder = func(data []byte, limit int) ([]byte, error) {
+			out := make([]byte, limit)
+			n, err := lz4.UncompressBlock(data, out)
+			return out[:n], err
+		}
+	case 6:
+		zr, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(max(blockSize, squashfsMetadataSize))))
+		if err != nil {
+			return nil, err
+		}
+		sq.decoder = func(data []byte, limit int) ([]byte, error) {
+			out, err := zr.DecodeAll(data, nil)
+			if err == nil && len(out) > limit {
+				return nil, errTooLarge
+			}
+			return out, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported SquashFS compression: %d", sq.super.CompressionID)
+	}
+	return sq, nil
+}
+
+var errTooLarge = errors.New("decompresses beyond the size of a block")
+
+// readAtMost reads r to its end, failing if it holds more than limit bytes
+func readAtMost(r io.Reader, limit int) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err == nil && len(data) > limit {
+		return nil, errTooLarge
+	}
+	return data, err
+}
+
+// metadata returns the decompressed metadata block at pos, and the position of the next one
+func (sq *squashfs) metadata(pos uint64) ([]byte, uint64, error) {
+	var header [2]byte
+	if _, err := sq.r.ReadAt(header[:], int64(pos)); err != nil {
+		return nil, 0, err
+	}
+	h := binary.LittleEndian.Uint16(header[:])
+	size := uint64(h &^ squashfsUncompressed)
+	if size > squashfsMetadataSize {
+		return nil, 0, fmt.Errorf("corrupt metadata block at %d", pos)
+	}
+	data := make([]byte, size)
+	if _, err := sq.r.ReadAt(data, int64(pos)+2); err != nil {
+		return nil, 0, err
+	}
+	if h&squashfsUncompressed == 0 {
+		var err error
+		if data, err = sq.decoder(data, squashfsMetadataSize); err != nil {
+			return nil, 0, fmt.Errorf("corrupt metadata block at %d: %w", pos, err)
+		}
+	}
+	return data, pos + 2 + size, nil
+}
+
+// metadataReader reads across the metadata blocks of a table, starting at offset within the block at pos
+type metadataReader struct {
+	sq   *squashfs
+	next uint64
+	buf  []byte
+}
+
+func (sq *squashfs) metadataReader(pos uint64, offset uint32) (*metadataReader, error) {
+	mr := &metadataReader{sq: sq, next: pos}
+	if err := mr.fill(); err != nil {
+		return nil, err
+	}
+	if int(offset) > len(mr.buf) {
+		return nil, fmt.Errorf("corrupt metadata reference")
+	}
+	mr.buf = mr.buf[offset:]
+	return mr, nil
+}
+
+func (mr *metadataReader) fill() error {
+	data, next, err := mr.sq.metadata(mr.next)
+	if err != nil {
+		return err
+	}
+	mr.buf, mr.next = data, next
+	return nil
+}
+
+func (mr *metadataReader) Read(p []byte) (int, error) {
+	if len(mr.buf) == 0 {
+		if err := mr.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, mr.buf)
+	mr.buf = mr.buf[n:]
+	return n, nil
+}
+
+// inode reads the inode that ref points to: the position of its metadata block within the inode table, and its offset within it
+func (sq *squashfs) inode(ref uint64) (*squashfsInode, error) {
+	mr, err := sq.metadataReader(sq.super.InodeTableStart+(ref>>16), uint32(ref&0xFFFF))
+	if err != nil {
+		return nil, err
+	}
+	// Type, permissions, uid, gid, mtime and inode number
+	var header struct {
+		Kind               uint16
+		Mode, UID, GID     uint16
+		MTime, InodeNumber uint32
+	}
+	if err := binary.Read(mr, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	inode := &squashfsInode{kind: header.Kind}
+	read := func(data ...any) error {
+		for _, d := range data {
+			if err := binary.Read(mr, binary.LittleEndian, d); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	switch header.Kind {
+	case squashfsDir:
+		var d struct {
+			BlockIndex, LinkCount uint32
+			FileSize, BlockOffset uint16
+			ParentInode           uint32
+		}
+		if err := read(&d); err != nil {
+			return nil, err
+		}
+		inode.start, inode.offset, inode.size = uint64(d.BlockIndex), uint32(d.BlockOffset), uint64(d.FileSize)
+	case squashfsExtDir:
+		var d struct {
+			LinkCount, FileSize, BlockIndex, ParentInode uint32
+			IndexCount, BlockOffset                      uint16
+			XattrIndex                                   uint32
+		}
+		if err := read(&d); err != nil {
+			return nil, err
+		}
+		inode.start, inode.offset, inode.size = uint64(d.BlockIndex), uint32(d.BlockOffset), uint64(d.FileSize)
+	case squashfsFile:
+		var f struct{ BlocksStart, Fragment, BlockOffset, FileSize uint32 }
+		if err := read(&f); err != nil {
+			return nil, err
+		}
+		inode.start, inode.fragment, inode.offset, inode.size = uint64(f.BlocksStart), f.Fragment, f.BlockOffset, uint64(f.FileSize)
+	case squashfsExtFile:
+		var f struct {
+			BlocksStart, FileSize, Sparse                uint64
+			LinkCount, Fragment, BlockOffset, XattrIndex uint32
+		}
+		if err := read(&f); err != nil {
+			return nil, err
+		}
+		inode.start, inode.fragment, inode.offset, inode.size = f.BlocksStart, f.Fragment, f.BlockOffset, f.FileSize
+	case squashfsSymlink, squashfsExtSymlink:
+		var s struct{ LinkCount, TargetSize uint32 }
+		if err := read(&s); err != nil {
+			return nil, err
+		}
+		if s.TargetSize > 4096 {
+			return nil, fmt.Errorf("corrupt symlink")
+		}
+		dest := make([]byte, s.TargetSize)
+		if _, err := io.ReadFull(mr, dest); err != nil {
+			return nil, err
+		}
+		inode.symlinkDest = string(dest)
+	default:
+		return inode, nil
+	}
+
+	if header.Kind == squashfsFile || header.Kind == squashfsExtFile {
+		// The list of block sizes is as long as the file is big, so it is not read for files that would not be read anyway
+		if inode.size > squashfsMaxFileSize {
+			return nil, errFileTooBig
+		}
+		// The tail of the file lives in a fragment, if it has one
+		blocks := inode.size / uint64(sq.super.BlockSize)
+		if inode.fragment == squashfsNoFragment && inode.size%uint64(sq.super.BlockSize) != 0 {
+			blocks++
+		}
+		inode.blockSizes = make([]uint32, blocks)
+		if err := read(inode.blockSizes); err != nil {
+			return nil, err
+		}
+	}
+	return inode, nil
+}
+
+// squashfsDirEntry is an entry of a directory listing
+type squashfsDirEntry struct {
+	name  string
+	inode uint64 // Reference to the inode
+}
+
+func (sq *squashfs) readDir(dir *squashfsInode) ([]squashfsDirEntry, error) {
+	if dir.kind != squashfsDir && dir.kind != squashfsExtDir {
+		return nil, fmt.Errorf("not a directory")
+	}
+	// The size accounts for the "." and ".." entries, which are not stored
+	if dir.size <= 3 {
+		return nil, nil
+	}
+	mr, err := sq.metadataReader(sq.super.DirectoryTableStart+dir.start, dir.offset)
+	if err != nil {
+		return nil, err
+	}
+	lr := io.LimitReader(mr, int64(dir.size-3))
+
+	var entries []squashfsDirEntry
+	for {
+		var header struct{ Count, Start, InodeNumber uint32 }
+		if err := binary.Read(lr, binary.LittleEndian, &header); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if header.Count >= 256 {
+			return nil, fmt.Errorf("corrupt directory listing")
+		}
+		for i := uint32(0); i <= header.Count; i++ {
+			var entry struct {
+				Offset      uint16
+				InodeOffset int16
+				Kind        uint16
+				NameSize    uint16
+			}
+			if err := binary.Read(lr, binary.LittleEndian, &entry); err != nil {
+				return nil, err
+			}
+			name := make([]byte, int(entry.NameSize)+1)
+			if _, err := io.ReadFull(lr, name); err != nil {
+				return nil, err
+			}
+			entries = append(entries, squashfsDirEntry{name: string(name), inode: uint64(header.Start)<<16 | uint64(entry.Offset)})
+		}
+	}
+}
+
+// lookup returns the inode at name, following symlinks, none of which may lead out of the image
+func (sq *squashfs) lookup(name string) (*squashfsInode, error) {
+	return sq.resolve(name, 0)
+}
+
+func (sq *squashfs) resolve(name string, depth int) (*squashfsInode, error) {
+	inode, err := sq.inode(sq.super.RootInodeRef)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(path.Clean("/"+name), "/")[1:]
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		entries, err := sq.readDir(inode)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, entry := range entries {
+			if entry.name == part {
+				if inode, err = sq.inode(entry.inode); err != nil {
+					return nil, err
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s: %w", name, errNotFound)
+		}
+		if inode.kind == squashfsSymlink || inode.kind == squashfsExtSymlink {
+			if depth >= squashfsMaxSymlinks {
+				return nil, fmt.Errorf("%s: too many levels of symbolic links", name)
+			}
+			// Absolute targets are taken as relative to the root of the image, as they would be once it is mounted
+			dest := inode.symlinkDest
+			if !path.IsAbs(dest) {
+				dest = path.Join(path.Join(parts[:i]...), dest)
+			}
+			return sq.resolve(path.Join(append([]string{dest}, parts[i+1:]...)...), depth+1)
+		}
+	}
+	return inode, nil
+}
+
+var (
+	errNotFound   = errors.New("no such file or directory")
+	errFileTooBig = errors.New("file too big")
+)
+
+// readFile returns the content of the regular file at name
+func (sq *squashfs) readFile(name string) ([]byte, error) {
+	inode, err := sq.lookup(name)
+	if errors.Is(err, errFileTooBig) {
+		return nil, fmt.Errorf("%s is too big", name)
+	} else if err != nil {
+		return nil, err
+	}
+	if inode.kind != squashfsFile && inode.kind != squashfsExtFile {
+		return nil, fmt.Errorf("%s is not a regular file", name)
+	}
+
+	data := make([]byte, 0, inode.size)
+	pos := inode.start
+	for _, blockSize := range inode.blockSizes {
+		size := blockSize &^ squashfsBlockUncompress
+		if size == 0 {
+			// Sparse block
+			data = append(data, make([]byte, min(uint64(sq.super.BlockSize), inode.size-uint64(len(data))))...)
+			continue
+		}
+		block, err := sq.block(pos, size, blockSize&squashfsBlockUncompress != 0)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, block...)
+		pos += uint64(size)
+	}
+
+	if uint64(len(data)) > inode.size {
+		return nil, fmt.Errorf("%s is corrupt", name)
+	}
+	if inode.fragment != squashfsNoFragment {
+		fragment, err := sq.fragment(inode.fragment)
+		if err != nil {
+			return nil, err
+		}
+		tail := inode.size - uint64(len(data))
+		if uint64(inode.offset)+tail > uint64(len(fragment)) {
+			return nil, fmt.Errorf("corrupt fragment")
+		}
+		data = append(data, fragment[inode.offset:uint64(inode.offset)+tail]...)
+	}
+	if uint64(len(data)) < inode.size {
+		return nil, fmt.Errorf("%s is truncated", name)
+	}
+	return data[:inode.size], nil
+}
+
+func (sq *squashfs) block(pos uint64, size uint32, uncompressed bool) ([]byte, error) {
+	// Blocks that would not get smaller are stored uncompressed, so none is bigger than the block size
+	if size > sq.super.BlockSize {
+		return nil, fmt.Errorf("corrupt data block at %d", pos)
+	}
+	data := make([]byte, size)
+	if _, err := sq.r.ReadAt(data, int64(pos)); err != nil {
+		return nil, err
+	}
+	if uncompressed {
+		return data, nil
+	}
+	return sq.decoder(data, int(sq.super.BlockSize))
+}
+
+// fragment returns the decompressed fragment block of the given index
+func (sq *squashfs) fragment(index uint32) ([]byte, error) {
+	if index >= sq.super.FragmentEntryCount {
+		return nil, fmt.Errorf("corrupt fragment index")
+	}
+	// The fragment table is a list of the positions of the metadata blocks that hold the entries, 512 per block
+	var location [8]byte
+	if _, err := sq.r.ReadAt(location[:], int64(sq.super.FragmentTableStart)+int64(index/512)*8); err != nil {
+		return nil, err
+	}
+	mr, err := sq.metadataReader(binary.LittleEndian.Uint64(location[:]), (index%512)*16)
+	if err != nil {
+		return nil, err
+	}
+	var entry struct {
+		Start  uint64
+		Size   uint32
+		Unused uint32
+	}
+	if err := binary.Read(mr, binary.LittleEndian, &entry); err != nil {
+		return nil, err
+	}
+	return sq.block(entry.Start, entry.Size&^squashfsBlockUncompress, entry.Size&squashfsBlockUncompress != 0)
+}
+
+// glob returns the paths of the regular files (or symlinks) within dir whose name matches pattern
+func (sq *squashfs) glob(dir, pattern string) ([]string, error) {
+	inode, err := sq.lookup(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := sq.readDir(inode)
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	for _, entry := range entries {
+		if ok, _ := path.Match(pattern, entry.name); ok {
+			matches = append(matches, path.Join(dir, entry.name))
+		}
+	}
+	return matches, nil
+}
@@ -0,0 +1,343 @@
+package integration
+
+import (
+	"bytes"
+	"compress/zlib"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/shamaton/msgpack/v2"
+)
+
+// squashfsBuilder writes small zlib-compressed SquashFS images, whose inode and directory tables fit within a single metadata block
+type squashfsBuilder struct {
+	data     bytes.Buffer // Everything that follows the superblock, up to the inode table
+	inodes   bytes.Buffer
+	dirs     bytes.Buffer
+	fragment bytes.Buffer // Tails of the files
+	count    uint32
+}
+
+type squashfsNode struct {
+	content  string
+	size     uint32 // Recorded in the inode instead of the length of the content, if set
+	symlink  string
+	children map[string]*squashfsNode
+}
+
+const testBlockSize = 4096
+
+func zlibCompress(data []byte) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	return buf.Bytes()
+}
+
+func put(buf *bytes.Buffer, data ...any) {
+	for _, d := range data {
+		binary.Write(buf, binary.LittleEndian, d)
+	}
+}
+
+func (b *squashfsBuilder) inodeHeader(kind uint16) {
+	b.count++
+	put(&b.inodes, kind, uint16(0755), uint16(0), uint16(0), uint32(0), b.count)
+}
+
+// add writes the inode of node (and, before it, those of its children), and returns its reference and type
+func (b *squashfsBuilder) add(node *squashfsNode) (uint64, uint16) {
+	switch {
+	case node.children != nil:
+		names := make([]string, 0, len(node.children))
+		for name := range node.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var listing bytes.Buffer
+		if len(names) > 0 {
+			binary.Write(&listing, binary.LittleEndian, []uint32{uint32(len(names) - 1), 0, b.count + 1})
+			for _, name := range names {
+				ref, kind := b.add(node.children[name])
+				put(&listing, uint16(ref), int16(0), kind, uint16(len(name)-1))
+				listing.WriteString(name)
+			}
+		}
+		offset := b.dirs.Len()
+		b.dirs.Write(listing.Bytes())
+		ref := uint64(b.inodes.Len())
+		b.inodeHeader(squashfsDir)
+		put(&b.inodes, uint32(0), uint32(2), uint16(listing.Len()+3), uint16(offset), uint32(0))
+		return ref, squashfsDir
+	case node.symlink != "":
+		ref := uint64(b.inodes.Len())
+		b.inodeHeader(squashfsSymlink)
+		binary.Write(&b.inodes, binary.LittleEndian, []uint32{1, uint32(len(node.symlink))})
+		b.inodes.WriteString(node.symlink)
+		return ref, squashfsSymlink
+	default:
+		// Whole blocks are compressed, the tail goes to the fragment
+		content := []byte(node.content)
+		start := uint32(96 + b.data.Len())
+		var sizes []uint32
+		for len(content) >= testBlockSize {
+			block := zlibCompress(content[:testBlockSize])
+			b.data.Write(block)
+			sizes = append(sizes, uint32(len(block)))
+			content = content[testBlockSize:]
+		}
+		fragment, offset := uint32(squashfsNoFragment), uint32(0)
+		if len(content) > 0 {
+			fragment, offset = 0, uint32(b.fragment.Len())
+			b.fragment.Write(content)
+		}
+		size := uint32(len(node.content))
+		if node.size != 0 {
+			size = node.size
+		}
+		ref := uint64(b.inodes.Len())
+		b.inodeHeader(squashfsFile)
+		binary.Write(&b.inodes, binary.LittleEndian, []uint32{start, fragment, offset, size})
+		binary.Write(&b.inodes, binary.LittleEndian, sizes)
+		return ref, squashfsFile
+	}
+}
+
+func buildSquashfs(root *squashfsNode) []byte {
+	b := &squashfsBuilder{}
+	rootRef, _ := b.add(root)
+
+	// The fragment block, followed by the metadata block that describes it
+	fragmentStart := uint64(96 + b.data.Len())
+	fragment := zlibCompress(b.fragment.Bytes())
+	b.data.Write(fragment)
+	fragmentEntries := uint64(96 + b.data.Len())
+	var entry bytes.Buffer
+	put(&entry, fragmentStart, uint32(len(fragment)), uint32(0))
+	binary.Write(&b.data, binary.LittleEndian, uint16(entry.Len())|squashfsUncompressed)
+	b.data.Write(entry.Bytes())
+
+	var image bytes.Buffer
+	inodes, dirs := zlibCompress(b.inodes.Bytes()), zlibCompress(b.dirs.Bytes())
+	inodeTable := uint64(96 + b.data.Len())
+	dirTable := inodeTable + 2 + uint64(len(inodes))
+	fragmentTable := dirTable + 2 + uint64(len(dirs))
+	binary.Write(&image, binary.LittleEndian, squashfsSuperblock{
+		Magic: squashfsMagic, InodeCount: b.count, BlockSize: testBlockSize, FragmentEntryCount: 1, CompressionID: 1, BlockLog: 12,
+		IDCount: 1, VersionMajor: 4, RootInodeRef: rootRef, BytesUsed: fragmentTable + 8, IDTableStart: fragmentTable,
+		XattrIDTableStart: ^uint64(0), InodeTableStart: inodeTable, DirectoryTableStart: dirTable, FragmentTableStart: fragmentTable,
+		ExportTableStart: ^uint64(0),
+	})
+	image.Write(b.data.Bytes())
+	binary.Write(&image, binary.LittleEndian, uint16(len(inodes)))
+	image.Write(inodes)
+	binary.Write(&image, binary.LittleEndian, uint16(len(dirs)))
+	image.Write(dirs)
+	binary.Write(&image, binary.LittleEndian, fragmentEntries)
+	return image.Bytes()
+}
+
+func testAppDir() *squashfsNode {
+	big := bytes.Repeat([]byte("0123456789abcdef"), 700) // Two whole blocks and a tail
+	return &squashfsNode{children: map[string]*squashfsNode{
+		".DirIcon":    {symlink: "usr/share/icons/app.png"},
+		"app.desktop": {symlink: "/usr/share/applications/app.desktop"},
+		"AppRun":      {content: "#!/bin/sh\n"},
+		"loop":        {symlink: "loop"},
+		"big":         {content: string(big)},
+		"usr":         {symlink: "./real-usr"},
+		"real-usr": {children: map[string]*squashfsNode{
+			"share": {children: map[string]*squashfsNode{
+				"icons":        {children: map[string]*squashfsNode{"app.png": {content: "\x89PNG\r\n\x1a\nicon"}}},
+				"applications": {children: map[string]*squashfsNode{"app.desktop": {content: "[Desktop Entry]\nName=App\n"}}},
+				"mime":         {children: map[string]*squashfsNode{"packages": {children: map[string]*squashfsNode{"app.xml": {content: "<mime-info/>"}}}}},
+			}},
+		}},
+	}}
+}
+
+func TestSquashfs(t *testing.T) {
+	image := buildSquashfs(testAppDir())
+	sq, err := openSquashfs(bytes.NewReader(image))
+	if err != nil {
+		t.Fatalf("openSquashfs failed: %v", err)
+	}
+
+	big, err := sq.readFile("big")
+	if err != nil || !bytes.Equal(big, bytes.Repeat([]byte("0123456789abcdef"), 700)) {
+		t.Errorf("Unexpected content of a file that spans several blocks and a fragment (err=%v)", err)
+	}
+	if _, err := sq.readFile("loop"); err == nil {
+		t.Errorf("Expected a symlink loop to fail")
+	}
+	if _, err := sq.readFile("missing"); err == nil {
+		t.Errorf("Expected a missing file to fail")
+	}
+
+	metadata := readAppDir(sq)
+	if string(metadata.PNG) != "\x89PNG\r\n\x1a\nicon" {
+		t.Errorf("Expected .DirIcon to be read through its symlink, got %q", metadata.PNG)
+	}
+	if string(metadata.Desktop) != "[Desktop Entry]\nName=App\n" {
+		t.Errorf("Expected the .desktop file to be read through its symlink, got %q", metadata.Desktop)
+	}
+	if len(metadata.MimeInfo) != 1 || string(metadata.MimeInfo[0]) != "<mime-info/>" {
+		t.Errorf("Expected the shared-mime-info package to be read, got %q", metadata.MimeInfo)
+	}
+}
+
+func TestSquashfsCorrupt(t *testing.T) {
+	image := buildSquashfs(testAppDir())
+	for _, tt := range []struct {
+		name      string
+		blockSize uint32
+		blockLog  uint16
+	}{
+		{"zero block size", 0, 0},
+		{"huge block size", 1 << 31, 31},
+		{"block size that is not a power of two", 5000, 12},
+		{"block size that does not match its log", 8192, 12},
+	} {
+		corrupt := bytes.Clone(image)
+		binary.LittleEndian.PutUint32(corrupt[12:], tt.blockSize)
+		binary.LittleEndian.PutUint16(corrupt[22:], tt.blockLog)
+		if _, err := openSquashfs(bytes.NewReader(corrupt)); err == nil {
+			t.Errorf("Expected an image with a %s to be refused", tt.name)
+		}
+	}
+
+	// Neither the list of block sizes of a huge file nor a fragment that expands beyond the block size may be read
+	sq, err := openSquashfs(bytes.NewReader(buildSquashfs(&squashfsNode{children: map[string]*squashfsNode{
+		"huge": {content: "tail", size: 0xFFFFFFFF},
+		"a":    {content: string(bytes.Repeat([]byte("a"), 3000))},
+		"b":    {content: string(bytes.Repeat([]byte("b"), 3000))},
+	}})))
+	if err != nil {
+		t.Fatalf("openSquashfs failed: %v", err)
+	}
+	if _, err := sq.readFile("huge"); err == nil {
+		t.Errorf("Expected a file whose inode claims 4GiB to be refused")
+	}
+	if _, err := sq.readFile("b"); !errors.Is(err, errTooLarge) {
+		t.Errorf("Expected a fragment bigger than the block size to be refused, got %v", err)
+	}
+
+	// Truncated tables must fail without panicking
+	for size := 96; size < len(image); size += 7 {
+		sq, err := openSquashfs(bytes.NewReader(image[:size]))
+		if err != nil {
+			t.Fatalf("openSquashfs failed on an image truncated to %d bytes: %v", size, err)
+		}
+		readAppDir(sq)
+		if _, err := sq.readFile("big"); err == nil {
+			t.Errorf("Expected reading a file of an image truncated to %d bytes to fail", size)
+		}
+	}
+}
+
+func TestExtractAppImage(t *testing.T) {
+	// Any ELF file whose section headers come last can stand in for the runtime
+	runtime, err := os.ReadFile("/bin/true")
+	if err != nil {
+		t.Skip("/bin/true is unavailable")
+	}
+	ef, err := elf.NewFile(bytes.NewReader(runtime))
+	if err != nil {
+		t.Skip("/bin/true is not an ELF file")
+	}
+	size, err := elfSize(bytes.NewReader(runtime), ef)
+	if err != nil || size > int64(len(runtime)) {
+		t.Skip("/bin/true does not end with its section headers")
+	}
+	runtime = runtime[:size]
+	copy(runtime[8:11], "AI\x02")
+
+	tmpDir, err := os.MkdirTemp("", "appimage-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "app.AppImage")
+	if err := os.WriteFile(path, append(runtime, buildSquashfs(testAppDir())...), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if format := SniffFormat(path); format != ".AppImage" {
+		t.Errorf("Expected the AppImage to be recognized, got %q", format)
+	}
+	metadata, err := extractAppImage(path)
+	if err != nil {
+		t.Fatalf("extractAppImage failed: %v", err)
+	}
+	if string(metadata.Desktop) != "[Desktop Entry]\nName=App\n" || len(metadata.PNG) == 0 {
+		t.Errorf("Unexpected metadata: %+v", metadata)
+	}
+}
+
+func TestReadAppBundle(t *testing.T) {
+	objcopy, err := exec.LookPath("objcopy")
+	if err != nil {
+		t.Skip("objcopy is unavailable")
+	}
+	tmpDir, err := os.MkdirTemp("", "appbundle-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// An AppBundle is a runtime that carries its runtime info in an ELF section, followed by its image
+	makeBundle := func(name, filesystemType string) string {
+		info, err := msgpack.Marshal(map[string]any{"AppBundleID": "app#github.com/owner/repo", "FilesystemType": filesystemType})
+		if err != nil {
+			t.Fatal(err)
+		}
+		infoPath, runtimePath := filepath.Join(tmpDir, "info"), filepath.Join(tmpDir, "runtime")
+		if err := os.WriteFile(infoPath, info, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if output, err := exec.Command(objcopy, "--add-section", ".pbundle_runtime_info="+infoPath, "/bin/true", runtimePath).CombinedOutput(); err != nil {
+			t.Skipf("objcopy failed: %v: %s", err, output)
+		}
+		runtime, err := os.ReadFile(runtimePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ef, err := elf.NewFile(bytes.NewReader(runtime))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size, err := elfSize(bytes.NewReader(runtime), ef)
+		if err != nil || size > int64(len(runtime)) {
+			t.Skip("The runtime does not end with its section headers")
+		}
+		path := filepath.Join(tmpDir, name)
+		if err := os.WriteFile(path, append(runtime[:size], buildSquashfs(testAppDir())...), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	bundle := makeBundle("app.AppBundle", "squashfs")
+	info, err := ReadRuntimeInfo(bundle)
+	if err != nil || info.AppBundleID != "app#github.com/owner/repo" {
+		t.Fatalf("Unexpected runtime info: %+v (err=%v)", info, err)
+	}
+	metadata, err := readAppBundle(bundle)
+	if err != nil {
+		t.Fatalf("readAppBundle failed: %v", err)
+	}
+	if string(metadata.Desktop) != "[Desktop Entry]\nName=App\n" || len(metadata.PNG) == 0 {
+		t.Errorf("Unexpected metadata: %+v", metadata)
+	}
+
+	if _, err := readAppBundle(makeBundle("dwarfs.AppBundle", "dwarfs")); err == nil {
+		t.Errorf("Expected an AppBundle whose image is DwarFS to fail")
+	}
+}
@@ -0,0 +1,112 @@
+package integration
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+	"github.com/xplshn/pelf/pkg/integration/freedesktop"
+)
+
+// The icons come from bundles that may have been crafted, so the biggest ones are refused before they are decoded
+const (
+	maxIconSide = 4096    // Pixels per side of a PNG icon
+	maxSVGSize  = 4 << 20 // Bytes of an SVG icon
+)
+
+// RasterizeSVG renders an SVG image within a transparent size*size square, keeping its aspect ratio
+func RasterizeSVG(data []byte, size int) (image.Image, error) {
+	if len(data) > maxSVGSize {
+		return nil, fmt.Errorf("the SVG image is too big (%d bytes)", len(data))
+	}
+	icon, err := oksvg.ReadIconStream(bytes.NewReader(data), oksvg.IgnoreErrorMode)
+	if err != nil {
+		return nil, err
+	}
+	if icon.ViewBox.W <= 0 || icon.ViewBox.H <= 0 {
+		return nil, fmt.Errorf("the SVG image has no viewBox")
+	}
+
+	// Keep the aspect ratio, centering the icon within the square
+	w, h := float64(size), float64(size)
+	if icon.ViewBox.W > icon.ViewBox.H {
+		h = w * icon.ViewBox.H / icon.ViewBox.W
+	} else {
+		w = h * icon.ViewBox.W / icon.ViewBox.H
+	}
+	icon.SetTarget((float64(size)-w)/2, (float64(size)-h)/2, w, h)
+
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	scanner := rasterx.NewScannerGV(size, size, img, img.Bounds())
+	icon.Draw(rasterx.NewDasher(size, size, scanner), 1)
+	return img, nil
+}
+
+// thumbnailIsStale reports whether the thumbnails of a bundle no longer match its modification time, or are missing
+func thumbnailIsStale(path string, entry *Entry) bool {
+	if (entry.Png == "" && entry.Svg == "") || isDirectory(path) {
+		return false
+	}
+	if entry.Thumbnail == "" || !fileExists(entry.Thumbnail) || entry.LargeThumbnail == "" || !fileExists(entry.LargeThumbnail) {
+		return true
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.ModTime().Unix() != entry.ThumbnailMTime
+}
+
+// loadIcon returns the PNG icon of the entry, falling back to its SVG icon rasterized at the size of the large thumbnails
+func loadIcon(entry *Entry) (image.Image, error) {
+	if entry.Png != "" {
+		if data, err := os.ReadFile(entry.Png); err == nil {
+			if img, err := decodePNG(data); err == nil {
+				return img, nil
+			}
+		}
+	}
+	if entry.Svg != "" {
+		data, err := os.ReadFile(entry.Svg)
+		if err != nil {
+			return nil, err
+		}
+		img, err := RasterizeSVG(data, freedesktop.ThumbnailSizes["large"])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", entry.Svg, err)
+		}
+		return img, nil
+	}
+	return nil, fmt.Errorf("no usable icon to make a thumbnail from")
+}
+
+// hicolorPNG scales a PNG icon down to the closest size of the hicolor theme, returning that size along with the scaled icon
+func hicolorPNG(data []byte) (int, []byte, error) {
+	img, err := decodePNG(data)
+	if err != nil {
+		return 0, nil, err
+	}
+	b := img.Bounds()
+	size := freedesktop.HicolorSize(b.Dx(), b.Dy())
+	if b.Dx() == size && b.Dy() == size {
+		return size, data, nil
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, freedesktop.ScaleToFit(img, size)); err != nil {
+		return 0, nil, err
+	}
+	return size, buf.Bytes(), nil
+}
+
+// decodePNG decodes a PNG icon, unless its header declares it bigger than maxIconSide, which would take too much memory to decode
+func decodePNG(data []byte) (image.Image, error) {
+	config, err := png.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width > maxIconSide || config.Height > maxIconSide {
+		return nil, fmt.Errorf("the PNG image is too big (%dx%d)", config.Width, config.Height)
+	}
+	return png.Decode(bytes.NewReader(data))
+}
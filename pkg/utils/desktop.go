@@ -1,67 +1,143 @@
 package utils
 
 import (
-	"bufio"
+	"errors"
+	"fmt"
 	"os"
+	"slices"
 	"strings"
 )
 
-// DesktopFile represents a parsed .desktop file
+// DesktopEntry is the group of a .desktop file that describes the application
+const DesktopEntry = "Desktop Entry"
+
+// DesktopFile represents a .desktop file, as per the Desktop Entry Specification.
+// It is edited line by line, so that the lines it doesn't change (comments and unknown lines included) are written back as they were.
 type DesktopFile struct {
+	// Sections holds the raw values (escapes included) of the keys of each group. Localized keys are kept as they are
+	// written, such as "Name[de]". It is kept up to date by SetValue and Delete, and must not be modified directly.
 	Sections map[string]map[string]string
+
+	lines          []string
+	noFinalNewline bool
 }
 
 // ParseDesktopFile parses a .desktop file from the given path.
 // It is designed to be robust and ignore lines that do not follow the key=value format,
-// such as placeholders or malformed entries, instead of failing.
+// such as placeholders or malformed entries, instead of failing. Validate reports them.
 func ParseDesktopFile(filePath string) (*DesktopFile, error) {
-	file, err := os.Open(filePath)
+	data, err := os.ReadFile(filePath)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	return ParseDesktop(data), nil
+}
 
-	df := &DesktopFile{
-		Sections: make(map[string]map[string]string),
+// ParseDesktop parses the content of a .desktop file.
+func ParseDesktop(data []byte) *DesktopFile {
+	df := &DesktopFile{}
+	if len(data) > 0 {
+		df.lines = strings.Split(string(data), "\n")
+		if df.lines[len(df.lines)-1] == "" {
+			df.lines = df.lines[:len(df.lines)-1]
+		} else {
+			df.noFinalNewline = true
+		}
 	}
+	df.index()
+	return df
+}
 
-	scanner := bufio.NewScanner(file)
-	currentSection := ""
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
+// parseDesktopLine tells what a line of a .desktop file is: a group header (returning its name), a key=value pair, or
+// anything else (a blank line, a comment, or a line that isn't understood)
+func parseDesktopLine(line string) (group, key, value string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", ""
+	}
+	if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+		return line[1 : len(line)-1], "", ""
+	}
+	// Lines without '=' are ignored (e.g., placeholders like @@EXTRA_DESKTOP_ENTRIES@@)
+	if key, value, ok := strings.Cut(line, "="); ok {
+		return "", strings.TrimSpace(key), strings.TrimSpace(value)
+	}
+	return "", "", ""
+}
+
+// index rebuilds Sections from the lines. The last occurrence of a duplicated key wins.
+func (df *DesktopFile) index() {
+	df.Sections = make(map[string]map[string]string)
+	current := ""
+	for _, line := range df.lines {
+		group, key, value := parseDesktopLine(line)
+		switch {
+		case group != "":
+			current = group
+			if df.Sections[current] == nil {
+				df.Sections[current] = make(map[string]string)
+			}
+		case key != "" && current != "":
+			df.Sections[current][key] = value
 		}
+	}
+}
 
-		// Check for section header [Section Name]
-		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
-			currentSection = line[1 : len(line)-1]
-			if df.Sections[currentSection] == nil {
-				df.Sections[currentSection] = make(map[string]string)
+// find returns the index of the last line of the key within group (-1 if it is missing),
+// and the index at which such a line would be inserted (-1 if the group is missing).
+func (df *DesktopFile) find(group, key string) (int, int) {
+	current, found, insertAt := "", -1, -1
+	for i, line := range df.lines {
+		g, k, _ := parseDesktopLine(line)
+		if g != "" {
+			current = g
+			if current == group && insertAt == -1 {
+				insertAt = i + 1
 			}
 			continue
 		}
-
-		if currentSection != "" {
-			// Find the first '=' character
-			idx := strings.Index(line, "=")
-			if idx != -1 {
-				key := strings.TrimSpace(line[:idx])
-				value := strings.TrimSpace(line[idx+1:])
-				df.Sections[currentSection][key] = value
+		if current != group {
+			continue
+		}
+		if k != "" {
+			if insertAt != -1 {
+				insertAt = i + 1
+			}
+			if k == key {
+				found = i
 			}
-			// Lines without '=' are ignored (e.g., placeholders like @@EXTRA_DESKTOP_ENTRIES@@)
 		}
 	}
+	return found, insertAt
+}
 
-	if err := scanner.Err(); err != nil {
-		return nil, err
+// Groups returns the names of the groups, in the order in which they appear.
+func (df *DesktopFile) Groups() []string {
+	var groups []string
+	for _, line := range df.lines {
+		if group, _, _ := parseDesktopLine(line); group != "" && !slices.Contains(groups, group) {
+			groups = append(groups, group)
+		}
 	}
+	return groups
+}
 
-	return df, nil
+// Keys returns the keys of a group, localized keys included, in the order in which they appear.
+func (df *DesktopFile) Keys(group string) []string {
+	var keys []string
+	current := ""
+	for _, line := range df.lines {
+		g, k, _ := parseDesktopLine(line)
+		if g != "" {
+			current = g
+		} else if k != "" && current == group && !slices.Contains(keys, k) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
 }
 
-// GetValue returns the value for a given key in a section.
+// GetValue returns the raw value for a given key in a section, escapes included.
 // Returns an empty string if the section or key does not exist.
 func (df *DesktopFile) GetValue(section, key string) string {
 	if s, ok := df.Sections[section]; ok {
@@ -69,3 +145,433 @@ func (df *DesktopFile) GetValue(section, key string) string {
 	}
 	return ""
 }
+
+// Value returns the value of a key of type string, with its escape sequences (\s, \n, \t, \r and \\) replaced.
+func (df *DesktopFile) Value(group, key string) string {
+	return unescapeDesktopValue(df.GetValue(group, key))
+}
+
+// LocaleValue returns the value of a key of type localestring, in the given locale (such as "de_DE.UTF-8@euro").
+// The value that matches the locale best is used, falling back to the unlocalized one, as per the specification.
+func (df *DesktopFile) LocaleValue(group, key, locale string) string {
+	return df.Value(group, df.localizedKey(group, key, locale))
+}
+
+// List returns the values of a key of type string(s), which are separated by semicolons.
+func (df *DesktopFile) List(group, key string) []string {
+	return splitDesktopList(df.GetValue(group, key))
+}
+
+// LocaleList returns the values of a localized key of type string(s), such as Keywords, in the given locale.
+func (df *DesktopFile) LocaleList(group, key, locale string) []string {
+	return df.List(group, df.localizedKey(group, key, locale))
+}
+
+// Bool returns the value of a key of type boolean. A missing key is false.
+func (df *DesktopFile) Bool(group, key string) bool {
+	return df.GetValue(group, key) == "true"
+}
+
+// localizedKey returns the key that holds the value of key in locale: the first one that exists among
+// key[lang_COUNTRY@MODIFIER], key[lang_COUNTRY], key[lang@MODIFIER], key[lang] and key.
+func (df *DesktopFile) localizedKey(group, key, locale string) string {
+	keys := df.Sections[group]
+	for _, candidate := range LocaleFallbacks(locale) {
+		if _, ok := keys[key+"["+candidate+"]"]; ok {
+			return key + "[" + candidate + "]"
+		}
+	}
+	return key
+}
+
+// LocaleFallbacks returns the locales to look translations up in, by order of preference, given a locale of the form
+// lang_COUNTRY.ENCODING@MODIFIER, where _COUNTRY, .ENCODING and @MODIFIER may be omitted. The encoding is not part of the match,
+// and the C and POSIX locales have no translations.
+func LocaleFallbacks(locale string) []string {
+	locale, modifier, _ := strings.Cut(locale, "@")
+	locale, _, _ = strings.Cut(locale, ".")
+	lang, country, _ := strings.Cut(locale, "_")
+	if lang == "" || lang == "C" || lang == "POSIX" {
+		return nil
+	}
+
+	var candidates []string
+	if country != "" && modifier != "" {
+		candidates = append(candidates, lang+"_"+country+"@"+modifier)
+	}
+	if country != "" {
+		candidates = append(candidates, lang+"_"+country)
+	}
+	if modifier != "" {
+		candidates = append(candidates, lang+"@"+modifier)
+	}
+	return append(candidates, lang)
+}
+
+// CurrentLocale returns the locale that messages are shown in, as set by LC_ALL, LC_MESSAGES or LANG.
+func CurrentLocale() string {
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if locale := os.Getenv(name); locale != "" {
+			return locale
+		}
+	}
+	return ""
+}
+
+// SetValue sets the raw value of a key in a group, creating either if needed. Keys that are added go after the last key of the group.
+func (df *DesktopFile) SetValue(group, key, value string) {
+	i, insertAt := df.find(group, key)
+	switch {
+	case i != -1:
+		df.lines[i] = key + "=" + value
+	case insertAt != -1:
+		df.lines = append(df.lines[:insertAt], append([]string{key + "=" + value}, df.lines[insertAt:]...)...)
+	default:
+		if len(df.lines) > 0 && strings.TrimSpace(df.lines[len(df.lines)-1]) != "" {
+			df.lines = append(df.lines, "")
+		}
+		df.lines = append(df.lines, "["+group+"]", key+"="+value)
+	}
+	df.index()
+}
+
+// SetString sets the value of a key of type string or localestring, escaping it as needed.
+func (df *DesktopFile) SetString(group, key, value string) {
+	df.SetValue(group, key, escapeDesktopValue(value))
+}
+
+// SetList sets the values of a key of type string(s), escaping them as needed.
+func (df *DesktopFile) SetList(group, key string, values []string) {
+	var value strings.Builder
+	for _, v := range values {
+		value.WriteString(strings.ReplaceAll(escapeDesktopValue(v), ";", `\;`) + ";")
+	}
+	df.SetValue(group, key, value.String())
+}
+
+// Delete removes a key from a group. Every occurrence of the key is removed, if it is duplicated.
+func (df *DesktopFile) Delete(group, key string) {
+	for i, _ := df.find(group, key); i != -1; i, _ = df.find(group, key) {
+		df.lines = append(df.lines[:i], df.lines[i+1:]...)
+	}
+	df.index()
+}
+
+// Bytes returns the content of the file. A file that was parsed and not modified is returned as it was.
+func (df *DesktopFile) Bytes() []byte {
+	content := strings.Join(df.lines, "\n")
+	if content != "" && !df.noFinalNewline {
+		content += "\n"
+	}
+	return []byte(content)
+}
+
+// Write saves the file to filePath (see WriteFileAtomic).
+func (df *DesktopFile) Write(filePath string) error {
+	return WriteFileAtomic(filePath, df.Bytes(), 0644)
+}
+
+// MimeTypes returns the MIME types (URL schemes included, as x-scheme-handler/<scheme>) that the application can handle.
+func (df *DesktopFile) MimeTypes() []string {
+	var mimeTypes []string
+	for _, mimeType := range df.List(DesktopEntry, "MimeType") {
+		if mimeType = strings.TrimSpace(mimeType); mimeType != "" {
+			mimeTypes = append(mimeTypes, mimeType)
+		}
+	}
+	return mimeTypes
+}
+
+// Keys of type boolean, whose value must be either "true" or "false"
+var desktopBoolKeys = []string{"NoDisplay", "Hidden", "DBusActivatable", "Terminal", "StartupNotify", "PrefersNonDefaultGPU", "SingleMainWindow"}
+
+// Validate checks the file against the specification: its syntax, and the keys that are required or must hold a given type.
+// It returns every problem found, joined, or nil if there are none.
+func (df *DesktopFile) Validate() error {
+	var errs []error
+	current := ""
+	seen := make(map[string]map[string]bool)
+	for i, line := range df.lines {
+		group, key, _ := parseDesktopLine(line)
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+		case group != "":
+			if current == "" && group != DesktopEntry {
+				errs = append(errs, fmt.Errorf("line %d: the first group must be [%s], not [%s]", i+1, DesktopEntry, group))
+			}
+			if seen[group] != nil {
+				errs = append(errs, fmt.Errorf("line %d: duplicate group [%s]", i+1, group))
+			}
+			current = group
+			seen[group] = make(map[string]bool)
+		case current == "":
+			errs = append(errs, fmt.Errorf("line %d: %q is outside of any group", i+1, trimmed))
+		case key == "":
+			errs = append(errs, fmt.Errorf("line %d: %q is not a key=value pair", i+1, trimmed))
+		case !validDesktopKey(key):
+			errs = append(errs, fmt.Errorf("line %d: invalid key %q", i+1, key))
+		case seen[current][key]:
+			errs = append(errs, fmt.Errorf("line %d: duplicate key %s in [%s]", i+1, key, current))
+		default:
+			seen[current][key] = true
+		}
+	}
+
+	if df.Sections[DesktopEntry] == nil {
+		return errors.Join(append(errs, fmt.Errorf("missing the [%s] group", DesktopEntry))...)
+	}
+	switch kind := df.Value(DesktopEntry, "Type"); kind {
+	case "":
+		errs = append(errs, errors.New("missing the required key Type"))
+	case "Application":
+		if df.GetValue(DesktopEntry, "Exec") == "" && !df.Bool(DesktopEntry, "DBusActivatable") {
+			errs = append(errs, errors.New("missing the key Exec, which is required by applications that aren't DBusActivatable"))
+		}
+	case "Link":
+		if df.GetValue(DesktopEntry, "URL") == "" {
+			errs = append(errs, errors.New("missing the key URL, which is required by links"))
+		}
+	case "Directory":
+	default:
+		if !strings.HasPrefix(kind, "X-") {
+			errs = append(errs, fmt.Errorf("unknown Type %q", kind))
+		}
+	}
+	if df.GetValue(DesktopEntry, "Name") == "" {
+		errs = append(errs, errors.New("missing the required key Name"))
+	}
+	for _, key := range desktopBoolKeys {
+		if value, ok := df.Sections[DesktopEntry][key]; ok && value != "true" && value != "false" {
+			errs = append(errs, fmt.Errorf("%s must be true or false, not %q", key, value))
+		}
+	}
+
+	groups := []string{DesktopEntry}
+	for _, action := range df.List(DesktopEntry, "Actions") {
+		group := "Desktop Action " + action
+		if df.Sections[group] == nil {
+			errs = append(errs, fmt.Errorf("missing the [%s] group of the action %s", group, action))
+			continue
+		}
+		if df.GetValue(group, "Name") == "" {
+			errs = append(errs, fmt.Errorf("missing the required key Name in [%s]", group))
+		}
+		groups = append(groups, group)
+	}
+	for _, group := range groups {
+		if exec, ok := df.Sections[group]["Exec"]; ok {
+			if _, err := ParseExec(unescapeDesktopValue(exec)); err != nil {
+				errs = append(errs, fmt.Errorf("invalid Exec in [%s]: %w", group, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validDesktopKey checks that a key is made of A-Za-z0-9-, optionally followed by a locale, such as Name[sr_YU@Latn]
+func validDesktopKey(key string) bool {
+	name, locale, localized := strings.Cut(key, "[")
+	if localized {
+		if !strings.HasSuffix(locale, "]") || len(locale) < 2 {
+			return false
+		}
+		for _, r := range locale[:len(locale)-1] {
+			if !isAlnum(r) && !strings.ContainsRune("_@.-", r) {
+				return false
+			}
+		}
+	}
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !isAlnum(r) && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+func isAlnum(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9'
+}
+
+// escapeDesktopValue escapes a string value: backslashes, newlines, tabs and carriage returns, along with the spaces that
+// would otherwise be trimmed, at either end
+func escapeDesktopValue(value string) string {
+	value = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\t", `\t`, "\r", `\r`).Replace(value)
+	if strings.HasPrefix(value, " ") {
+		value = `\s` + value[1:]
+	}
+	if strings.HasSuffix(value, " ") {
+		value = value[:len(value)-1] + `\s`
+	}
+	return value
+}
+
+// unescapeDesktopValue replaces the escape sequences of a string value. Unknown sequences are kept as they are.
+func unescapeDesktopValue(value string) string {
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' || i+1 == len(value) {
+			b.WriteByte(value[i])
+			continue
+		}
+		i++
+		switch value[i] {
+		case 's':
+			b.WriteByte(' ')
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case '\\':
+			b.WriteByte('\\')
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(value[i])
+		}
+	}
+	return b.String()
+}
+
+// splitDesktopList splits a raw value of type string(s) at its unescaped semicolons, and unescapes the values. Empty values,
+// such as the one that follows the trailing semicolon, are left out.
+func splitDesktopList(value string) []string {
+	var values []string
+	var b strings.Builder
+	for i := 0; i <= len(value); i++ {
+		switch {
+		case i == len(value) || value[i] == ';':
+			if b.Len() > 0 {
+				values = append(values, unescapeDesktopValue(b.String()))
+			}
+			b.Reset()
+		case value[i] == '\\' && i+1 < len(value) && value[i+1] == ';':
+			b.WriteByte(';')
+			i++
+		case value[i] == '\\' && i+1 < len(value):
+			b.WriteString(value[i : i+2])
+			i++
+		default:
+			b.WriteByte(value[i])
+		}
+	}
+	return values
+}
+
+// ParseExec splits the (unescaped) value of an Exec key into the program and its arguments, as per the quoting rules of the
+// specification: within double quotes, ", `, $ and \ are escaped by a backslash. Field codes, such as %f or %U, are left
+// as they are, for ExpandExec to replace.
+func ParseExec(value string) ([]string, error) {
+	var args []string
+	var b strings.Builder
+	inArg, quoted := false, false
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case quoted && c == '\\' && i+1 < len(value) && strings.IndexByte("\"`$\\", value[i+1]) != -1:
+			i++
+			b.WriteByte(value[i])
+		case quoted && c == '"':
+			quoted = false
+		case quoted:
+			b.WriteByte(c)
+		case c == '"':
+			quoted, inArg = true, true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, b.String())
+				b.Reset()
+				inArg = false
+			}
+		default:
+			b.WriteByte(c)
+			inArg = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote in %q", value)
+	}
+	if inArg {
+		args = append(args, b.String())
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty Exec")
+	}
+	return args, nil
+}
+
+// ExecFields is what the field codes of an Exec key expand to
+type ExecFields struct {
+	Files    []string // %f (the first of them) and %F
+	URLs     []string // %u (the first of them) and %U. Files are used if there are none, as they are valid URLs too
+	Icon     string   // %i, which expands to "--icon <Icon>"
+	Name     string   // %c, the localized Name of the application
+	Location string   // %k, the location of the .desktop file
+}
+
+// ExpandExec replaces the field codes of the arguments returned by ParseExec. Deprecated and unknown field codes are removed,
+// as are the arguments that were only made of field codes that expanded to nothing.
+func ExpandExec(args []string, fields ExecFields) []string {
+	urls := fields.URLs
+	if len(urls) == 0 {
+		urls = fields.Files
+	}
+	first := func(values []string) string {
+		if len(values) == 0 {
+			return ""
+		}
+		return values[0]
+	}
+
+	var expanded []string
+	for _, arg := range args {
+		switch arg {
+		case "%F":
+			expanded = append(expanded, fields.Files...)
+			continue
+		case "%U":
+			expanded = append(expanded, urls...)
+			continue
+		case "%i":
+			if fields.Icon != "" {
+				expanded = append(expanded, "--icon", fields.Icon)
+			}
+			continue
+		}
+
+		var b strings.Builder
+		hadCode := false
+		for i := 0; i < len(arg); i++ {
+			if arg[i] != '%' || i+1 == len(arg) {
+				b.WriteByte(arg[i])
+				continue
+			}
+			i++
+			hadCode = true
+			switch arg[i] {
+			case '%':
+				b.WriteByte('%')
+			case 'f':
+				b.WriteString(first(fields.Files))
+			case 'u':
+				b.WriteString(first(urls))
+			case 'c':
+				b.WriteString(fields.Name)
+			case 'k':
+				b.WriteString(fields.Location)
+			}
+		}
+		if b.Len() > 0 || !hadCode {
+			expanded = append(expanded, b.String())
+		}
+	}
+	return expanded
+}
@@ -3,6 +3,8 @@ package utils
 import (
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -52,3 +54,225 @@ Exec=chromium-browser`
 		t.Errorf("Expected Name=New Window in section Desktop Action new-window, got %s", df.GetValue("Desktop Action new-window", "Name"))
 	}
 }
+
+func TestDesktopFileRoundTrip(t *testing.T) {
+	content := `# Written by hand
+[Desktop Entry]
+Type=Application
+Name=Editor
+Name[de]=Bearbeiter
+# The program
+Exec=editor %F
+  Icon = editor
+@@EXTRA_DESKTOP_ENTRIES@@
+
+[Desktop Action new-window]
+Name=New Window
+Exec=editor --new-window
+`
+	df := ParseDesktop([]byte(content))
+	if string(df.Bytes()) != content {
+		t.Fatalf("Expected the file to be written back as it was, got:\n%s", df.Bytes())
+	}
+	if df.GetValue(DesktopEntry, "Icon") != "editor" {
+		t.Errorf("Expected Icon=editor, got %s", df.GetValue(DesktopEntry, "Icon"))
+	}
+	if groups := df.Groups(); !reflect.DeepEqual(groups, []string{DesktopEntry, "Desktop Action new-window"}) {
+		t.Errorf("Unexpected groups %q", groups)
+	}
+	if keys := df.Keys(DesktopEntry); !reflect.DeepEqual(keys, []string{"Type", "Name", "Name[de]", "Exec", "Icon"}) {
+		t.Errorf("Unexpected keys %q", keys)
+	}
+
+	df.SetValue(DesktopEntry, "Exec", "other %F")
+	df.SetString(DesktopEntry, "Comment", "Edits text")
+	df.SetValue("Desktop Action new-window", "Icon", "new")
+	df.SetList("X-Extra", "Keywords", []string{"a;b", "c"})
+	df.Delete(DesktopEntry, "Name[de]")
+	expected := `# Written by hand
+[Desktop Entry]
+Type=Application
+Name=Editor
+# The program
+Exec=other %F
+  Icon = editor
+Comment=Edits text
+@@EXTRA_DESKTOP_ENTRIES@@
+
+[Desktop Action new-window]
+Name=New Window
+Exec=editor --new-window
+Icon=new
+
+[X-Extra]
+Keywords=a\;b;c;
+`
+	if string(df.Bytes()) != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, df.Bytes())
+	}
+	if df.GetValue(DesktopEntry, "Name[de]") != "" || df.GetValue("X-Extra", "Keywords") != `a\;b;c;` {
+		t.Errorf("Sections is out of date: %v", df.Sections)
+	}
+
+	// No final newline is added, if there was none
+	if data := ParseDesktop([]byte("[Desktop Entry]\nName=A")).Bytes(); string(data) != "[Desktop Entry]\nName=A" {
+		t.Errorf("Expected no final newline, got %q", data)
+	}
+}
+
+func TestDesktopFileLocale(t *testing.T) {
+	df := ParseDesktop([]byte(`[Desktop Entry]
+Name=Color
+Name[en_GB]=Colour
+Name[sr]=Boja
+Name[sr@Latn]=Boja (Latn)
+Name[sr_YU@Latn]=Boja (YU)
+Keywords=paint;draw;
+Keywords[de]=malen;zeichnen;
+`))
+	tests := []struct {
+		locale, name string
+	}{
+		{"", "Color"},
+		{"C", "Color"},
+		{"en_GB.UTF-8", "Colour"},
+		{"en_US", "Color"},
+		{"sr_YU@Latn", "Boja (YU)"},
+		{"sr_RS@Latn", "Boja (Latn)"},
+		{"sr_RS", "Boja"},
+		{"sr.UTF-8@Latn", "Boja (Latn)"},
+	}
+	for _, tt := range tests {
+		if name := df.LocaleValue(DesktopEntry, "Name", tt.locale); name != tt.name {
+			t.Errorf("LocaleValue(%q) = %q, expected %q", tt.locale, name, tt.name)
+		}
+	}
+	if keywords := df.LocaleList(DesktopEntry, "Keywords", "de_AT"); !reflect.DeepEqual(keywords, []string{"malen", "zeichnen"}) {
+		t.Errorf("Unexpected keywords %q", keywords)
+	}
+}
+
+func TestDesktopFileEscapes(t *testing.T) {
+	df := ParseDesktop([]byte(`[Desktop Entry]
+Comment=\sLine one\nLine\ttwo\\ \x
+MimeType=text/plain;x-scheme-handler/a\;b;;image/png
+`))
+	if comment := df.Value(DesktopEntry, "Comment"); comment != " Line one\nLine\ttwo\\ \\x" {
+		t.Errorf("Unexpected comment %q", comment)
+	}
+	if mimeTypes := df.MimeTypes(); !reflect.DeepEqual(mimeTypes, []string{"text/plain", "x-scheme-handler/a;b", "image/png"}) {
+		t.Errorf("Unexpected MIME types %q", mimeTypes)
+	}
+
+	for _, value := range []string{" leading", "trailing ", "back\\slash\nnewline\ttab\rreturn", "\\s"} {
+		df.SetString(DesktopEntry, "X-Value", value)
+		if got := df.Value(DesktopEntry, "X-Value"); got != value {
+			t.Errorf("%q was written as %q, and read back as %q", value, df.GetValue(DesktopEntry, "X-Value"), got)
+		}
+	}
+	values := []string{"a;b", " c", "d\\"}
+	df.SetList(DesktopEntry, "X-List", values)
+	if got := df.List(DesktopEntry, "X-List"); !reflect.DeepEqual(got, values) {
+		t.Errorf("%q was written as %q, and read back as %q", values, df.GetValue(DesktopEntry, "X-List"), got)
+	}
+}
+
+func TestDesktopFileValidate(t *testing.T) {
+	tests := []struct {
+		content string
+		errs    []string
+	}{
+		{"[Desktop Entry]\nType=Application\nName=A\nExec=a %U\n", nil},
+		{"[Desktop Entry]\nType=Application\nName=A\nDBusActivatable=true\n", nil},
+		{"[Desktop Entry]\nType=Link\nName=A\nURL=https://example.com\n", nil},
+		{"[Desktop Entry]\nType=Application\n", []string{"Name", "Exec"}},
+		{"[Desktop Entry]\nName=A\n", []string{"Type"}},
+		{"[Desktop Entry]\nType=Link\nName=A\n", []string{"URL"}},
+		{"[Desktop Entry]\nType=Program\nName=A\n", []string{"unknown Type"}},
+		{"[Other]\nName=A\n[Desktop Entry]\nType=Directory\nName=A\n", []string{"first group"}},
+		{"Name=A\n[Desktop Entry]\nType=Directory\nName=A\n", []string{"outside of any group"}},
+		{"[Desktop Entry]\nType=Directory\nName=A\nName=B\n", []string{"duplicate key"}},
+		{"[Desktop Entry]\nType=Directory\nName=A\n[Desktop Entry]\n", []string{"duplicate group"}},
+		{"[Desktop Entry]\nType=Directory\nName=A\nName[de=B\nX_Key=C\n", []string{"Name[de", "X_Key"}},
+		{"[Desktop Entry]\nType=Directory\nName=A\n@@PLACEHOLDER@@\n", []string{"not a key=value pair"}},
+		{"[Desktop Entry]\nType=Application\nName=A\nExec=a\nTerminal=yes\n", []string{"Terminal"}},
+		{"[Desktop Entry]\nType=Application\nName=A\nExec=\"a\n", []string{"unterminated quote"}},
+		{"[Desktop Entry]\nType=Application\nName=A\nExec=a\nActions=new;gone;\n[Desktop Action new]\nExec=a --new\n", []string{"Name in [Desktop Action new]", "action gone"}},
+		{"# Nothing\n", []string{"missing the [Desktop Entry] group"}},
+	}
+	for _, tt := range tests {
+		err := ParseDesktop([]byte(tt.content)).Validate()
+		if len(tt.errs) == 0 && err != nil {
+			t.Errorf("Expected %q to be valid, got: %v", tt.content, err)
+		}
+		if len(tt.errs) > 0 && err == nil {
+			t.Errorf("Expected %q to be invalid", tt.content)
+			continue
+		}
+		for _, e := range tt.errs {
+			if !strings.Contains(err.Error(), e) {
+				t.Errorf("Expected the errors of %q to mention %q, got: %v", tt.content, e, err)
+			}
+		}
+	}
+}
+
+func TestParseExec(t *testing.T) {
+	tests := []struct {
+		exec string
+		args []string
+	}{
+		{"app", []string{"app"}},
+		{"app  --flag %U", []string{"app", "--flag", "%U"}},
+		{`"/opt/My App/app" %f`, []string{"/opt/My App/app", "%f"}},
+		{`sh -c "echo \"\$HOME\" \\\\ \\x"`, []string{"sh", "-c", `echo "$HOME" \\ \x`}},
+		{`app ""`, []string{"app", ""}},
+		{`app --name=%c 100%%`, []string{"app", "--name=%c", "100%%"}},
+	}
+	for _, tt := range tests {
+		args, err := ParseExec(tt.exec)
+		if err != nil || !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("ParseExec(%q) = %q, %v, expected %q", tt.exec, args, err, tt.args)
+		}
+	}
+	for _, exec := range []string{"", "  ", `app "unterminated`} {
+		if _, err := ParseExec(exec); err == nil {
+			t.Errorf("Expected ParseExec(%q) to fail", exec)
+		}
+	}
+
+	// Exec values are escaped as strings first, so that backslashes within quotes are doubled
+	df := ParseDesktop([]byte(`[Desktop Entry]
+Exec="/opt/a\\\\b/app" %F
+`))
+	if args, err := ParseExec(df.Value(DesktopEntry, "Exec")); err != nil || !reflect.DeepEqual(args, []string{`/opt/a\b/app`, "%F"}) {
+		t.Errorf("Unexpected arguments %q (%v)", args, err)
+	}
+}
+
+func TestExpandExec(t *testing.T) {
+	fields := ExecFields{
+		Files:    []string{"/a b", "/c"},
+		Icon:     "app",
+		Name:     "App",
+		Location: "/usr/share/applications/app.desktop",
+	}
+	tests := []struct {
+		args     []string
+		fields   ExecFields
+		expanded []string
+	}{
+		{[]string{"app", "%F"}, fields, []string{"app", "/a b", "/c"}},
+		{[]string{"app", "%f"}, fields, []string{"app", "/a b"}},
+		{[]string{"app", "%U"}, ExecFields{URLs: []string{"https://a"}}, []string{"app", "https://a"}},
+		{[]string{"app", "%u"}, fields, []string{"app", "/a b"}},
+		{[]string{"app", "%i", "--name=%c", "%k"}, fields, []string{"app", "--icon", "app", "--name=App", fields.Location}},
+		{[]string{"app", "%f", "%F", "%i", "%d", "%m"}, ExecFields{}, []string{"app"}},
+		{[]string{"app", "100%%", "%%", ""}, ExecFields{}, []string{"app", "100%", "%", ""}},
+	}
+	for _, tt := range tests {
+		if expanded := ExpandExec(tt.args, tt.fields); !reflect.DeepEqual(expanded, tt.expanded) {
+			t.Errorf("ExpandExec(%q) = %q, expected %q", tt.args, expanded, tt.expanded)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// DefaultApplications is the section of mimeapps.list that holds the default application of each MIME type
+const DefaultApplications = "Default Applications"
+
+// MimeApps represents a mimeapps.list file.
+// It is edited line by line, so that the lines it doesn't change (comments included) are written back as they were.
+type MimeApps struct {
+	lines []string
+}
+
+// ParseMimeApps parses a mimeapps.list file. A file that does not exist yields an empty MimeApps.
+func ParseMimeApps(filePath string) (*MimeApps, error) {
+	ma := &MimeApps{}
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return ma, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		ma.lines = append(ma.lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ma, nil
+}
+
+// find returns the index of the line of the key within section (-1 if it is missing),
+// and the index at which such a line would be inserted (-1 if the section is missing).
+func (ma *MimeApps) find(section, key string) (int, int) {
+	current, insertAt := "", -1
+	for i, line := range ma.lines {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			current = line[1 : len(line)-1]
+			if current == section {
+				insertAt = i + 1
+			}
+			continue
+		}
+		if current != section {
+			continue
+		}
+		if line != "" && !strings.HasPrefix(line, "#") {
+			insertAt = i + 1
+		}
+		if k, _, ok := strings.Cut(line, "="); ok && strings.TrimSpace(k) == key {
+			return i, insertAt
+		}
+	}
+	return -1, insertAt
+}
+
+// GetValue returns the value for a given key in a section.
+// Returns an empty string if the section or key does not exist.
+func (ma *MimeApps) GetValue(section, key string) string {
+	i, _ := ma.find(section, key)
+	if i == -1 {
+		return ""
+	}
+	_, value, _ := strings.Cut(ma.lines[i], "=")
+	return strings.TrimSpace(value)
+}
+
+// SetValue sets the value of a key in a section, creating either if needed. An empty value removes the key.
+func (ma *MimeApps) SetValue(section, key, value string) {
+	i, insertAt := ma.find(section, key)
+	switch {
+	case i != -1 && value == "":
+		ma.lines = append(ma.lines[:i], ma.lines[i+1:]...)
+	case i != -1:
+		ma.lines[i] = key + "=" + value
+	case value == "":
+	case insertAt != -1:
+		ma.lines = append(ma.lines[:insertAt], append([]string{key + "=" + value}, ma.lines[insertAt:]...)...)
+	default:
+		if len(ma.lines) > 0 && strings.TrimSpace(ma.lines[len(ma.lines)-1]) != "" {
+			ma.lines = append(ma.lines, "")
+		}
+		ma.lines = append(ma.lines, "["+section+"]", key+"="+value)
+	}
+}
+
+// SetDefault makes desktopID the default application for mimeType, and returns the value that it replaced.
+func (ma *MimeApps) SetDefault(mimeType, desktopID string) string {
+	previous := ma.GetValue(DefaultApplications, mimeType)
+	ma.SetValue(DefaultApplications, mimeType, desktopID)
+	return previous
+}
+
+// RestoreDefault undoes SetDefault, given the value that it returned.
+// Nothing is done if desktopID is no longer the default, since the user chose another application in the meantime.
+func (ma *MimeApps) RestoreDefault(mimeType, desktopID, previous string) {
+	current, _, _ := strings.Cut(ma.GetValue(DefaultApplications, mimeType), ";")
+	if current == desktopID {
+		ma.SetValue(DefaultApplications, mimeType, previous)
+	}
+}
+
+// Write saves the file, replacing it atomically.
+func (ma *MimeApps) Write(filePath string) error {
+	content := strings.Join(ma.lines, "\n")
+	if content != "" {
+		content += "\n"
+	}
+	return WriteFileAtomic(filePath, []byte(content), 0644)
+}
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMimeApps(t *testing.T) {
+	content := `# Edited by hand
+[Added Associations]
+text/plain=gedit.desktop;
+
+[Default Applications]
+text/plain=gedit.desktop
+x-scheme-handler/http=firefox.desktop;chromium.desktop;
+`
+
+	tmpDir, err := os.MkdirTemp("", "mimeapps-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "mimeapps.list")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ma, err := ParseMimeApps(path)
+	if err != nil {
+		t.Fatalf("ParseMimeApps failed: %v", err)
+	}
+
+	if previous := ma.SetDefault("x-scheme-handler/http", "app.desktop"); previous != "firefox.desktop;chromium.desktop;" {
+		t.Errorf("Expected the previous default to be firefox.desktop;chromium.desktop;, got %s", previous)
+	}
+	if previous := ma.SetDefault("image/png", "app.desktop"); previous != "" {
+		t.Errorf("Expected no previous default for image/png, got %s", previous)
+	}
+	if ma.GetValue(DefaultApplications, "image/png") != "app.desktop" {
+		t.Errorf("Expected image/png=app.desktop, got %s", ma.GetValue(DefaultApplications, "image/png"))
+	}
+	// Must not be confused with the key of the same name in [Added Associations]
+	if ma.GetValue("Added Associations", "text/plain") != "gedit.desktop;" {
+		t.Errorf("Expected [Added Associations] to be left alone, got text/plain=%s", ma.GetValue("Added Associations", "text/plain"))
+	}
+
+	// The user picked another application in the meantime, which must be kept
+	ma.SetValue(DefaultApplications, "image/png", "gimp.desktop")
+
+	ma.RestoreDefault("x-scheme-handler/http", "app.desktop", "firefox.desktop;chromium.desktop;")
+	ma.RestoreDefault("image/png", "app.desktop", "")
+	if err := ma.Write(path); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	written, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `# Edited by hand
+[Added Associations]
+text/plain=gedit.desktop;
+
+[Default Applications]
+text/plain=gedit.desktop
+x-scheme-handler/http=firefox.desktop;chromium.desktop;
+image/png=gimp.desktop
+`
+	if string(written) != expected {
+		t.Errorf("Unexpected content after restoring the defaults:\n%s\nexpected:\n%s", written, expected)
+	}
+}
+
+func TestMimeAppsNewFile(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "mimeapps-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "config", "mimeapps.list")
+	ma, err := ParseMimeApps(path)
+	if err != nil {
+		t.Fatalf("ParseMimeApps failed on a missing file: %v", err)
+	}
+	ma.SetDefault("text/plain", "app.desktop")
+	ma.RestoreDefault("text/plain", "app.desktop", "")
+	ma.SetDefault("image/png", "app.desktop")
+	if err := ma.Write(path); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	written, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "[Default Applications]\nimage/png=app.desktop\n"; string(written) != expected {
+		t.Errorf("Expected %q, got %q", expected, written)
+	}
+}
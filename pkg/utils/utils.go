@@ -1,10 +1,14 @@
 package utils
 
 import (
+	"cmp"
 	"fmt"
 	"io/fs"
+	"net/url"
+	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
 	"time"
 )
@@ -61,6 +65,47 @@ func FindFiles(fsys fs.FS, dir string, walkDepth uint, globs []string) (string,
 	return foundPath, nil
 }
 
+// WriteFileAtomic replaces the file at path by one holding data, creating its directory if needed. The data is written to a
+// temporary file of its own within that directory and renamed over path, so that readers and crashes see either the old file
+// or the new one, never a truncated one, and concurrent writers never share a temporary file
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name()) // Fails once renamed
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Chmod(perm); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return err
+	}
+
+	// Make the rename itself durable
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
 // IsRepo returns true if the string contains both a dot (.) and a slash (/)
 func IsRepo(s string) bool {
 	return strings.Contains(s, ".") && strings.Contains(s, "/")
@@ -69,6 +114,18 @@ func IsRepo(s string) bool {
 // --- AppBundleID-related code ---
 
 // AppBundleID format types
+//
+// The fields of an AppBundleID are canonicalized when parsed: the slashes of the repo become dots, the hyphens of the version
+// become underscores, and dates are formatted as YYYYMMDD, whichever of the supported layouts they were written in. Format
+// writes the canonical form, and Raw keeps the AppBundleID as it was written.
+//
+// Type I AppBundleIDs are meant for file names, and their fields are separated by hyphens, of which names may hold any.
+// Their other fields are escaped as in URLs, with '%' followed by two hexadecimal digits: hyphens and slashes are written
+// as %2D and %2F (the slashes of names included, so that they make a single file name), and a version that would be read
+// as a date has its first character escaped, such as %320240101 for version 20240101. '%' can't be part of a field, so
+// escapes are unambiguous. A type I AppBundleID holds either a date or a version, the date being kept if there are both.
+// Its version has to start with a digit, or with a 'v' followed by one, so that names such as google-chrome-stable aren't
+// taken for AppBundleIDs: the first character of other versions is escaped as well, such as %6Eightly for version nightly.
 const (
 	TypeI   = iota + 1 // name-dd_mm_yyyy-maintainer OR name-versionString-maintainer OR name-dd_mm_yyyy-repo OR name-versionString-repo
 	TypeII             // name#repo[:version]
@@ -79,8 +136,9 @@ const (
 	ValidSubstr        = `^[A-Za-z0-9._]+$`
 	ValidRepoSubstr    = `^[A-Za-z0-9._/\-]+$`
 	ValidNameSubstr    = `^[A-Za-z0-9._/\-]+$`
-	ValidVersionSubstr = `^[A-Za-z0-9._]+$` // Version cannot contain hyphens
-	TypeIFormat        = `^(.+)-(\d{2}_\d{2}_\d{4}|\d{4}\d{2}\d{2}|\d{4}_\d{2}_\d{2})-([^-]+)$`
+	ValidVersionSubstr = `^[A-Za-z0-9._]+$`                                          // Version cannot contain hyphens
+	TypeIFormat        = `^(.+)-(\d[^-]*|[vV]\d[^-]*|%[0-9A-Fa-f]{2}[^-]*)-([^-]+)$` // The date (or version) and the repo have no hyphens, as they are escaped
+	TypeIVersion       = `^[vV]?\d`                                                  // What type I versions start with, unless their first character is escaped
 	TypeIIFormat       = `^([^#]+)#([^:@]+)(?::([^@]+))?$`
 	TypeIIIFormat      = `^([^#]+)#([^:@]+)(?::([^@]+))?(@(?:\d{2}_\d{2}_\d{4}|\d{4}\d{2}\d{2}|\d{4}_\d{2}_\d{2}))$`
 	DateFormat         = `^(\d{2})_(\d{2})_(\d{4})$`
@@ -92,6 +150,7 @@ const (
 
 var (
 	typeIRe              = regexp.MustCompile(TypeIFormat)
+	typeIVersionRe       = regexp.MustCompile(TypeIVersion)
 	typeIIRe             = regexp.MustCompile(TypeIIFormat)
 	typeIIIRe            = regexp.MustCompile(TypeIIIFormat)
 	dateRe               = regexp.MustCompile(DateFormat)
@@ -135,7 +194,7 @@ func isDateString(s string) bool {
 	return false
 }
 
-// formatDate formats a time using the preferred DD_MM_YYYY format
+// formatDate formats a time using the canonical YYYYMMDD format
 func formatDate(t *time.Time) string {
 	if t == nil {
 		return ""
@@ -248,7 +307,16 @@ func ParseAppBundleID(raw string) (*AppBundleID, int, error) {
 
 	// Handle type I format
 	if m := typeIRe.FindStringSubmatch(raw); m != nil {
-		name, err := validateField(m[1], "name")
+		fields := make([]string, 3)
+		for i, field := range m[1:] {
+			unescaped, err := url.PathUnescape(field)
+			if err != nil {
+				return nil, -1, fmt.Errorf("invalid escape in AppBundleID: %w", err)
+			}
+			fields[i] = unescaped
+		}
+
+		name, err := validateField(fields[0], "name")
 		if err != nil {
 			return nil, -1, err
 		}
@@ -256,7 +324,7 @@ func ParseAppBundleID(raw string) (*AppBundleID, int, error) {
 		var version string
 		var t *time.Time
 
-		// Check if second part is a date or version using the new multi-format date checker
+		// Check if second part is a date or version using the new multi-format date checker. Versions that look like dates are escaped
 		if isDateString(m[2]) {
 			parsedTime, err := parseDate(m[2])
 			if err != nil {
@@ -265,13 +333,13 @@ func ParseAppBundleID(raw string) (*AppBundleID, int, error) {
 			t = parsedTime
 		} else {
 			// It's a version string
-			version, err = validateField(m[2], "version")
+			version, err = validateField(fields[1], "version")
 			if err != nil {
 				return nil, -1, err
 			}
 		}
 
-		repo, err := validateField(m[3], "maintainer")
+		repo, err := validateField(fields[2], "repo")
 		if err != nil {
 			return nil, -1, err
 		}
@@ -299,11 +367,16 @@ func (a *AppBundleID) Format(formatType int) (string, error) {
 		if a.Name == "" || a.Repo == "" {
 			return "", fmt.Errorf("insufficient fields for type I format")
 		}
+		name, repo := escapeTypeIField(a.Name, "%/"), escapeTypeIField(a.Repo, "%-/")
 		if a.Date != nil {
-			return fmt.Sprintf("%s-%s-%s", a.Name, formatDate(a.Date), a.Repo), nil
+			return fmt.Sprintf("%s-%s-%s", name, formatDate(a.Date), repo), nil
 		}
 		if a.Version != "" {
-			return fmt.Sprintf("%s-%s-%s", a.Name, a.Version, a.Repo), nil
+			version := escapeTypeIField(a.Version, "%-/")
+			if isDateString(version) || !typeIVersionRe.MatchString(version) {
+				version = fmt.Sprintf("%%%02X", version[0]) + version[1:]
+			}
+			return fmt.Sprintf("%s-%s-%s", name, version, repo), nil
 		}
 		return "", fmt.Errorf("type I format requires date or version")
 
@@ -335,6 +408,28 @@ func (a *AppBundleID) Format(formatType int) (string, error) {
 	}
 }
 
+// escapeTypeIField escapes the given characters of a field of a type I AppBundleID
+func escapeTypeIField(field, chars string) string {
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if strings.IndexByte(chars, field[i]) != -1 {
+			fmt.Fprintf(&b, "%%%02X", field[i])
+		} else {
+			b.WriteByte(field[i])
+		}
+	}
+	return b.String()
+}
+
+// CanonicalAppBundleID returns the canonical form of an AppBundleID, written in the same type.
+func CanonicalAppBundleID(raw string) (string, error) {
+	id, formatType, err := ParseAppBundleID(raw)
+	if err != nil {
+		return "", err
+	}
+	return id.Format(formatType)
+}
+
 // String returns the canonical string representation.
 // Prefers type III if possible, falls back to type II, then type I.
 func (a *AppBundleID) String() string {
@@ -362,11 +457,16 @@ func (a *AppBundleID) String() string {
 }
 
 // MarshalText implements encoding.TextMarshaler.
+// Raw is kept as it was written, so that the AppBundleID round-trips losslessly, unless the fields were changed since it was parsed.
 func (a *AppBundleID) MarshalText() ([]byte, error) {
 	if a == nil {
 		return nil, nil
 	}
 
+	if parsed, _, err := ParseAppBundleID(a.Raw); err == nil && parsed.equal(a) {
+		return []byte(a.Raw), nil
+	}
+
 	// Try to marshal in preferred order: III, II, I
 	for _, formatType := range []int{TypeIII, TypeII, TypeI} {
 		if s, err := a.Format(formatType); err == nil {
@@ -392,6 +492,14 @@ func (a *AppBundleID) UnmarshalText(text []byte) error {
 	return nil
 }
 
+// equal tells whether two AppBundleIDs have the same fields, Raw aside
+func (a *AppBundleID) equal(b *AppBundleID) bool {
+	if a.Name != b.Name || a.Repo != b.Repo || a.Version != b.Version || (a.Date == nil) != (b.Date == nil) {
+		return false
+	}
+	return a.Date == nil || a.Date.Equal(*b.Date)
+}
+
 // IsDated returns true if a date is present.
 func (a *AppBundleID) IsDated() bool {
 	return a != nil && a.Date != nil
@@ -423,6 +531,143 @@ func (a *AppBundleID) Compliant() (int, error) {
 	return t, err
 }
 
+// Compare tells which of two AppBundleIDs of the same application is newer: it returns -1 if a is older than b, 1 if it is
+// newer, and 0 if they can't be told apart. Their versions are compared with CompareVersions, and their dates are used when
+// either has no version or both have the same. A nil AppBundleID is older than any other. Use SameApp to check that the
+// AppBundleIDs are of the same application first, as any two of them are ordered.
+func Compare(a, b *AppBundleID) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+
+	if a.Version != "" && b.Version != "" {
+		if c := CompareVersions(a.Version, b.Version); c != 0 {
+			return c
+		}
+	}
+	if a.Date != nil && b.Date != nil {
+		return a.Date.Compare(*b.Date)
+	}
+	return 0
+}
+
+// SameApp tells whether two AppBundleIDs are of the same application: they have the same name, and come from the same repo.
+// Names and repos are compared case-insensitively. As the repo of a type I AppBundleID may only be the name of its maintainer,
+// a repo without dots also matches the repos (such as github.com.maintainer.app) of which it is a segment.
+func SameApp(a, b *AppBundleID) bool {
+	if a == nil || b == nil || !strings.EqualFold(a.Name, b.Name) {
+		return false
+	}
+	if strings.EqualFold(a.Repo, b.Repo) {
+		return true
+	}
+	maintainer, repo := a.Repo, b.Repo
+	if strings.Contains(maintainer, ".") {
+		maintainer, repo = repo, maintainer
+	}
+	if maintainer == "" || strings.Contains(maintainer, ".") {
+		return false
+	}
+	for _, segment := range strings.Split(repo, ".") {
+		if strings.EqualFold(segment, maintainer) {
+			return true
+		}
+	}
+	return false
+}
+
+// Suffixes of pre-releases, by order of precedence. They make a version older than the same one without them, whereas any
+// other suffix (such as the r of 1.2.3_r1, or the p of 1.2.3_p1) makes it newer
+var preReleases = []string{"dev", "alpha", "beta", "pre", "preview", "rc"}
+
+// CompareVersions compares two versions, returning -1 if a is older than b, 1 if it is newer, and 0 if they are the same.
+// Versions are split in numbers, compared numerically, and words: 1.10 is newer than 1.9, 1.2.3_r1 (as -r1 is normalized by
+// ParseAppBundleID) is newer than 1.2.3, and 1.2.3-beta2 is older than it, as is 1.2.3_rc1. A leading v and semver build
+// metadata (+...) are ignored.
+func CompareVersions(a, b string) int {
+	ta, tb := versionTokens(a), versionTokens(b)
+	for i := 0; i < len(ta) || i < len(tb); i++ {
+		switch {
+		case i == len(ta):
+			return versionEndWeight(tb[i])
+		case i == len(tb):
+			return -versionEndWeight(ta[i])
+		}
+		if c := compareVersionTokens(ta[i], tb[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// versionTokens splits a version in numbers and words, dropping the separators
+func versionTokens(version string) []string {
+	version, _, _ = strings.Cut(version, "+")
+	if len(version) > 1 && (version[0] == 'v' || version[0] == 'V') && version[1] >= '0' && version[1] <= '9' {
+		version = version[1:]
+	}
+
+	var tokens []string
+	start := -1
+	for i := 0; i <= len(version); i++ {
+		if start != -1 && (i == len(version) || !isAlnum(rune(version[i])) || isDigit(version[i]) != isDigit(version[start])) {
+			tokens = append(tokens, strings.ToLower(version[start:i]))
+			start = -1
+		}
+		if start == -1 && i < len(version) && isAlnum(rune(version[i])) {
+			start = i
+		}
+	}
+	return tokens
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// versionEndWeight returns 1 if a version that ends where the other goes on with token is newer than it, as token is a
+// pre-release suffix, or -1 if it is older
+func versionEndWeight(token string) int {
+	if slices.Contains(preReleases, token) {
+		return 1
+	}
+	return -1
+}
+
+// compareVersionTokens compares two tokens of versions. Numbers are newer than words, and pre-release suffixes are older than
+// the other words
+func compareVersionTokens(a, b string) int {
+	aNumber, bNumber := isDigit(a[0]), isDigit(b[0])
+	switch {
+	case aNumber && bNumber:
+		a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+		if len(a) != len(b) {
+			return cmp.Compare(len(a), len(b))
+		}
+		return strings.Compare(a, b)
+	case aNumber:
+		return 1
+	case bNumber:
+		return -1
+	}
+
+	aPre, bPre := slices.Index(preReleases, a), slices.Index(preReleases, b)
+	switch {
+	case aPre != -1 && bPre != -1:
+		return cmp.Compare(aPre, bPre)
+	case aPre != -1:
+		return -1
+	case bPre != -1:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
 // --- Appstream-related stuff ---
 
 // AppStreamIDToName extracts the application name from an AppStream ID.
@@ -69,6 +69,27 @@ func TestParseAppBundleID(t *testing.T) {
 			raw:       "invalid_format_string",
 			shouldErr: true,
 		},
+		{
+			name:      "Hyphenated words are not a type I AppBundleID",
+			raw:       "google-chrome-stable",
+			shouldErr: true,
+		},
+		{
+			name:      "Hyphenated words ending in an architecture are not a type I AppBundleID",
+			raw:       "ffmpeg-static-x86_64",
+			shouldErr: true,
+		},
+		{
+			name:      "Type I version that starts with v",
+			raw:       "some-tool-v2.1-xplshn",
+			shouldErr: false,
+			expected: &AppBundleID{
+				Raw:     "some-tool-v2.1-xplshn",
+				Name:    "some-tool",
+				Repo:    "xplshn",
+				Version: "v2.1",
+			},
+		},
 		{
 			name:      "Invalid characters in repo",
 			raw:       "app#core$repo:v1",
@@ -692,3 +713,253 @@ func TestIsRepo(t *testing.T) {
 		})
 	}
 }
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"v1.2.3", "1.2.3", 0},
+		{"1.2.3+build.5", "1.2.3", 0},
+		{"1.2.3", "1.2.4", -1},
+		{"1.10", "1.9", 1},
+		{"1.02", "1.2", 0},
+		{"2.0", "1.99.99", 1},
+		{"1.2", "1.2.1", -1},
+		{"1.2.3_r1", "1.2.3", 1},
+		{"1.2.3_r2", "1.2.3_r10", -1},
+		{"1.2.3_p1", "1.2.3", 1},
+		{"1.2.3_p1", "1.2.4", -1},
+		{"1.0.1a", "1.0.1", 1},
+		{"1.2.3_beta", "1.2.3", -1},
+		{"1.2.3_beta2", "1.2.3_beta10", -1},
+		{"1.2.3_rc1", "1.2.3_beta3", 1},
+		{"1.2.3_alpha", "1.2.3_dev", 1},
+		{"1.2.3_rc1", "1.2.3", -1},
+		{"1.2.3_rc1", "1.2.2", 1},
+		{"1.2.3-rc.1", "1.2.3_rc1", 0},
+		{"1.2.3.1", "1.2.3_rc1", 1},
+		{"1.2.3_RC1", "1.2.3_rc1", 0},
+		{"2024.01.31", "2023.12.01", 1},
+		{"", "1.0", -1},
+		{"", "", 0},
+	}
+	for _, tt := range tests {
+		if got := CompareVersions(tt.a, tt.b); got != tt.expected {
+			t.Errorf("CompareVersions(%q, %q) = %d, expected %d", tt.a, tt.b, got, tt.expected)
+		}
+		if got := CompareVersions(tt.b, tt.a); got != -tt.expected {
+			t.Errorf("CompareVersions(%q, %q) = %d, expected %d", tt.b, tt.a, got, -tt.expected)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	parse := func(raw string) *AppBundleID {
+		id, _, err := ParseAppBundleID(raw)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", raw, err)
+		}
+		return id
+	}
+	tests := []struct {
+		name     string
+		a, b     string
+		expected int
+	}{
+		{"Semver", "app#repo:1.2.3", "app#repo:1.10.0", -1},
+		{"Same version", "app#repo:1.2.3", "app#repo:v1.2.3", 0},
+		{"Distro revision", "app#repo:1.2.3-r1", "app#repo:1.2.3", 1},
+		{"Distro revisions", "app#repo:1.2.3-r2", "app#repo:1.2.3_r1", 1},
+		{"Pre-release", "app#repo:1.2.3-beta", "app#repo:1.2.3", -1},
+		{"Date fallback without versions", "app#repo@20240101", "app#repo@20231231", 1},
+		{"Date fallback with a missing version", "app#repo:1.0@20240101", "app#repo@20240102", -1},
+		{"Date breaks version ties", "app#repo:1.0@20240101", "app#repo:1.0@20240102", -1},
+		{"Version wins over date", "app#repo:2.0@20230101", "app#repo:1.0@20240101", 1},
+		{"Different date formats", "app#repo@01_02_2024", "app#repo@2024_02_01", 0},
+		{"Nothing to compare", "app#repo", "app#repo:1.0", 0},
+		{"Type I with date", "app-20240101-maintainer", "app-20230101-maintainer", 1},
+		{"Type I with version", "app-1.2-maintainer", "app-1.10-maintainer", -1},
+		{"Type I and type II", "app-1.2-maintainer", "app#github.com/maintainer/app:1.3", -1},
+		{"Type I with date and type II", "app-20240101-maintainer", "app#github.com/maintainer/app:1.3", 0},
+		{"Type I and type III", "app-02_01_2024-maintainer", "app#github.com/maintainer/app:1.3@20240101", 1},
+		{"Type II and type III", "app#repo:2.0", "app#repo:1.0@20240101", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := parse(tt.a), parse(tt.b)
+			if got := Compare(a, b); got != tt.expected {
+				t.Errorf("Compare(%q, %q) = %d, expected %d", tt.a, tt.b, got, tt.expected)
+			}
+			if got := Compare(b, a); got != -tt.expected {
+				t.Errorf("Compare(%q, %q) = %d, expected %d", tt.b, tt.a, got, -tt.expected)
+			}
+		})
+	}
+
+	if Compare(nil, parse("app#repo")) != -1 || Compare(parse("app#repo"), nil) != 1 || Compare(nil, nil) != 0 {
+		t.Errorf("Expected nil to be older than any AppBundleID")
+	}
+}
+
+func TestSameApp(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b     *AppBundleID
+		expected bool
+	}{
+		{"Same name and repo", &AppBundleID{Name: "app", Repo: "repo", Version: "1.0"}, &AppBundleID{Name: "app", Repo: "repo", Version: "2.0"}, true},
+		{"Different case", &AppBundleID{Name: "App", Repo: "github.com.User.app"}, &AppBundleID{Name: "app", Repo: "github.com.user.app"}, true},
+		{"Different name", &AppBundleID{Name: "app", Repo: "repo"}, &AppBundleID{Name: "other", Repo: "repo"}, false},
+		{"Different repo", &AppBundleID{Name: "app", Repo: "repo"}, &AppBundleID{Name: "app", Repo: "other"}, false},
+		{"Type I maintainer within the repo", &AppBundleID{Name: "app", Repo: "maintainer"}, &AppBundleID{Name: "app", Repo: "github.com.maintainer.app"}, true},
+		{"Type I maintainer within the repo, reversed", &AppBundleID{Name: "app", Repo: "github.com.maintainer.app"}, &AppBundleID{Name: "app", Repo: "maintainer"}, true},
+		{"Type I maintainer not within the repo", &AppBundleID{Name: "app", Repo: "someone"}, &AppBundleID{Name: "app", Repo: "github.com.maintainer.app"}, false},
+		{"Different dotted repos", &AppBundleID{Name: "app", Repo: "github.com.maintainer.app"}, &AppBundleID{Name: "app", Repo: "gitlab.com.maintainer.app"}, false},
+		{"Missing repo", &AppBundleID{Name: "app"}, &AppBundleID{Name: "app", Repo: "github.com.maintainer.app"}, false},
+		{"Nil", nil, &AppBundleID{Name: "app", Repo: "repo"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SameApp(tt.a, tt.b); got != tt.expected {
+				t.Errorf("SameApp(%+v, %+v) = %v, expected %v", tt.a, tt.b, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestTypeIEscaping(t *testing.T) {
+	tests := []struct {
+		name     string
+		id       *AppBundleID
+		expected string
+	}{
+		{"Hyphens in the name", &AppBundleID{Name: "some-tool", Repo: "user", Date: parseTime(t, "2024_01_31")}, "some-tool-20240131-user"},
+		{"Hyphens in the repo", &AppBundleID{Name: "app", Repo: "github.com.some-user.app", Version: "1.0"}, "app-1.0-github.com.some%2Duser.app"},
+		{"Slashes in the name", &AppBundleID{Name: "org/app", Repo: "user", Version: "1.0"}, "org%2Fapp-1.0-user"},
+		{"Version that looks like a date", &AppBundleID{Name: "app", Repo: "user", Version: "20240131"}, "app-%320240131-user"},
+		{"Version that looks like a DD_MM_YYYY date", &AppBundleID{Name: "app", Repo: "user", Version: "31_01_2024"}, "app-%331_01_2024-user"},
+		{"Version that isn't a date", &AppBundleID{Name: "app", Repo: "user", Version: "20241399"}, "app-20241399-user"},
+		{"Version that doesn't start with a digit", &AppBundleID{Name: "app", Repo: "user", Version: "nightly"}, "app-%6Eightly-user"},
+		{"Version that starts with v and a digit", &AppBundleID{Name: "app", Repo: "user", Version: "v2"}, "app-v2-user"},
+		{"Date over version", &AppBundleID{Name: "app", Repo: "user", Version: "1.0", Date: parseTime(t, "2024_01_31")}, "app-20240131-user"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			formatted, err := tt.id.Format(TypeI)
+			if err != nil || formatted != tt.expected {
+				t.Fatalf("Format(TypeI) = %q, %v, expected %q", formatted, err, tt.expected)
+			}
+			parsed, formatType, err := ParseAppBundleID(formatted)
+			if err != nil || formatType != TypeI {
+				t.Fatalf("Failed to parse %q as type I: %v (type %d)", formatted, err, formatType)
+			}
+			expected := *tt.id
+			if expected.Date != nil {
+				expected.Version = ""
+			}
+			if !parsed.equal(&expected) {
+				t.Errorf("%q was parsed as %+v, expected %+v", formatted, parsed, expected)
+			}
+		})
+	}
+
+	if _, _, err := ParseAppBundleID("app-1.0-user%2"); err == nil {
+		t.Errorf("Expected an invalid escape to be rejected")
+	}
+}
+
+func TestCanonicalAppBundleID(t *testing.T) {
+	tests := []struct {
+		raw      string
+		expected string
+	}{
+		{"app#github.com/user/app:1.2-r1", "app#github.com.user.app:1.2_r1"},
+		{"app#repo:1.0@31_01_2024", "app#repo:1.0@20240131"},
+		{"app#repo@2024_01_31", "app#repo@20240131"},
+		{"some-tool-31_01_2024-user", "some-tool-20240131-user"},
+		{"app-1.0-user/repo", "app-1.0-user.repo"},
+		{"app#repo", "app#repo"},
+	}
+	for _, tt := range tests {
+		canonical, err := CanonicalAppBundleID(tt.raw)
+		if err != nil || canonical != tt.expected {
+			t.Errorf("CanonicalAppBundleID(%q) = %q, %v, expected %q", tt.raw, canonical, err, tt.expected)
+		}
+	}
+}
+
+func TestMarshalTextKeepsRaw(t *testing.T) {
+	for _, raw := range []string{"app#github.com/user/app:1.2-r1", "tool-31_01_2024-user", "app#repo:v1@2024_01_31"} {
+		var id AppBundleID
+		if err := id.UnmarshalText([]byte(raw)); err != nil {
+			t.Fatalf("UnmarshalText(%q) failed: %v", raw, err)
+		}
+		if text, err := id.MarshalText(); err != nil || string(text) != raw {
+			t.Errorf("Expected %q to round-trip, got %q (%v)", raw, text, err)
+		}
+
+		// Changed fields aren't hidden behind Raw
+		id.Version = "9.9"
+		if text, _ := id.MarshalText(); string(text) == raw {
+			t.Errorf("Expected the changed version of %q to be marshaled, got %q", raw, text)
+		}
+	}
+}
+
+// FuzzAppBundleID checks that formatting a parsed AppBundleID, in any type, yields one that parses to the same fields (those
+// that the type can hold) and formats the same again, and that Raw survives marshaling
+func FuzzAppBundleID(f *testing.F) {
+	for _, seed := range []string{
+		"app#repo",
+		"app#repo:1.0",
+		"app#github.com/user/app:1.2.3-r1@20240131",
+		"app#repo@31_01_2024",
+		"some-tool-13_04_2022-xplshn",
+		"some-tool-2022_04_13-xplshn",
+		"app-v1.0-github.com.some%2Duser.app",
+		"org%2Fapp-%3220240131-user",
+		"io.github.user.App#user/repo:20240131@20240131",
+		"a-b-c-d-e",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, raw string) {
+		id, _, err := ParseAppBundleID(raw)
+		if err != nil {
+			return
+		}
+
+		for _, formatType := range []int{TypeI, TypeII, TypeIII} {
+			formatted, err := id.Format(formatType)
+			if err != nil {
+				continue
+			}
+			parsed, _, err := ParseAppBundleID(formatted)
+			if err != nil {
+				t.Fatalf("%q was formatted as %q (type %d), which doesn't parse: %v", raw, formatted, formatType, err)
+			}
+
+			expected := *id
+			switch {
+			case formatType == TypeI && expected.Date != nil:
+				expected.Version = ""
+			case formatType == TypeII:
+				expected.Date = nil
+			}
+			if !parsed.equal(&expected) {
+				t.Fatalf("%q was formatted as %q (type %d), which parses as %+v instead of %+v", raw, formatted, formatType, parsed, expected)
+			}
+			if again, err := parsed.Format(formatType); err != nil || again != formatted {
+				t.Fatalf("%q was formatted as %q (type %d), and then as %q (%v)", raw, formatted, formatType, again, err)
+			}
+		}
+
+		text, err := id.MarshalText()
+		if err != nil || string(text) != raw {
+			t.Fatalf("%q was marshaled as %q (%v)", raw, text, err)
+		}
+	})
+}